@@ -0,0 +1,189 @@
+package blob
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchMaxBytes      = 4 * 1024 * 1024
+	defaultBatchMaxPoints     = 100
+	defaultBatchFlushInterval = 50 * time.Millisecond
+)
+
+// BatchOptions controls when a BatchUploader sends its pending blocks.
+// Zero values are replaced with defaults.
+type BatchOptions struct {
+	// MaxBytes is the size of line protocol body that triggers a write.
+	// A single block larger than MaxBytes is sent in a write of its own.
+	MaxBytes int
+
+	// MaxPoints is the number of blocks that triggers a write.
+	MaxPoints int
+
+	// FlushInterval is the longest a block will wait for other blocks to join its batch.
+	FlushInterval time.Duration
+}
+
+// BatchUploader coalesces blocks from concurrent calls to UploadBlock
+// into a single write request against an InfluxVolume.
+//
+// UploadBlock blocks until the batch containing the block has been written,
+// so the size of a batch is bounded by the number of concurrent callers.
+type BatchUploader struct {
+	v    *InfluxVolume
+	opts BatchOptions
+
+	mu  sync.Mutex
+	cur *batch
+}
+
+// batch is a set of lines that will be sent in one write.
+// err is only safe to read after done is closed.
+type batch struct {
+	buf   []byte
+	n     int
+	timer *time.Timer
+
+	done chan struct{}
+	err  error
+}
+
+// Batcher is implemented by a Volume whose block uploads can be coalesced into fewer requests.
+type Batcher interface {
+	// Batched returns a Volume that reads like this one,
+	// but whose uploaded and linked blocks are written in batches according to opts.
+	Batched(opts BatchOptions) Volume
+}
+
+var (
+	_ Batcher = (*InfluxVolume)(nil)
+	_ Batcher = (*ReplicatedVolume)(nil)
+)
+
+// batchedVolume is an InfluxVolume whose blocks are written through a BatchUploader.
+type batchedVolume struct {
+	*InfluxVolume
+	u *BatchUploader
+}
+
+func (v batchedVolume) UploadBlock(data []byte, bm *BlockMeta) error {
+	return v.u.UploadBlock(data, bm)
+}
+
+func (v batchedVolume) LinkBlock(bm, src *BlockMeta) error {
+	return v.u.LinkBlock(bm, src)
+}
+
+// Batched returns the volume with its blocks written through a new BatchUploader.
+func (v *InfluxVolume) Batched(opts BatchOptions) Volume {
+	return batchedVolume{InfluxVolume: v, u: NewBatchUploader(v, opts)}
+}
+
+// NewBatchUploader returns a BatchUploader that writes batches to v.
+func NewBatchUploader(v *InfluxVolume, opts BatchOptions) *BatchUploader {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultBatchMaxBytes
+	}
+	if opts.MaxPoints <= 0 {
+		opts.MaxPoints = defaultBatchMaxPoints
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultBatchFlushInterval
+	}
+
+	return &BatchUploader{
+		v:    v,
+		opts: opts,
+	}
+}
+
+// UploadBlock adds the block to the current batch and waits for that batch to be written.
+// The returned error is the result of writing the whole batch.
+// This method is safe to call concurrently.
+func (u *BatchUploader) UploadBlock(data []byte, bm *BlockMeta) error {
+	// Encode outside the lock so that concurrent callers encode in parallel.
+	line, err := u.v.appendBlockLine(nil, data, bm)
+	if err != nil {
+		return err
+	}
+	return u.add(line)
+}
+
+// LinkBlock adds a reference from bm to src to the current batch, as InfluxVolume.LinkBlock,
+// and waits for that batch to be written.
+// This method is safe to call concurrently.
+func (u *BatchUploader) LinkBlock(bm, src *BlockMeta) error {
+	line, err := u.v.appendLinkLine(nil, bm, src)
+	if err != nil {
+		return err
+	}
+	return u.add(line)
+}
+
+// Commit commits the version directly through the InfluxVolume.
+// Every block of the version must have been uploaded already, so there is nothing to batch with.
+func (u *BatchUploader) Commit(fm *FileMeta) error {
+	return u.v.Commit(fm)
+}
+
+// add appends line to the current batch and waits for that batch to be written.
+func (u *BatchUploader) add(line []byte) error {
+	u.mu.Lock()
+	if u.cur != nil && len(u.cur.buf)+len(line) > u.opts.MaxBytes {
+		u.flushLocked()
+	}
+	if u.cur == nil {
+		u.cur = u.newBatchLocked()
+	}
+
+	b := u.cur
+	b.buf = append(b.buf, line...)
+	b.n++
+	if b.n >= u.opts.MaxPoints || len(b.buf) >= u.opts.MaxBytes {
+		u.flushLocked()
+	}
+	u.mu.Unlock()
+
+	<-b.done
+	return b.err
+}
+
+// Flush starts writing the current batch, if any, without waiting for it to fill.
+func (u *BatchUploader) Flush() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.cur != nil {
+		u.flushLocked()
+	}
+}
+
+// newBatchLocked returns a new batch that flushes itself after the flush interval.
+// u.mu must be held.
+func (u *BatchUploader) newBatchLocked() *batch {
+	b := &batch{done: make(chan struct{})}
+	b.timer = time.AfterFunc(u.opts.FlushInterval, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		// The batch may have already been flushed for being full.
+		if u.cur == b {
+			u.flushLocked()
+		}
+	})
+	return b
+}
+
+// flushLocked detaches the current batch and writes it in the background.
+// u.mu must be held and u.cur must not be nil.
+func (u *BatchUploader) flushLocked() {
+	b := u.cur
+	u.cur = nil
+	b.timer.Stop()
+
+	go func() {
+		b.err = u.v.client.SendWrite(b.buf, u.v.blockSendOpts())
+		close(b.done)
+	}()
+}
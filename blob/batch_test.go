@@ -0,0 +1,95 @@
+package blob_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+)
+
+func TestBatchUploader_CoalescesBlocks(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	src := []byte("abcdefghijklmnop")
+	fm, err := blob.NewFileMeta(bytes.NewReader(src))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm.Path = "/my/file"
+	fm.BlockSize = 4
+
+	v := blob.NewInfluxVolume(s.URL, "db", "")
+	u := blob.NewBatchUploader(v, blob.BatchOptions{MaxPoints: 2, FlushInterval: time.Minute})
+
+	var wg sync.WaitGroup
+	errs := make([]error, fm.NumBlocks())
+	for i := 0; i < fm.NumBlocks(); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bm := fm.NewBlockMeta(i)
+			errs[i] = u.UploadBlock(src[bm.FileOffset():int(bm.FileOffset())+bm.ExpSize()], bm)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("block %d: exp no err, got %s", i, err)
+		}
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("exp 2 writes, got %d", len(bodies))
+	}
+	for _, b := range bodies {
+		if n := strings.Count(b, "\n"); n != 2 {
+			t.Fatalf("exp 2 lines per write, got %d in %q", n, b)
+		}
+	}
+}
+
+func TestBatchUploader_FlushIntervalAndErrors(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	fm, err := blob.NewFileMeta(strings.NewReader("abc"))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm.Path = "/my/file"
+	fm.BlockSize = 4
+
+	v := blob.NewInfluxVolume(s.URL, "db", "")
+	u := blob.NewBatchUploader(v, blob.BatchOptions{FlushInterval: time.Millisecond})
+
+	// A lone block must be sent once the flush interval elapses,
+	// and the failure of its batch must be reported back.
+	done := make(chan error)
+	go func() { done <- u.UploadBlock([]byte("abc"), fm.NewBlockMeta(0)) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("exp err from failed write, got nil")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("UploadBlock did not complete in time")
+	}
+}
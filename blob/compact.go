@@ -0,0 +1,101 @@
+package blob
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mark-rushakoff/influx-blob/internal/influxclient"
+)
+
+// compactTag is the tag holding the schema of blocks written with SchemaCompact,
+// which store every block of a version in a single series:
+//
+// Tags:
+//   bs, sha256: As with SchemaSeries.
+//   v: The Schema of the block, base 10. Only blocks written with SchemaCompact or later have it.
+//
+// Fields:
+//   h: The SHA256 checksum of the block, plain ASCII hex representation.
+//      It is a field rather than the bsha256 tag so that it does not multiply series.
+//   fsz: The size of the file, as with SchemaManifest.
+//   b, z, ref: As with SchemaSeries. The encoding is recorded in the version's manifest, as with SchemaManifest.
+//
+// The point's time, in nanoseconds, is the time of the version plus the index of the block,
+// so a version has at most compactMaxBlocks blocks.
+const compactTag = "v"
+
+// compactMaxBlocks is the number of nanoseconds in the second of a version's time,
+// and so the number of blocks a version written with SchemaCompact may have.
+const compactMaxBlocks = 1e9
+
+// blockTime returns the timestamp of bm's point, in the precision of blockSendOpts.
+func (v *InfluxVolume) blockTime(bm *BlockMeta) (int64, error) {
+	if v.schema != SchemaCompact {
+		return bm.Time, nil
+	}
+	if bm.Index < 0 || bm.Index >= compactMaxBlocks {
+		return 0, fmt.Errorf("block %d of %s: schema %d allows at most %d blocks", bm.Index, bm.Path, SchemaCompact, int64(compactMaxBlocks))
+	}
+	return bm.Time*compactMaxBlocks + int64(bm.Index), nil
+}
+
+// compactBlocks calls fn with the tags of the series, the index, the version time in seconds,
+// the checksum and the file size of every block of path written with SchemaCompact.
+// If where is not empty, only the blocks whose series also match that InfluxQL condition are read.
+func (v *InfluxVolume) compactBlocks(path, where string, fn func(tags map[string]string, bi int, t int64, sum string, fsz int) error) error {
+	qopts := v.queryOpts()
+	qopts.Epoch = "ns"
+
+	q := fmt.Sprintf("SELECT h, fsz FROM %q WHERE %s = '%d'", path, compactTag, SchemaCompact)
+	if where != "" {
+		q += " AND " + where
+	}
+	q += " GROUP BY bs, sha256"
+	return v.client.Query(q, qopts, func(h *influxclient.SeriesHeader, row []json.RawMessage) error {
+		if len(row) < 3 {
+			return fmt.Errorf("short row in response to: %s", q)
+		}
+		var t int64
+		if err := json.Unmarshal(row[0], &t); err != nil {
+			return err
+		}
+		var sum string
+		if err := json.Unmarshal(row[1], &sum); err != nil {
+			return err
+		}
+		var fsz int
+		if err := json.Unmarshal(row[2], &fsz); err != nil {
+			return err
+		}
+		return fn(h.Tags, int(t%compactMaxBlocks), t/compactMaxBlocks, sum, fsz)
+	})
+}
+
+// downloadCompactBlocks fetches the blocks in bms, all written with SchemaCompact for the same version,
+// with a single query over the range of their times, calling fn with the index and encoded data of each.
+func (v *InfluxVolume) downloadCompactBlocks(bms []*BlockMeta, fn func(bi int, src influxclient.BlockSource, encoded []byte) error) error {
+	if len(bms) == 0 {
+		return nil
+	}
+
+	fm := bms[0].FileMeta
+	lo, hi := bms[0].Index, bms[0].Index
+	for _, bm := range bms {
+		if bm.Index < lo {
+			lo = bm.Index
+		}
+		if bm.Index > hi {
+			hi = bm.Index
+		}
+	}
+
+	tags := map[string]string{
+		"bs":       fmt.Sprint(fm.BlockSize),
+		"sha256":   fmt.Sprintf("%x", fm.SHA256[:]),
+		compactTag: fmt.Sprint(int(SchemaCompact)),
+	}
+	base := fm.Time * compactMaxBlocks
+	return v.client.GetBlocksInRange(fm.Path, tags, base+int64(lo), base+int64(hi), v.queryOpts(), func(t int64, src influxclient.BlockSource, encoded []byte) error {
+		return fn(int(t-base), src, encoded)
+	})
+}
@@ -0,0 +1,220 @@
+package blob_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+func TestInfluxVolume_SchemaCompact(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	e := engine.NewEngine(8, 4)
+	v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: blob.SchemaCompact})
+
+	src, fm := randomFile(t, "/my/file", 10*1024+3, 1024, 1500000000)
+	roundTrip(t, e, v, src, fm)
+
+	points := s.Points("blob", fm.Path)
+	if len(points) != fm.NumBlocks() {
+		t.Fatalf("exp one point per block, got %d", len(points))
+	}
+	for i, p := range points {
+		if len(p.Tags) != 3 || p.Tags["v"] != "3" || p.Fields["h"] == nil || p.Time != fm.Time*1e9+int64(i) {
+			t.Fatalf("exp block %d in a single series with its index in the time, got %+v", i, p)
+		}
+	}
+	// One series for the blocks and one for the manifest.
+	if n := s.SeriesN("blob"); n != 2 {
+		t.Fatalf("exp 2 series, got %d", n)
+	}
+	fms, err := v.Stat(fm.Path, blob.ListOptions{})
+	if err != nil || len(fms) != 1 || fms[0].Schema != blob.SchemaCompact {
+		t.Fatalf("exp one version of schema 3, got %v (%v)", fms, err)
+	}
+
+	bms, err := v.ListBlocks(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A block is read by the time of its point, rather than by matching its checksum against every point.
+	_, before := s.Requests()
+	if data, err := v.DownloadBlock(bms[3]); err != nil || !bytes.Equal(data, src[3*1024:4*1024]) {
+		t.Fatalf("exp block 3, got %v", err)
+	}
+	if _, after := s.Requests(); after-before != 1 {
+		t.Fatalf("exp one query to download a block, got %d", after-before)
+	}
+
+	// A second version, linking its unchanged blocks to the first.
+	src2 := append([]byte(nil), src...)
+	src2[0] ^= 0xff
+	fm2, err := blob.NewFileMeta(bytes.NewReader(src2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm2.Path, fm2.BlockSize, fm2.Time = fm.Path, 1024, 1500000100
+	for _, bm := range bms {
+		nbm := fm2.NewBlockMeta(bm.Index)
+		if bm.Index == 0 {
+			if err := nbm.SetSHA256(bytes.NewReader(src2[:1024])); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.UploadBlock(src2[:1024], nbm); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		nbm.SHA256 = bm.SHA256
+		if err := v.LinkBlock(nbm, bm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.Commit(fm2); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	// Either schema reads both versions, including the linked blocks.
+	other := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: blob.SchemaManifest})
+	for _, rv := range []*blob.InfluxVolume{v, other} {
+		bms, err := rv.ListBlocks(fm.Path, blob.ListOptions{})
+		if err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+		fms := blob.FileMetas(bms)
+		if len(fms) != 2 {
+			t.Fatalf("exp two versions, got %+v", fms)
+		}
+		for i, exp := range [][]byte{src, src2} {
+			out := new(memFile)
+			down, err := e.DownloadFile(out, blob.BlocksOf(fms[i], bms), rv)
+			if err != nil {
+				t.Fatalf("exp no err, got %s", err)
+			}
+			down.Wait()
+			if err := down.Err(); err != nil {
+				t.Fatalf("exp no download err, got %s", err)
+			}
+			if !bytes.Equal(out.buf, exp) {
+				t.Fatalf("version %d did not match", i)
+			}
+		}
+
+		last := blob.BlocksOf(fms[1], bms)
+		data, err := rv.DownloadBlock(last[len(last)-1])
+		if err != nil {
+			t.Fatalf("exp no err downloading linked block, got %s", err)
+		}
+		if !bytes.Equal(data, src2[10*1024:]) {
+			t.Fatalf("linked block did not match")
+		}
+	}
+
+	if err := v.Delete(fm); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if fms, err := v.Stat(fm.Path, blob.ListOptions{}); err != nil || len(fms) != 1 || fms[0].Time != fm2.Time {
+		t.Fatalf("exp only the second version after delete, got %v (%v)", fms, err)
+	}
+}
+
+func TestInfluxVolume_MigrateCompact(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	e := engine.NewEngine(8, 4)
+	old := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: blob.SchemaManifest})
+	v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: blob.SchemaCompact})
+
+	src, fm := randomFile(t, "/old/file", 6*1024+1, 1024, 1500000000)
+	roundTrip(t, e, old, src, fm)
+
+	migrated, err := v.Migrate(fm.Path)
+	if err != nil || len(migrated) != 1 {
+		t.Fatalf("exp one version migrated, got %v (%v)", migrated, err)
+	}
+	for _, p := range s.Points("blob", fm.Path) {
+		if _, ok := p.Tags["bi"]; ok {
+			t.Fatalf("exp no blocks left in the old schema, got %+v", p)
+		}
+	}
+	if n := s.SeriesN("blob"); n != 2 {
+		t.Fatalf("exp 2 series after migrating, got %d", n)
+	}
+	if migrated, err := v.Migrate(fm.Path); err != nil || len(migrated) != 0 {
+		t.Fatalf("exp nothing left to migrate, got %v (%v)", migrated, err)
+	}
+
+	fms, err := v.Stat(fm.Path, blob.ListOptions{})
+	if err != nil || len(fms) != 1 || fms[0].Schema != blob.SchemaCompact {
+		t.Fatalf("exp one version of schema 3, got %v (%v)", fms, err)
+	}
+	bms, err := v.ListBlocks(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	out := new(memFile)
+	down, err := e.DownloadFile(out, bms, v)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if err := down.Err(); err != nil {
+		t.Fatalf("exp no download err, got %s", err)
+	}
+	if !bytes.Equal(out.buf, src) {
+		t.Fatalf("downloaded content did not match after migrating")
+	}
+}
+
+// BenchmarkSchemas compares the series stored for the same files, and the time to list and download them,
+// with each schema.
+func BenchmarkSchemas(b *testing.B) {
+	const files, blocks = 4, 256
+
+	for _, schema := range []blob.Schema{blob.SchemaSeries, blob.SchemaManifest, blob.SchemaCompact} {
+		s := influxtest.NewServer()
+		e := engine.NewEngine(8, 4)
+		v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: schema})
+		var paths []string
+		for i := 0; i < files; i++ {
+			p := fmt.Sprintf("/bench/%d", i)
+			src, fm := randomFile(b, p, blocks*1024-i, 1024, 1500000000)
+			roundTrip(b, e, v, src, fm)
+			paths = append(paths, p)
+		}
+		series := float64(s.SeriesN("blob"))
+
+		b.Run(schema.String()+"/list", func(b *testing.B) {
+			b.ReportMetric(series, "series")
+			for i := 0; i < b.N; i++ {
+				if _, err := v.ListBlocks(paths[i%files], blob.ListOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(schema.String()+"/download", func(b *testing.B) {
+			b.ReportMetric(series, "series")
+			for i := 0; i < b.N; i++ {
+				bms, err := v.ListBlocks(paths[i%files], blob.ListOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				down, err := e.DownloadFile(new(memFile), bms, v)
+				if err != nil {
+					b.Fatal(err)
+				}
+				down.Wait()
+				if err := down.Err(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		s.Close()
+	}
+}
@@ -0,0 +1,341 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DirVolume is a Volume stored in a local directory, mirroring the InfluxVolume schema on disk:
+//
+//	<root>/<escaped path>/<sha256>-<bs>-<sz>/meta
+//	<root>/<escaped path>/<sha256>-<bs>-<sz>/commit
+//	<root>/<escaped path>/<sha256>-<bs>-<sz>/<bi>-<bsha256>
+//
+// The path of each file is escaped into a single directory name,
+// so that one file's path may be a prefix of another's.
+// The meta file holds the file-level tags and the time of the version as JSON,
+// and whether the version is published by a commit file; those written before commit files existed are not,
+// and count as committed.
+// The commit file exists once the version is committed and holds its Attrs as JSON,
+// and each block file holds the raw content of one block.
+type DirVolume struct {
+	root string
+
+	// Serializes updates to meta files.
+	mu sync.Mutex
+}
+
+var _ Volume = (*DirVolume)(nil)
+
+// dirMeta is the content of a version's meta file.
+type dirMeta struct {
+	SHA256    string `json:"sha256"`
+	BlockSize int    `json:"bs"`
+	Size      int    `json:"sz"`
+	Time      int64  `json:"time"`
+	// Set on versions that are committed by their commit file.
+	Commits bool `json:"commits"`
+}
+
+// NewDirVolume returns a DirVolume rooted at root, creating the directory if necessary.
+func NewDirVolume(root string) (*DirVolume, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &DirVolume{root: root}, nil
+}
+
+func (v *DirVolume) fileDir(path string) string {
+	return filepath.Join(v.root, url.PathEscape(path))
+}
+
+func (v *DirVolume) versionDir(fm *FileMeta) string {
+	return filepath.Join(v.fileDir(fm.Path), fmt.Sprintf("%x-%d-%d", fm.SHA256[:], fm.BlockSize, fm.Size))
+}
+
+func (v *DirVolume) blockFile(bm *BlockMeta) string {
+	return filepath.Join(v.versionDir(bm.FileMeta), fmt.Sprintf("%d-%x", bm.Index, bm.SHA256[:]))
+}
+
+// UploadBlock writes data to its own file and records the version's metadata.
+func (v *DirVolume) UploadBlock(data []byte, bm *BlockMeta) error {
+	if len(data) != bm.expSize {
+		return fmt.Errorf("block %d: exp %d bytes, got %d", bm.Index, bm.expSize, len(data))
+	}
+
+	dir := v.versionDir(bm.FileMeta)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(v.blockFile(bm), data); err != nil {
+		return err
+	}
+	return v.updateMeta(bm.FileMeta)
+}
+
+// LinkBlock stores bm as a hard link to the file of src, an identical block of another version,
+// so the data is neither copied nor lost if src's version is deleted.
+func (v *DirVolume) LinkBlock(bm, src *BlockMeta) error {
+	if src.SHA256 != bm.SHA256 {
+		return fmt.Errorf("block %d: cannot link to block %d with different checksum", bm.Index, src.Index)
+	}
+
+	dir := v.versionDir(bm.FileMeta)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Link under a temporary name and rename, so an existing block file is replaced atomically.
+	dst := v.blockFile(bm)
+	tmp := dst + ".link"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(v.blockFile(src), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return v.updateMeta(bm.FileMeta)
+}
+
+// Commit creates the commit file of fm's version, holding fm.Attrs.
+func (v *DirVolume) Commit(fm *FileMeta) error {
+	if err := os.MkdirAll(v.versionDir(fm), 0755); err != nil {
+		return err
+	}
+	if err := v.updateMeta(fm); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(fm.Attrs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(v.commitFile(fm), buf)
+}
+
+func (v *DirVolume) commitFile(fm *FileMeta) string {
+	return filepath.Join(v.versionDir(fm), "commit")
+}
+
+// hasCommitted reports whether any version of the file at path has been committed,
+// or was written before commit files existed.
+func (v *DirVolume) hasCommitted(path string) bool {
+	if matches, _ := filepath.Glob(filepath.Join(v.fileDir(path), "*", "commit")); len(matches) > 0 {
+		return true
+	}
+	metas, _ := filepath.Glob(filepath.Join(v.fileDir(path), "*", "meta"))
+	for _, p := range metas {
+		if m, err := readDirMeta(p); err == nil && !m.Commits {
+			return true
+		}
+	}
+	return false
+}
+
+// updateMeta creates or updates the meta file for fm's version, keeping the latest time.
+func (v *DirVolume) updateMeta(fm *FileMeta) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	p := filepath.Join(v.versionDir(fm), "meta")
+	if m, err := readDirMeta(p); err == nil && m.Time >= fm.Time {
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	buf, err := json.Marshal(dirMeta{
+		SHA256:    fmt.Sprintf("%x", fm.SHA256[:]),
+		BlockSize: fm.BlockSize,
+		Size:      fm.Size,
+		Time:      fm.Time,
+		Commits:   true,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, buf)
+}
+
+// DownloadBlock reads the block's file and verifies its checksum.
+func (v *DirVolume) DownloadBlock(bm *BlockMeta) ([]byte, error) {
+	data, err := ioutil.ReadFile(v.blockFile(bm))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("block %d of %s: %w", bm.Index, bm.Path, ErrBlockMissing)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := bm.CompareSHA256Against(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ListFiles returns the sorted paths beginning with pattern.
+func (v *DirVolume) ListFiles(pattern string, opts ListOptions) ([]string, error) {
+	entries, err := ioutil.ReadDir(v.root)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		path, err := url.PathUnescape(e.Name())
+		if err != nil {
+			// Not a directory that we created.
+			continue
+		}
+		if strings.HasPrefix(path, pattern) && (opts.IncludeUncommitted || v.hasCommitted(path)) {
+			names = append(names, path)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListBlocks returns new BlockMeta for every block file at path,
+// ordered by version time and then block index.
+func (v *DirVolume) ListBlocks(path string, opts ListOptions) ([]*BlockMeta, error) {
+	versions, err := ioutil.ReadDir(v.fileDir(path))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	var bms []*BlockMeta
+	for _, ver := range versions {
+		if !ver.IsDir() {
+			continue
+		}
+		dir := filepath.Join(v.fileDir(path), ver.Name())
+
+		m, err := readDirMeta(filepath.Join(dir, "meta"))
+		if os.IsNotExist(err) {
+			// A version whose first block is still being written.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		fm := &FileMeta{
+			Path:      path,
+			BlockSize: m.BlockSize,
+			Size:      m.Size,
+			Time:      m.Time,
+		}
+		if err := fm.SetSHA256String(m.SHA256); err != nil {
+			return nil, err
+		}
+		if buf, err := ioutil.ReadFile(v.commitFile(fm)); err == nil {
+			fm.Committed = true
+			// Versions committed before attributes were stored have an empty commit file.
+			if len(buf) > 0 {
+				if err := json.Unmarshal(buf, &fm.Attrs); err != nil {
+					return nil, fmt.Errorf("%s: %v", v.commitFile(fm), err)
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		} else if !m.Commits {
+			// Written before commit files existed, when every version was published as it was uploaded.
+			fm.Committed = true
+		}
+		if !fm.Committed && !opts.IncludeUncommitted {
+			continue
+		}
+
+		blocks, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blocks {
+			parts := strings.SplitN(b.Name(), "-", 2)
+			if len(parts) != 2 {
+				// The meta file or a temporary file.
+				continue
+			}
+			idx, err := strconv.Atoi(parts[0])
+			if err != nil {
+				continue
+			}
+			bm := fm.NewBlockMeta(idx)
+			if err := bm.SetSHA256String(parts[1]); err != nil {
+				continue
+			}
+			bms = append(bms, bm)
+		}
+	}
+	if len(bms) == 0 {
+		return nil, ErrNotExist
+	}
+
+	sortBlocks(bms)
+	return bms, nil
+}
+
+// Stat returns the FileMeta of the versions of the file at path, oldest first.
+func (v *DirVolume) Stat(path string, opts ListOptions) ([]*FileMeta, error) {
+	bms, err := v.ListBlocks(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return FileMetas(bms), nil
+}
+
+// Delete removes the version directory of fm, and the file's directory if no versions remain.
+func (v *DirVolume) Delete(fm *FileMeta) error {
+	if err := os.RemoveAll(v.versionDir(fm)); err != nil {
+		return err
+	}
+
+	// Only succeeds if the directory is now empty.
+	os.Remove(v.fileDir(fm.Path))
+	return nil
+}
+
+func readDirMeta(p string) (*dirMeta, error) {
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dirMeta)
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return m, nil
+}
+
+// writeFileAtomic writes data to a temporary file beside p and renames it into place,
+// so that readers never observe a partially written file.
+func writeFileAtomic(p string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
@@ -0,0 +1,125 @@
+package blob_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+)
+
+func TestDirVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "dirvolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	v, err := blob.NewDirVolume(root)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	putFile(t, v, "/a", "first file", 4, 100)
+	putFile(t, v, "/a/b", "nested file", 4, 100)
+	putFile(t, v, "/a/b", "nested file v2", 4, 200)
+
+	names, err := v.ListFiles("/a", blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(names) != 2 || names[0] != "/a" || names[1] != "/a/b" {
+		t.Fatalf("exp [/a /a/b], got %v", names)
+	}
+
+	bms, err := v.ListBlocks("/a/b", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	var got []byte
+	for _, bm := range blob.LatestBlocks(bms) {
+		data, err := v.DownloadBlock(bm)
+		if err != nil {
+			t.Fatalf("exp no err downloading block %d, got %s", bm.Index, err)
+		}
+		got = append(got, data...)
+	}
+	if string(got) != "nested file v2" {
+		t.Fatalf("exp latest version content, got %q", got)
+	}
+
+	fms, err := v.Stat("/a/b", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 2 || fms[0].Time != 100 || fms[1].Time != 200 {
+		t.Fatalf("exp two versions oldest first, got %v", fms)
+	}
+	for _, fm := range fms {
+		if err := v.Delete(fm); err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+	}
+	if _, err := v.Stat("/a/b", blob.ListOptions{}); err != blob.ErrNotExist {
+		t.Fatalf("exp ErrNotExist, got %v", err)
+	}
+	if names, _ := v.ListFiles("/", blob.ListOptions{}); len(names) != 1 || names[0] != "/a" {
+		t.Fatalf("exp only /a to remain, got %v", names)
+	}
+}
+
+func TestDirVolume_LegacyVersions(t *testing.T) {
+	root, err := ioutil.TempDir("", "dirvolume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// A version written before commit files existed, whose meta does not say it is committed by one.
+	src := []byte("old!")
+	fm, err := blob.NewFileMeta(bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, url.PathEscape("/old"), fmt.Sprintf("%x-4-4", fm.SHA256[:]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	meta := fmt.Sprintf(`{"sha256":"%x","bs":4,"sz":4,"time":100}`, fm.SHA256[:])
+	if err := ioutil.WriteFile(filepath.Join(dir, "meta"), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("0-%x", fm.SHA256[:])), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := blob.NewDirVolume(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A version uploaded since, but not committed.
+	pending := &blob.FileMeta{Path: "/pending", BlockSize: 4, Size: 4, Time: 200}
+	bm := pending.NewBlockMeta(0)
+	if err := bm.SetSHA256(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.UploadBlock(src, bm); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := v.ListFiles("/", blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil || len(names) != 1 || names[0] != "/old" {
+		t.Fatalf("exp only the legacy file, got %v (%v)", names, err)
+	}
+	fms, err := v.Stat("/old", blob.ListOptions{})
+	if err != nil || len(fms) != 1 || !fms[0].Committed || fms[0].Time != 100 {
+		t.Fatalf("exp legacy version committed, got %+v (%v)", fms, err)
+	}
+	if _, err := v.Stat("/pending", blob.ListOptions{}); err != blob.ErrNotExist {
+		t.Fatalf("exp pending version to stay hidden, got %v", err)
+	}
+}
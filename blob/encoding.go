@@ -0,0 +1,250 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/ascii85"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Encoding converts the raw data of a block to and from the text stored in InfluxDB.
+// The name of the encoding is recorded so that readers can decode it:
+// on each block with SchemaSeries, and once in the version's manifest with SchemaManifest and SchemaCompact.
+type Encoding interface {
+	// Name identifies the encoding in the enc field of the blocks or the manifest that record it.
+	Name() string
+
+	// EncodedLen returns the largest possible length of the encoding of n bytes,
+	// before any escaping needed inside a line protocol string field.
+	// See escapedLen for the length after escaping.
+	EncodedLen(n int) int
+
+	// AppendEncode appends the encoding of src to dst.
+	// dst must not overlap src.
+	AppendEncode(dst, src []byte) []byte
+
+	// AppendDecode appends the data decoded from src to dst, or returns an error if src is not valid.
+	// The decoded data may be followed by padding, as Z85 pads the final frame.
+	// dst must not overlap src.
+	AppendDecode(dst, src []byte) ([]byte, error)
+
+	// NewEncoder returns a stream encoder that writes to w.
+	// The encoder must be closed to flush any partial final group.
+	NewEncoder(w io.Writer) io.WriteCloser
+}
+
+// Encoder is implemented by a Volume that encodes the data of the blocks it stores,
+// so that block sizes can be planned for the encoded length.
+type Encoder interface {
+	// Encoding returns the encoding used for the data of uploaded blocks.
+	Encoding() Encoding
+}
+
+var (
+	_ Encoder = (*InfluxVolume)(nil)
+	_ Encoder = (*ReplicatedVolume)(nil)
+)
+
+// FieldLimiter is implemented by a Volume that splits encoded blocks across string fields of limited size,
+// so that block sizes can be planned for the names of the extra fields.
+type FieldLimiter interface {
+	// MaxFieldSize returns the largest string field the volume writes, in bytes.
+	MaxFieldSize() int
+}
+
+var (
+	_ FieldLimiter = (*InfluxVolume)(nil)
+	_ FieldLimiter = (*ReplicatedVolume)(nil)
+)
+
+// The encodings supported by InfluxVolume.
+var (
+	// Z85 is the ZeroMQ Base-85 encoding, and the default.
+	// Blocks stored without an enc field were all written with Z85.
+	Z85 Encoding = z85Encoding{}
+
+	// Base64 is standard, padded base64 as defined in RFC 4648.
+	Base64 Encoding = base64Encoding{name: "base64", enc: base64.StdEncoding}
+
+	// RawBase64 is standard base64 without padding.
+	RawBase64 Encoding = base64Encoding{name: "base64raw", enc: base64.RawStdEncoding}
+
+	// Ascii85 is the btoa and Adobe Ascii85 encoding, without delimiters.
+	// Its alphabet includes the quote and backslash, which are escaped in line protocol,
+	// so block sizes are planned as though every byte of it were escaped.
+	Ascii85 Encoding = ascii85Encoding{}
+)
+
+// Encodings lists every supported encoding, default first.
+var Encodings = []Encoding{Z85, Base64, RawBase64, Ascii85}
+
+// EncodingByName returns the encoding with the given name.
+// The empty name is Z85, so that blocks written before encodings were recorded are decoded correctly.
+func EncodingByName(name string) (Encoding, error) {
+	if name == "" {
+		return Z85, nil
+	}
+	for _, e := range Encodings {
+		if e.Name() == name {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown encoding %q", name)
+}
+
+// DecodeError is returned when a stored block cannot be decoded.
+type DecodeError struct {
+	// Encoding is the name of the encoding the block was stored with.
+	Encoding string
+
+	// Err is the error from the encoding, such as a *Z85Error.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding %s: %v", e.Encoding, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// exactEncoding is implemented by encodings whose EncodedLen is exact
+// and whose output never needs escaping inside a line protocol string field.
+type exactEncoding interface {
+	exact()
+}
+
+// escapedLen returns the largest possible length of the encoding of n bytes with e,
+// once escaped for a line protocol string field.
+// Unless e is an exactEncoding, every byte is assumed to need escaping.
+func escapedLen(e Encoding, n int) int {
+	if _, ok := e.(exactEncoding); ok {
+		return e.EncodedLen(n)
+	}
+	return 2 * e.EncodedLen(n)
+}
+
+type z85Encoding struct{}
+
+func (z85Encoding) exact() {}
+
+func (z85Encoding) Name() string { return "z85" }
+
+func (z85Encoding) EncodedLen(n int) int { return Z85EncodedLen(paddedSize(n)) }
+
+func (z85Encoding) AppendEncode(dst, src []byte) []byte { return Z85EncodeAppend(dst, src) }
+
+func (z85Encoding) AppendDecode(dst, src []byte) ([]byte, error) {
+	return Z85DecodeAppendStrict(dst, src)
+}
+
+func (z85Encoding) NewEncoder(w io.Writer) io.WriteCloser { return NewZ85Encoder(w) }
+
+type base64Encoding struct {
+	name string
+	enc  *base64.Encoding
+}
+
+func (base64Encoding) exact() {}
+
+func (e base64Encoding) Name() string { return e.name }
+
+func (e base64Encoding) EncodedLen(n int) int { return e.enc.EncodedLen(n) }
+
+func (e base64Encoding) AppendEncode(dst, src []byte) []byte {
+	n := len(dst)
+	dst = append(dst, make([]byte, e.enc.EncodedLen(len(src)))...)
+	e.enc.Encode(dst[n:], src)
+	return dst
+}
+
+func (e base64Encoding) AppendDecode(dst, src []byte) ([]byte, error) {
+	buf := make([]byte, e.enc.DecodedLen(len(src)))
+	n, err := e.enc.Decode(buf, src)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, buf[:n]...), nil
+}
+
+func (e base64Encoding) NewEncoder(w io.Writer) io.WriteCloser { return base64.NewEncoder(e.enc, w) }
+
+type ascii85Encoding struct{}
+
+func (ascii85Encoding) Name() string { return "ascii85" }
+
+func (ascii85Encoding) EncodedLen(n int) int { return ascii85.MaxEncodedLen(n) }
+
+func (ascii85Encoding) AppendEncode(dst, src []byte) []byte {
+	buf := make([]byte, ascii85.MaxEncodedLen(len(src)))
+	n := ascii85.Encode(buf, src)
+	return append(dst, buf[:n]...)
+}
+
+func (ascii85Encoding) AppendDecode(dst, src []byte) ([]byte, error) {
+	// A single 'z' decodes to four zero bytes.
+	buf := make([]byte, 4*len(src))
+	n, _, err := ascii85.Decode(buf, src, true)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, buf[:n]...), nil
+}
+
+func (ascii85Encoding) NewEncoder(w io.Writer) io.WriteCloser { return ascii85.NewEncoder(w) }
+
+// decodeBlock decodes z, the stored data of a block written with e.
+func decodeBlock(e Encoding, z []byte) ([]byte, error) {
+	raw, err := e.AppendDecode(nil, z)
+	if err != nil {
+		return nil, &DecodeError{Encoding: e.Name(), Err: err}
+	}
+	return raw, nil
+}
+
+// fieldSpecials are the bytes that must be escaped inside a line protocol string field.
+const fieldSpecials = `"\`
+
+// appendFieldEscaped escapes any quotes or backslashes in dst[start:], which is the value of a string field.
+func appendFieldEscaped(dst []byte, start int) []byte {
+	if bytes.IndexAny(dst[start:], fieldSpecials) < 0 {
+		return dst
+	}
+	val := append([]byte(nil), dst[start:]...)
+	dst = dst[:start]
+	for _, c := range val {
+		if c == '"' || c == '\\' {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// fieldEscaper escapes quotes and backslashes written through it to w,
+// for streaming the value of a line protocol string field.
+type fieldEscaper struct {
+	w io.Writer
+}
+
+func (f fieldEscaper) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		i := bytes.IndexAny(p, fieldSpecials)
+		if i < 0 {
+			m, err := f.w.Write(p)
+			return n + m, err
+		}
+		if _, err := f.w.Write(p[:i]); err != nil {
+			return n, err
+		}
+		if _, err := f.w.Write([]byte{'\\', p[i]}); err != nil {
+			return n, err
+		}
+		n += i + 1
+		p = p[i+1:]
+	}
+	return n, nil
+}
@@ -0,0 +1,230 @@
+package blob_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+func TestEncodings(t *testing.T) {
+	src := make([]byte, 4*1024+3)
+	rand.New(rand.NewSource(4)).Read(src)
+	// A run of zeros, which Ascii85 abbreviates.
+	copy(src[100:], make([]byte, 16))
+
+	for _, e := range blob.Encodings {
+		enc := e.AppendEncode(nil, src)
+		if len(enc) > e.EncodedLen(len(src)) {
+			t.Errorf("%s: exp at most %d encoded bytes, got %d", e.Name(), e.EncodedLen(len(src)), len(enc))
+		}
+
+		var buf bytes.Buffer
+		w := e.NewEncoder(&buf)
+		w.Write(src[:1001])
+		w.Write(src[1001:])
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: exp no err, got %s", e.Name(), err)
+		}
+		if !bytes.Equal(buf.Bytes(), enc) {
+			t.Errorf("%s: stream encoder did not match AppendEncode", e.Name())
+		}
+
+		dec, err := e.AppendDecode(nil, enc)
+		if err != nil {
+			t.Fatalf("%s: exp no err, got %s", e.Name(), err)
+		}
+		if len(dec) < len(src) || !bytes.Equal(dec[:len(src)], src) {
+			t.Errorf("%s: decoded data did not match", e.Name())
+		}
+
+		if _, err := e.AppendDecode(nil, []byte("~~~~~")); err == nil {
+			t.Errorf("%s: exp err decoding invalid input", e.Name())
+		}
+
+		if got, err := blob.EncodingByName(e.Name()); err != nil || got != e {
+			t.Errorf("%s: exp to find encoding by name, got %v, %v", e.Name(), got, err)
+		}
+	}
+
+	if e, err := blob.EncodingByName(""); err != nil || e != blob.Z85 {
+		t.Fatalf("exp empty name to mean Z85, got %v, %v", e, err)
+	}
+}
+
+func TestInfluxVolume_Encodings(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	e := engine.NewEngine(4, 4)
+	for i, enc := range blob.Encodings {
+		v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Encoding: enc})
+		path := "/enc/" + enc.Name()
+		src, fm := randomFile(t, path, 8*1024+5, 1024, 1500000000+int64(i))
+
+		// Upload half of the versions directly, and half through a batch.
+		var bu engine.BlockUploader = v
+		if i%2 == 1 {
+			bu = blob.NewBatchUploader(v, blob.BatchOptions{MaxPoints: 4})
+		}
+		up := e.UploadFile(bytes.NewReader(src), fm, bu)
+		up.Wait()
+		if err := up.Err(); err != nil {
+			t.Fatalf("%s: exp no upload err, got %s", enc.Name(), err)
+		}
+
+		// Download through a volume with a different encoding, which must not matter.
+		rv := blob.NewInfluxVolume(s.URL, "blob", "")
+		bms, err := rv.ListBlocks(path, blob.ListOptions{})
+		if err != nil {
+			t.Fatalf("%s: exp no err, got %s", enc.Name(), err)
+		}
+		out := new(memFile)
+		down, err := e.DownloadFile(out, bms, rv)
+		if err != nil {
+			t.Fatalf("%s: exp no err, got %s", enc.Name(), err)
+		}
+		down.Wait()
+		if err := down.Err(); err != nil {
+			t.Fatalf("%s: exp no download err, got %s", enc.Name(), err)
+		}
+		if !bytes.Equal(out.buf, src) {
+			t.Fatalf("%s: downloaded data did not match", enc.Name())
+		}
+
+		if _, err := rv.DownloadBlock(bms[len(bms)-1]); err != nil {
+			t.Fatalf("%s: exp no err downloading last block, got %s", enc.Name(), err)
+		}
+		// The encoding is recorded once, in the manifest, rather than on every block.
+		for _, p := range s.Points("blob", path) {
+			if _, ok := p.Fields["enc"]; ok {
+				t.Fatalf("%s: exp no enc field on blocks, got %v", enc.Name(), p.Fields["enc"])
+			}
+		}
+		var recorded bool
+		for _, p := range s.Points("blob", "blob_manifests") {
+			if p.Tags["path"] == path {
+				recorded = p.Fields["enc"] == enc.Name()
+			}
+		}
+		if !recorded {
+			t.Fatalf("%s: exp enc field on the manifest", enc.Name())
+		}
+	}
+}
+
+func TestInfluxVolume_EncodingPerVersion(t *testing.T) {
+	for _, schema := range []blob.Schema{blob.SchemaSeries, blob.SchemaManifest, blob.SchemaCompact} {
+		s := influxtest.NewServer()
+		defer s.Close()
+
+		e := engine.NewEngine(4, 4)
+		first := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Encoding: blob.Base64, Schema: schema})
+		src, fm := randomFile(t, "/my/file", 8*1024, 1024, 1500000000)
+		roundTrip(t, e, first, src, fm)
+
+		// The second version links its unchanged blocks to the first, but writes the rest with another encoding.
+		second := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Encoding: blob.Ascii85, Schema: schema})
+		src2 := append([]byte(nil), src...)
+		src2[0] ^= 0xff
+		fm2, err := blob.NewFileMeta(bytes.NewReader(src2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm2.Path, fm2.BlockSize, fm2.Time = fm.Path, fm.BlockSize, fm.Time+100
+		prev, err := second.ListBlocks(fm.Path, blob.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		up := e.UploadFileDelta(bytes.NewReader(src2), fm2, second, prev)
+		up.Wait()
+		if err := up.Err(); err != nil {
+			t.Fatalf("%s: exp no upload err, got %s", schema, err)
+		}
+		if n := up.Stats().SkippedBlocks; n != fm2.NumBlocks()-1 {
+			t.Fatalf("%s: exp %d linked blocks, got %d", schema, fm2.NumBlocks()-1, n)
+		}
+
+		// A third version is left uncommitted, and is read with the encoding of the volume reading it.
+		src3 := append([]byte(nil), src...)
+		src3[1] ^= 0xff
+		fm3, err := blob.NewFileMeta(bytes.NewReader(src3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm3.Path, fm3.BlockSize, fm3.Time = fm.Path, fm.BlockSize, fm.Time+200
+		up = e.UploadFile(bytes.NewReader(src3), fm3, uploadOnly{first})
+		up.Wait()
+		if err := up.Err(); err != nil {
+			t.Fatalf("%s: exp no upload err, got %s", schema, err)
+		}
+
+		for _, rv := range []*blob.InfluxVolume{blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Encoding: blob.Base64}), first} {
+			bms, err := rv.ListBlocks(fm.Path, blob.ListOptions{IncludeUncommitted: true})
+			if err != nil {
+				t.Fatalf("%s: exp no err, got %s", schema, err)
+			}
+			fms := blob.FileMetas(bms)
+			if len(fms) != 3 {
+				t.Fatalf("%s: exp 3 versions, got %v", schema, fms)
+			}
+			for i, exp := range [][]byte{src, src2, src3} {
+				blocks := blob.BlocksOf(fms[i], bms)
+				out := new(memFile)
+				down, err := e.DownloadFile(out, blocks, rv)
+				if err != nil {
+					t.Fatalf("%s: exp no err, got %s", schema, err)
+				}
+				down.Wait()
+				if err := down.Err(); err != nil {
+					t.Fatalf("%s: exp no download err for version %d, got %s", schema, i, err)
+				}
+				if !bytes.Equal(out.buf, exp) {
+					t.Fatalf("%s: version %d did not match", schema, i)
+				}
+				data, err := rv.DownloadBlock(blocks[len(blocks)-1])
+				if err != nil || !bytes.Equal(data, exp[len(exp)-1024:]) {
+					t.Fatalf("%s: exp last block of version %d, got %v", schema, i, err)
+				}
+			}
+		}
+	}
+}
+
+// uploadOnly hides every method of the volume but UploadBlock, so that uploads through it are not committed.
+type uploadOnly struct {
+	v blob.Volume
+}
+
+func (u uploadOnly) UploadBlock(data []byte, bm *blob.BlockMeta) error {
+	return u.v.UploadBlock(data, bm)
+}
+
+func BenchmarkEncodings(b *testing.B) {
+	src := make([]byte, 64*1024)
+	rand.New(rand.NewSource(5)).Read(src)
+
+	for _, e := range blob.Encodings {
+		enc := e.AppendEncode(nil, src)
+		b.Run(fmt.Sprintf("%s/encode", e.Name()), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			b.ReportMetric(float64(len(enc))/float64(len(src)), "encoded/raw")
+			var dst []byte
+			for i := 0; i < b.N; i++ {
+				dst = e.AppendEncode(dst[:0], src)
+			}
+		})
+		b.Run(fmt.Sprintf("%s/decode", e.Name()), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				if _, err := e.AppendDecode(nil, enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
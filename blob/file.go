@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"os"
 )
 
 // FileMeta is the metadata for a File.
@@ -21,6 +22,33 @@ type FileMeta struct {
 	Size int
 	// Timestamp in seconds since Unix epoch.
 	Time int64
+	// Whether the version has been committed. Only meaningful in FileMeta returned by a Volume.
+	Committed bool
+	// Optional metadata about the file, stored by Commit.
+	// Only returned by a Volume for committed versions.
+	Attrs Attrs
+	// The layout an InfluxVolume stored the version with. Zero for other volumes.
+	Schema Schema
+}
+
+// Attrs are optional metadata about a file.
+// Volumes store them once per version, when the version is committed, rather than with every block.
+type Attrs struct {
+	// Mode and permission bits of the original file. Zero means unknown.
+	Mode os.FileMode `json:"mode,omitempty"`
+	// Modification time of the original file, in nanoseconds since Unix epoch. Zero means unknown.
+	ModTime int64 `json:"mtime,omitempty"`
+	// Name of the user that owned the original file.
+	Owner string `json:"owner,omitempty"`
+	// MIME type of the content, such as "text/plain; charset=utf-8".
+	ContentType string `json:"ctype,omitempty"`
+	// Arbitrary key/value labels set by the user.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// IsZero reports whether none of the attributes are set.
+func (a *Attrs) IsZero() bool {
+	return a.Mode == 0 && a.ModTime == 0 && a.Owner == "" && a.ContentType == "" && len(a.Labels) == 0
 }
 
 // NewFileMeta returns a new FileMeta with Size and SHA256 set as calculated from r.
@@ -89,6 +117,10 @@ type BlockMeta struct {
 
 	offset  int
 	expSize int
+
+	// The layout of the block's own point, as listed by an InfluxVolume.
+	// It differs from the FileMeta's Schema while a version is being migrated.
+	layout Schema
 }
 
 func (bm *BlockMeta) FileOffset() int64 {
@@ -130,16 +162,36 @@ func compareSHA256Against(r io.Reader, sha [sha256.Size]byte, expSize int64) err
 	if n, err := io.Copy(h, r); err != nil {
 		return err
 	} else if n != expSize {
-		return fmt.Errorf("Expected to read %d bytes, got %d", expSize, n)
+		return &SizeError{Exp: expSize, Got: n}
 	}
 
 	if !bytes.Equal(h.Sum(nil), sha[:]) {
-		return fmt.Errorf("GetBlock: checksum did not match! exp %x, got %x", sha, h.Sum(nil))
+		e := &ChecksumError{Exp: sha}
+		copy(e.Got[:], h.Sum(nil))
+		return e
 	}
 
 	return nil
 }
 
+// SizeError is returned when data being verified is not the expected size.
+type SizeError struct {
+	Exp, Got int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("Expected to read %d bytes, got %d", e.Exp, e.Got)
+}
+
+// ChecksumError is returned when data being verified does not match the expected checksum.
+type ChecksumError struct {
+	Exp, Got [sha256.Size]byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("GetBlock: checksum did not match! exp %x, got %x", e.Exp, e.Got)
+}
+
 // SetSHA256String sets the SHA256 from the hex-encoded string.
 func (bm *BlockMeta) SetSHA256String(hexSha string) error {
 	return setSHA256String(&bm.SHA256, hexSha)
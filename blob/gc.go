@@ -0,0 +1,212 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"time"
+)
+
+// GarbageReason describes why a version of a file is garbage.
+type GarbageReason string
+
+const (
+	// Incomplete versions are missing blocks, typically because their upload was interrupted.
+	Incomplete GarbageReason = "incomplete"
+
+	// Superseded versions are complete, but older than the versions to keep.
+	Superseded GarbageReason = "superseded"
+)
+
+// GCOptions controls which versions FindGarbage reports.
+type GCOptions struct {
+	// GracePeriod is how long an incomplete version may still be uploading.
+	// Incomplete versions written more recently than this are not garbage.
+	GracePeriod time.Duration
+
+	// KeepVersions, if positive, is the number of complete versions to keep per path.
+	// Older complete versions are reported as Superseded.
+	KeepVersions int
+
+	// Now is the time the grace period is measured from. The zero value means time.Now().
+	Now time.Time
+}
+
+// Garbage is a version of a file that can be deleted.
+type Garbage struct {
+	*FileMeta
+
+	// Blocks is the number of distinct blocks of the version that are present.
+	Blocks int
+
+	Reason GarbageReason
+}
+
+// FindGarbage returns the versions of files beginning with prefix that are incomplete,
+// or superseded according to opts.KeepVersions, ordered by path and then oldest first.
+//
+// Only committed versions count towards opts.KeepVersions.
+// Complete versions that are not committed are never garbage:
+// they may be about to be committed, or predate commits altogether.
+func FindGarbage(v Volume, prefix string, opts GCOptions) ([]*Garbage, error) {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	cutoff := opts.Now.Add(-opts.GracePeriod).Unix()
+
+	all := ListOptions{ListMatch: ByPrefix, IncludeUncommitted: true}
+	paths, err := v.ListFiles(prefix, all)
+	if err != nil {
+		return nil, err
+	}
+
+	var garbage []*Garbage
+	for _, p := range paths {
+		bms, err := v.ListBlocks(p, all)
+		if err == ErrNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		fms := FileMetas(bms)
+		present := presentBlocks(bms)
+
+		var committed []*FileMeta
+		for _, fm := range fms {
+			n := present[fm]
+			if n >= fm.NumBlocks() {
+				if fm.Committed {
+					committed = append(committed, fm)
+				}
+				continue
+			}
+			if fm.Time <= cutoff {
+				garbage = append(garbage, &Garbage{FileMeta: fm, Blocks: n, Reason: Incomplete})
+			}
+		}
+
+		if opts.KeepVersions > 0 && len(committed) > opts.KeepVersions {
+			for _, fm := range committed[:len(committed)-opts.KeepVersions] {
+				garbage = append(garbage, &Garbage{FileMeta: fm, Blocks: present[fm], Reason: Superseded})
+			}
+		}
+	}
+	return garbage, nil
+}
+
+// CommitComplete commits every uncommitted version of the file at path that has all of its blocks,
+// such as versions uploaded before commits existed, and returns the versions it committed.
+func CommitComplete(v Volume, path string) ([]*FileMeta, error) {
+	bms, err := v.ListBlocks(path, ListOptions{IncludeUncommitted: true})
+	if err != nil {
+		return nil, err
+	}
+
+	present := presentBlocks(bms)
+	var committed []*FileMeta
+	for _, fm := range FileMetas(bms) {
+		if fm.Committed || present[fm] < fm.NumBlocks() {
+			continue
+		}
+		if err := v.Commit(fm); err != nil {
+			return committed, err
+		}
+		fm.Committed = true
+		committed = append(committed, fm)
+	}
+	return committed, nil
+}
+
+// presentBlocks returns the number of distinct block indexes of each version in bms.
+func presentBlocks(bms []*BlockMeta) map[*FileMeta]int {
+	seen := make(map[*FileMeta]map[int]bool)
+	for _, bm := range bms {
+		if seen[bm.FileMeta] == nil {
+			seen[bm.FileMeta] = make(map[int]bool)
+		}
+		seen[bm.FileMeta][bm.Index] = true
+	}
+
+	n := make(map[*FileMeta]int, len(seen))
+	for fm, idx := range seen {
+		n[fm] = len(idx)
+	}
+	return n
+}
+
+// CollectGarbage deletes each version in garbage from v.
+//
+// Versions that are kept may have blocks linked to a version being deleted,
+// so any kept block with the same checksum as a block of a deleted version
+// is first uploaded again under its own version.
+func CollectGarbage(v Volume, garbage []*Garbage) error {
+	byPath := make(map[string][]*Garbage)
+	var paths []string
+	for _, g := range garbage {
+		if byPath[g.Path] == nil {
+			paths = append(paths, g.Path)
+		}
+		byPath[g.Path] = append(byPath[g.Path], g)
+	}
+
+	for _, p := range paths {
+		if err := collectPath(v, p, byPath[p]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectPath deletes the garbage versions of the file at path.
+func collectPath(v Volume, path string, garbage []*Garbage) error {
+	bms, err := v.ListBlocks(path, ListOptions{IncludeUncommitted: true})
+	if err == ErrNotExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	doomed := make(map[fileKey]bool, len(garbage))
+	for _, g := range garbage {
+		doomed[fileKeyOf(g.FileMeta)] = true
+	}
+
+	// Find the checksums of every block that is about to be deleted.
+	deleted := make(map[[sha256.Size]byte]*BlockMeta)
+	for _, bm := range bms {
+		if doomed[fileKeyOf(bm.FileMeta)] {
+			deleted[bm.SHA256] = bm
+		}
+	}
+
+	for _, bm := range bms {
+		if doomed[fileKeyOf(bm.FileMeta)] {
+			continue
+		}
+		src := deleted[bm.SHA256]
+		if src == nil {
+			continue
+		}
+		data, err := v.DownloadBlock(bm)
+		if err != nil {
+			// The kept block may only be readable through the version it was linked to.
+			if data, err = v.DownloadBlock(src); err != nil {
+				return fmt.Errorf("block %d of %s: %v", bm.Index, path, err)
+			}
+		}
+		if err := bm.CompareSHA256Against(bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("block %d of %s: %v", bm.Index, path, err)
+		}
+		if err := v.UploadBlock(data, bm); err != nil {
+			return err
+		}
+	}
+
+	for _, g := range garbage {
+		if err := v.Delete(g.FileMeta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package blob_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+func TestFindGarbage(t *testing.T) {
+	v := blob.NewMemVolume()
+
+	putFile(t, v, "/a/file", "version one", 4, 100)
+	putFile(t, v, "/a/file", "version two", 4, 200)
+	putFile(t, v, "/a/file", "version three", 4, 300)
+
+	// Interrupted uploads: one long ago, one still in progress.
+	putPartial(t, v, "/a/crashed", "only partly there", 4, 100, 2)
+	putPartial(t, v, "/a/uploading", "not finished yet", 4, 1000, 1)
+
+	garbage, err := blob.FindGarbage(v, "/a/", blob.GCOptions{
+		GracePeriod:  time.Minute,
+		KeepVersions: 2,
+		Now:          time.Unix(1030, 0),
+	})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	var got []string
+	for _, g := range garbage {
+		got = append(got, g.Path+" "+string(g.Reason))
+	}
+	exp := "/a/crashed incomplete,/a/file superseded"
+	if strings.Join(got, ",") != exp {
+		t.Fatalf("exp %s, got %v", exp, got)
+	}
+	if garbage[0].Blocks != 2 || garbage[1].Time != 100 {
+		t.Fatalf("unexpected garbage: %+v %+v", garbage[0], garbage[1])
+	}
+
+	if err := blob.CollectGarbage(v, garbage); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if _, err := v.Stat("/a/crashed", blob.ListOptions{}); err != blob.ErrNotExist {
+		t.Fatalf("exp crashed upload to be removed, got %v", err)
+	}
+	fms, err := v.Stat("/a/file", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 2 || fms[0].Time != 200 {
+		t.Fatalf("exp newest two versions kept, got %+v", fms)
+	}
+	if _, err := v.Stat("/a/uploading", blob.ListOptions{IncludeUncommitted: true}); err != nil {
+		t.Fatalf("exp upload within grace period to be kept, got %v", err)
+	}
+}
+
+// putPartial uploads only the first n blocks of content, as an interrupted upload would.
+func putPartial(t *testing.T, v blob.Volume, path, content string, blockSize int, time int64, n int) {
+	t.Helper()
+
+	fm, err := blob.NewFileMeta(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm.Path, fm.BlockSize, fm.Time = path, blockSize, time
+
+	for i := 0; i < n; i++ {
+		bm := fm.NewBlockMeta(i)
+		data := []byte(content[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()])
+		if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+		if err := v.UploadBlock(data, bm); err != nil {
+			t.Fatalf("exp no err uploading block %d, got %s", i, err)
+		}
+	}
+}
+
+func TestCollectGarbage_LinkedBlocks(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	// Linked blocks of an InfluxVolume have no data of their own.
+	v := blob.NewInfluxVolume(s.URL, "blob", "")
+
+	old := putFile(t, v, "/f", "aaaabbbb", 4, 100)
+	cur, err := blob.NewFileMeta(strings.NewReader("aaaacccc"))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	cur.Path, cur.BlockSize, cur.Time = "/f", 4, 200
+
+	// Link the unchanged block, upload the changed one.
+	oldBlocks := mustListBlocks(t, v, "/f")
+	bm := cur.NewBlockMeta(0)
+	bm.SHA256 = oldBlocks[0].SHA256
+	if err := v.LinkBlock(bm, oldBlocks[0]); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	bm = cur.NewBlockMeta(1)
+	if err := bm.SetSHA256(strings.NewReader("cccc")); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if err := v.UploadBlock([]byte("cccc"), bm); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if err := v.Commit(cur); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	if err := blob.CollectGarbage(v, []*blob.Garbage{{FileMeta: old, Reason: blob.Superseded}}); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	bms := mustListBlocks(t, v, "/f")
+	if len(bms) != 2 {
+		t.Fatalf("exp 2 blocks left, got %d", len(bms))
+	}
+	data, err := v.DownloadBlock(bms[0])
+	if err != nil {
+		t.Fatalf("exp linked block to survive, got %s", err)
+	}
+	if !bytes.Equal(data, []byte("aaaa")) {
+		t.Fatalf("exp aaaa, got %q", data)
+	}
+}
@@ -3,31 +3,96 @@ package blob
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/mark-rushakoff/influx-blob/internal/influxclient"
 )
 
+// InfluxVolume is a Volume that stores each file as a measurement in an InfluxDB database.
 type InfluxVolume struct {
 	client *influxclient.Client
 
 	database        string
 	retentionPolicy string
+
+	encoding     Encoding
+	schema       Schema
+	maxFieldSize int
+
+	// The encodings recorded in the manifests of versions that have been listed or committed.
+	encMu sync.Mutex
+	encs  map[manifestKey]string
 }
 
+var _ Volume = (*InfluxVolume)(nil)
+
+// InfluxVolumeOptions are the less commonly changed settings of an InfluxVolume.
+type InfluxVolumeOptions struct {
+	// Client controls compression of the HTTP traffic with InfluxDB.
+	Client influxclient.ClientOptions
+
+	// Encoding is used for the data of uploaded blocks. Nil means Z85.
+	// Downloads decode each block with the encoding it was stored with.
+	Encoding Encoding
+
+	// Schema is the layout of the points written. Zero means DefaultSchema.
+	// Versions written with any schema are read.
+	Schema Schema
+
+	// MaxFieldSize is the largest string field the server accepts, in bytes. Zero means 64 KiB.
+	// Blocks whose encoding may be longer are split across several fields, as described on UploadBlock.
+	MaxFieldSize int
+}
+
+const defaultMaxFieldSize = 64 * 1024
+
 func NewInfluxVolume(httpURL, database, retentionPolicy string) *InfluxVolume {
+	return NewInfluxVolumeWithOptions(httpURL, database, retentionPolicy, InfluxVolumeOptions{})
+}
+
+func NewInfluxVolumeWithOptions(httpURL, database, retentionPolicy string, opts InfluxVolumeOptions) *InfluxVolume {
+	if opts.Encoding == nil {
+		opts.Encoding = Z85
+	}
+	if opts.Schema == 0 {
+		opts.Schema = DefaultSchema
+	}
+	if opts.MaxFieldSize <= 0 {
+		opts.MaxFieldSize = defaultMaxFieldSize
+	}
 	return &InfluxVolume{
-		client:          influxclient.NewClient(httpURL),
+		client:          influxclient.NewClientWithOptions(httpURL, opts.Client),
 		database:        database,
 		retentionPolicy: retentionPolicy,
+		encoding:        opts.Encoding,
+		schema:          opts.Schema,
+		maxFieldSize:    opts.MaxFieldSize,
 	}
 }
 
+// Encoding returns the encoding used for the data of uploaded blocks.
+func (v *InfluxVolume) Encoding() Encoding {
+	return v.encoding
+}
+
+// MaxFieldSize returns the largest string field the volume writes, in bytes.
+func (v *InfluxVolume) MaxFieldSize() int {
+	return v.maxFieldSize
+}
+
+// Schema returns the layout of the points the volume writes.
+func (v *InfluxVolume) Schema() Schema {
+	return v.schema
+}
+
 // UploadBlock writes the block to InfluxDB.
 // This method is safe to call concurrently.
 //
-// The block is stored with this schema:
+// With SchemaSeries, the block is stored as follows.
+// SchemaManifest differs as described on manifestMeasurement, and SchemaCompact as described on compactTag.
 //
 // Measurement:
 //   The path of the file.
@@ -45,165 +110,562 @@ func NewInfluxVolume(httpURL, database, retentionPolicy string) *InfluxVolume {
 // Fields:
 //   b: Reserved. Currently always set to integer zero.
 //      Used to avoid downloading a whole block when selecting a field is necessary.
-//   z: Z85-encoded binary data representing the raw content of the block.
-//      For all but the last block, len(z) == bs * 5 / 4.
+//   enc: The name of the Encoding of z, the same for every block of a file.
+//        Blocks written before encodings were recorded have no enc field, and are Z85.
+//        Later schemas record the encoding in the version's manifest instead.
+//   z: The raw content of the block, encoded with enc and escaped for line protocol.
+//      With Z85, for all but the last block, len(z) == bs * 5 / 4.
 //      For the last block, len(z) == sz % bs, rounding up to nearest 4 for padding.
+//   z0, z1, ..., zn: Instead of z, if the encoded block may be longer than InfluxVolumeOptions.MaxFieldSize.
+//                    Each of z0 to z(zn-1) holds at most that many bytes of the encoded block, in order,
+//                    and the integer zn is the number of them.
+//   ref: Only set on blocks written by LinkBlock, which have no z field.
+//        The sha256 of the version of the file whose identical block holds the data.
 func (v *InfluxVolume) UploadBlock(data []byte, bm *BlockMeta) error {
-	fm := bm.FileMeta
+	prefix, suffix, err := v.blockLineParts(bm)
+	if err != nil {
+		return err
+	}
 
-	prefix := fmt.Sprintf("%s,bi=%d,bs=%d,bsha256=%x,sha256=%x,sz=%d b=0i,z=\"",
-		fm.Path, bm.Index, fm.BlockSize, bm.SHA256[:], fm.SHA256[:], fm.Size,
-	)
-	suffix := fmt.Sprintf("\" %d\n", fm.Time)
+	size, ok := blockLineLen(prefix, v.encoding, v.maxFieldSize, len(data), suffix)
+	if !ok {
+		// The length of the line is not known until it is escaped, so build it first.
+		line, err := v.appendBlockLine(nil, data, bm)
+		if err != nil {
+			return err
+		}
+		return v.client.SendWrite(line, v.blockSendOpts())
+	}
 
-	buf := make([]byte, 0, len(prefix)+Z85EncodedLen(len(data))+len(suffix))
-	buf = append(buf, prefix...)
-	buf = Z85EncodeAppend(buf, data)
-	buf = append(buf, suffix...)
+	// Encode the block straight into the request body, rather than building the whole line first.
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(writeBlockLine(pw, prefix, v.encoding, v.maxFieldSize, data, suffix))
+	}()
+	return v.client.SendWriteFrom(pr, size, v.blockSendOpts())
+}
 
-	return v.client.SendWrite(buf, influxclient.SendOpts{
-		Database:        v.database,
-		RetentionPolicy: v.retentionPolicy,
-		Consistency:     "all", // seeing too many errors on consistency one.
-	})
+// blockLineLen returns the exact length of the line written by writeBlockLine for n bytes of data,
+// or false if e is not an exactEncoding and so the length depends on the data.
+func blockLineLen(prefix string, e Encoding, maxField, n int, suffix string) (int, bool) {
+	if _, ok := e.(exactEncoding); !ok {
+		return 0, false
+	}
+	l := e.EncodedLen(n)
+	if l <= maxField {
+		return len(prefix) + len(`z="`) + l + len(`"`) + len(suffix), true
+	}
+	parts := (l + maxField - 1) / maxField
+	size := len(prefix) + len(`z0="`) + l + len(fmt.Sprintf(`",zn=%di`, parts)) + len(suffix)
+	for k := 1; k < parts; k++ {
+		size += len(fmt.Sprintf(`",z%d="`, k))
+	}
+	return size, true
 }
 
-func (v *InfluxVolume) DownloadBlock(bm *BlockMeta) ([]byte, error) {
-	encoded, err := v.client.GetSingleBlock(v.database, v.retentionPolicy, bm.Path, bm.Index)
-	if err != nil {
-		return nil, err
+// writeBlockLine writes the line protocol representation of the block to w,
+// encoding data with e into its z field, or if the encoding may be longer than maxField bytes,
+// into as many fields z0, z1, ... of at most maxField bytes as it takes, followed by their number in zn.
+func writeBlockLine(w io.Writer, prefix string, e Encoding, maxField int, data []byte, suffix string) error {
+	if _, err := io.WriteString(w, prefix); err != nil {
+		return err
 	}
 
-	// It's safe to Z85DecodeAppend into the source slice.
-	raw := Z85DecodeAppend(encoded[:0], encoded)
-	raw = raw[:bm.expSize] // If decoding a short frame, don't read into padding.
+	split := e.EncodedLen(len(data)) > maxField
+	var fw io.Writer = fieldEscaper{w}
+	var fs *fieldSplitter
+	open := `z="`
+	if split {
+		fs = &fieldSplitter{w: w, max: maxField, parts: 1}
+		fw = fs
+		open = `z0="`
+	}
+	if _, err := io.WriteString(w, open); err != nil {
+		return err
+	}
 
-	if err := bm.CompareSHA256Against(bytes.NewReader(raw)); err != nil {
-		return nil, err
+	enc := e.NewEncoder(fw)
+	if _, err := enc.Write(data); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
 	}
 
-	return raw, nil
+	end := `"`
+	if split {
+		end = fmt.Sprintf(`",zn=%di`, fs.parts)
+	}
+	if _, err := io.WriteString(w, end); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, suffix)
+	return err
 }
 
-// ListBlocks returns a slice of block meta information belonging to path exactly.
-// There may be multiple timestamps that match.
-//
-// The path must be an exact match.
-func (v *InfluxVolume) ListBlocks(path string) ([]*BlockMeta, error) {
-	ss, err := v.client.ShowSeriesForPath(path, influxclient.QueryOpts{
-		Database:        v.database,
-		RetentionPolicy: v.retentionPolicy,
-	})
+// fieldSplitter escapes encoded data written through it to w as the values of the fields z0, z1, ...,
+// closing the current field and opening the next whenever max bytes have been written to it.
+// The caller opens z0 and closes the last field.
+type fieldSplitter struct {
+	w   io.Writer
+	max int
+
+	// Bytes written to the current field, and the number of fields opened.
+	n, parts int
+}
+
+func (s *fieldSplitter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.n == s.max {
+			if _, err := fmt.Fprintf(s.w, `",z%d="`, s.parts); err != nil {
+				return written, err
+			}
+			s.parts++
+			s.n = 0
+		}
+		k := s.max - s.n
+		if k > len(p) {
+			k = len(p)
+		}
+		if _, err := (fieldEscaper{s.w}).Write(p[:k]); err != nil {
+			return written, err
+		}
+		s.n += k
+		written += k
+		p = p[k:]
+	}
+	return written, nil
+}
+
+// blockLineParts returns the line protocol representation of the block that comes before
+// and after the fields holding the encoded data, according to the schema documented on UploadBlock.
+func (v *InfluxVolume) blockLineParts(bm *BlockMeta) (prefix, suffix string, err error) {
+	t, err := v.blockTime(bm)
+	if err != nil {
+		return "", "", err
+	}
+	enc := ""
+	if v.schema == SchemaSeries {
+		enc = fmt.Sprintf(",enc=\"%s\"", v.encoding.Name())
+	}
+	prefix = fmt.Sprintf("%s b=0i%s%s,", v.blockKey(bm), v.blockFields(bm), enc)
+	suffix = fmt.Sprintf(" %d\n", t)
+	return prefix, suffix, nil
+}
+
+// appendBlockLine appends the line protocol representation of the block to dst,
+// according to the schema documented on UploadBlock.
+func (v *InfluxVolume) appendBlockLine(dst, data []byte, bm *BlockMeta) ([]byte, error) {
+	prefix, suffix, err := v.blockLineParts(bm)
 	if err != nil {
 		return nil, err
 	}
 
-	mb := newMetaBuilder(len(ss))
-	for _, s := range ss {
-		// Assuming no malformed data arrived, tag values will never be escaped
-		// and the series key can be parsed by splitting on commas and equals.
-		if err := mb.Add(s); err != nil {
+	if v.encoding.EncodedLen(len(data)) > v.maxFieldSize {
+		buf := bytes.NewBuffer(dst)
+		if err := writeBlockLine(buf, prefix, v.encoding, v.maxFieldSize, data, suffix); err != nil {
 			return nil, err
 		}
+		return buf.Bytes(), nil
 	}
 
-	return mb.blocks, nil
+	if dst == nil {
+		dst = make([]byte, 0, len(prefix)+v.encoding.EncodedLen(len(data))+len(suffix)+4)
+	}
+	dst = append(dst, prefix...)
+	dst = append(dst, `z="`...)
+	start := len(dst)
+	dst = v.encoding.AppendEncode(dst, data)
+	dst = appendFieldEscaped(dst, start)
+	dst = append(dst, '"')
+	dst = append(dst, suffix...)
+	return dst, nil
 }
 
-type ListMatch int
+// LinkBlock stores bm as a reference to src, an identical block of another version of the same file,
+// instead of uploading the block's data again.
+// Downloads of bm find the data by its checksum.
+// This method is safe to call concurrently.
+func (v *InfluxVolume) LinkBlock(bm, src *BlockMeta) error {
+	line, err := v.appendLinkLine(nil, bm, src)
+	if err != nil {
+		return err
+	}
+	return v.client.SendWrite(line, v.blockSendOpts())
+}
 
-const (
-	ByPrefix ListMatch = iota
-)
+// appendLinkLine appends the line protocol representation of bm as a reference to src,
+// according to the schema documented on UploadBlock.
+func (v *InfluxVolume) appendLinkLine(dst []byte, bm, src *BlockMeta) ([]byte, error) {
+	if src.Path != bm.Path {
+		return nil, fmt.Errorf("block %d: cannot link to block of %s from %s", bm.Index, src.Path, bm.Path)
+	}
+	if src.SHA256 != bm.SHA256 {
+		return nil, fmt.Errorf("block %d: cannot link to block %d with different checksum", bm.Index, src.Index)
+	}
 
-type ListOptions struct {
-	Database  string
-	ListMatch ListMatch
+	t, err := v.blockTime(bm)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, fmt.Sprintf("%s b=0i%s,ref=\"%x\" %d\n",
+		v.blockKey(bm), v.blockFields(bm), src.FileMeta.SHA256[:], t,
+	)...), nil
 }
 
-// ListFiles returns a list of filenames matching pattern, according to opts.ListMatch
-func (v *InfluxVolume) ListFiles(pattern string, opts ListOptions) ([]string, error) {
-	// For now, assuming ByPrefix is the only choice.
-	return v.client.ShowMeasurementsByPrefix(pattern, v.database)
+// commitMeasurement holds one point per committed version of a file:
+//
+// Tags:
+//   path: The path of the file.
+//   bs, sha256, sz: The file-level tags of the version's blocks.
+//
+// Fields:
+//   c: Always true.
+//   v: The Schema of the version, always SchemaSeries. Commits written before schemas were recorded have none.
+//   attrs: The version's Attrs as JSON, if any are set.
+//
+// The point's time is the time of the version.
+// Paths of files always begin with a slash, so this never collides with a file's measurement.
+const commitMeasurement = "blob_commits"
+
+// Commit writes the commit point of fm's version, or with later schemas, its manifest.
+// It should only be called once every block of the version has been uploaded.
+func (v *InfluxVolume) Commit(fm *FileMeta) error {
+	if v.schema >= SchemaManifest {
+		return v.commitManifest(fm)
+	}
+	return v.commitSeries(fm)
 }
 
-// Internal struct to quickly look up a timestamp-less FileMeta from a series key.
-// You don't need to bother splitting the tags on = if you don't want to.
-type fileKey struct {
-	Path      string
-	SHA256    string
-	Size      string
-	BlockSize string
+// commitSeries writes the commit point of fm's version, as SchemaSeries does.
+func (v *InfluxVolume) commitSeries(fm *FileMeta) error {
+	attrs, err := attrsField(fm)
+	if err != nil {
+		return err
+	}
+	return v.sendWrite([]byte(fmt.Sprintf("%s,bs=%d,path=%s,sha256=%x,sz=%d c=true,v=%di%s %d\n",
+		commitMeasurement, fm.BlockSize, escapeTag(fm.Path), fm.SHA256[:], fm.Size, SchemaSeries, attrs, fm.Time,
+	)))
 }
 
-type metaBuilder struct {
-	blocks []*BlockMeta
-	files  map[fileKey]*FileMeta
+// escapeTag escapes a tag value for line protocol.
+var escapeTag = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace
+
+// escapeMeasurement escapes a measurement name, such as the path of a file, for line protocol.
+var escapeMeasurement = strings.NewReplacer(",", `\,`, " ", `\ `).Replace
+
+// escapeField escapes the value of a string field for line protocol.
+var escapeField = strings.NewReplacer(`"`, `\"`, `\`, `\\`).Replace
+
+// sendWrite sends the line protocol in buf to the volume's database and retention policy.
+func (v *InfluxVolume) sendWrite(buf []byte) error {
+	return v.client.SendWrite(buf, v.sendOpts())
 }
 
-// newMetaBuilder returns a new metaBuilder with capacity for initialSize files.
-func newMetaBuilder(initialSize int) *metaBuilder {
-	return &metaBuilder{
-		blocks: make([]*BlockMeta, 0, 4*initialSize),
-		files:  make(map[fileKey]*FileMeta, initialSize),
+// sendOpts returns the options for writing to the volume's database and retention policy.
+func (v *InfluxVolume) sendOpts() influxclient.SendOpts {
+	return influxclient.SendOpts{
+		Database:        v.database,
+		RetentionPolicy: v.retentionPolicy,
+		Consistency:     "all", // seeing too many errors on consistency one.
 	}
 }
 
-// Add parses a series key string into a new BlockMeta.
-// Prevents duplicate FileMeta.
-func (m *metaBuilder) Add(sk string) error {
-	parts := strings.Split(sk, ",")
-	if len(parts) != 6 {
-		panic(fmt.Sprintf("exp 6 part, got: %#v", parts))
+// blockSendOpts returns the options for writing the points of blocks,
+// whose timestamps are in nanoseconds with SchemaCompact.
+func (v *InfluxVolume) blockSendOpts() influxclient.SendOpts {
+	opts := v.sendOpts()
+	if v.schema == SchemaCompact {
+		opts.Precision = "ns"
 	}
+	return opts
+}
 
-	var (
-		// Raw path
-		path = parts[0]
+// DownloadBlock returns the data of the block, which may have been stored by any version of the file
+// with the same block checksum, including the version a linked block refers to.
+// Stored copies that cannot be decoded, or that do not match the checksum, are skipped.
+// The block's own point is looked up first, if it was written with SchemaCompact.
+func (v *InfluxVolume) DownloadBlock(bm *BlockMeta) ([]byte, error) {
+	var raw []byte
+	var lastErr error
+	try := func(_ string, src influxclient.BlockSource, encoded []byte) error {
+		if raw != nil {
+			return nil
+		}
 
-		// Everything else is k=v, and we'll need to split them up
+		decoded, err := v.decodeBlock(bm.Path, src, encoded)
+		if err != nil {
+			lastErr = fmt.Errorf("block %d: %w", bm.Index, err)
+			return nil
+		}
+		if len(decoded) < bm.expSize || len(decoded) > paddedSize(bm.expSize) {
+			lastErr = fmt.Errorf("block %d: %w", bm.Index, &SizeError{Exp: int64(bm.expSize), Got: int64(len(decoded))})
+			return nil
+		}
+		decoded = decoded[:bm.expSize] // If decoding a short frame, don't read into padding.
 
-		blockIndex  = parts[1]
-		blockSize   = parts[2]
-		blockSHA256 = parts[3]
-		fileSHA256  = parts[4]
-		size        = parts[5]
-	)
+		if err := bm.CompareSHA256Against(bytes.NewReader(decoded)); err != nil {
+			lastErr = err
+			return nil
+		}
+		raw = decoded
+		return nil
+	}
 
-	// Ensure we have the one copy of this fileMeta.
-	fk := fileKey{Path: path, SHA256: fileSHA256, Size: size, BlockSize: blockSize}
-	var fm *FileMeta
-	if fm = m.files[fk]; fm == nil {
-		var err error
-		fm, err = fileMetaFromFileKey(fk)
-		if err != nil {
-			return err
+	shas := []string{fmt.Sprintf("%x", bm.SHA256[:])}
+	byTag := func() error { return v.client.GetBlocksBySHA256(bm.Path, shas, v.queryOpts(), try) }
+	// Matching a field reads every point of the file, so it is only a fallback for linked blocks.
+	byField := func() error { return v.client.GetBlocksByField(bm.Path, "h", shas, v.queryOpts(), try) }
+	lookups := []func() error{byTag, byField}
+	if bm.layout == SchemaCompact {
+		// The block's own point is at a known time.
+		own := func() error {
+			return v.downloadCompactBlocks([]*BlockMeta{bm}, func(_ int, src influxclient.BlockSource, encoded []byte) error {
+				return try("", src, encoded)
+			})
 		}
-		m.files[fk] = fm
+		lookups = []func() error{own, byField, byTag}
 	}
+	for _, lookup := range lookups {
+		if raw != nil {
+			break
+		}
+		if err := lookup(); err != nil {
+			return nil, err
+		}
+	}
+
+	if raw == nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("block %d of %s: %w", bm.Index, bm.Path, ErrBlockMissing)
+	}
+	return raw, nil
+}
 
-	// Always make a new BlockMeta.
-	i, err := getV("bi", blockIndex)
+// decodeBlock decodes z, the stored data of a block of path read from src,
+// with the encoding that src records, or if it records none, the encoding of the version that stored it.
+func (v *InfluxVolume) decodeBlock(path string, src influxclient.BlockSource, z []byte) ([]byte, error) {
+	e, err := v.blockEncoding(path, src)
 	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(e, z)
+}
+
+// paddedSize returns the length of n bytes once Z85-decoded, including the padding of the final frame.
+// Other encodings decode to exactly n bytes.
+func paddedSize(n int) int {
+	return (n + 3) / 4 * 4
+}
+
+// queryOpts returns the options for querying the volume's database and retention policy.
+func (v *InfluxVolume) queryOpts() influxclient.QueryOpts {
+	return influxclient.QueryOpts{
+		Database:        v.database,
+		RetentionPolicy: v.retentionPolicy,
+	}
+}
+
+// DownloadBlocks fetches every block in bms with a single query,
+// calling fn with each block's raw data as it is decoded from the response.
+// All of bms must belong to the same FileMeta.
+//
+// Blocks written with SchemaCompact are fetched with another query, over the range of their times.
+// Blocks written by LinkBlock are fetched afterwards, by checksum, in further queries.
+//
+// Unlike DownloadBlock, DownloadBlocks does not verify the checksum of each block;
+// that is left to fn, which typically hands the block to the engine.
+// Blocks missing from both responses are not reported to fn.
+func (v *InfluxVolume) DownloadBlocks(bms []*BlockMeta, fn func(bm *BlockMeta, data []byte) error) error {
+	if len(bms) == 0 {
+		return nil
+	}
+
+	fm := bms[0].FileMeta
+	byIndex := make(map[int]*BlockMeta, len(bms))
+	var indexes []int
+	var compact []*BlockMeta
+	for _, bm := range bms {
+		if bm.FileMeta != fm {
+			return fmt.Errorf("(%T).DownloadBlocks: all BlockMeta must have same FileMeta", v)
+		}
+		byIndex[bm.Index] = bm
+		if bm.layout == SchemaCompact {
+			compact = append(compact, bm)
+		} else {
+			indexes = append(indexes, bm.Index)
+		}
+	}
+
+	got := make(map[int]bool, len(bms))
+	deliver := func(bi int, src influxclient.BlockSource, encoded []byte) error {
+		bm := byIndex[bi]
+		if bm == nil {
+			return fmt.Errorf("received unrequested block %d", bi)
+		}
+		if got[bi] {
+			return nil
+		}
+
+		raw, err := v.decodeBlock(fm.Path, src, encoded)
+		if err != nil {
+			return fmt.Errorf("block %d: %w", bi, err)
+		}
+		if len(raw) < bm.expSize {
+			return fmt.Errorf("block %d: exp at least %d bytes, got %d", bi, bm.expSize, len(raw))
+		}
+		got[bi] = true
+		return fn(bm, raw[:bm.expSize])
+	}
+	if err := v.client.GetBlocks(fm.Path, fmt.Sprintf("%x", fm.SHA256[:]), fm.BlockSize, indexes, v.queryOpts(), deliver); err != nil {
 		return err
 	}
-	idx, err := strconv.Atoi(i)
-	if err != nil {
+	if err := v.downloadCompactBlocks(compact, func(bi int, src influxclient.BlockSource, encoded []byte) error {
+		// The range of times may include blocks that were not requested, or that are stored with another schema.
+		if bm := byIndex[bi]; bm == nil || bm.layout != SchemaCompact {
+			return nil
+		}
+		return deliver(bi, src, encoded)
+	}); err != nil {
 		return err
 	}
-	bm := fm.NewBlockMeta(idx)
 
-	// Copy in the hash.
-	hexSha, err := getV("bsha256", blockSHA256)
+	// Any block not returned may be linked to another version.
+	bySHA := make(map[string][]*BlockMeta)
+	var shas []string
+	for _, bm := range bms {
+		if got[bm.Index] {
+			continue
+		}
+		h := fmt.Sprintf("%x", bm.SHA256[:])
+		if bySHA[h] == nil {
+			shas = append(shas, h)
+		}
+		bySHA[h] = append(bySHA[h], bm)
+	}
+
+	linked := func(h string, src influxclient.BlockSource, encoded []byte) error {
+		missing := bySHA[h]
+		if len(missing) == 0 {
+			// Already delivered from another version.
+			return nil
+		}
+		delete(bySHA, h)
+
+		raw, err := v.decodeBlock(fm.Path, src, encoded)
+		if err != nil {
+			return fmt.Errorf("block %d: %w", missing[0].Index, err)
+		}
+		for _, bm := range missing {
+			if len(raw) < bm.expSize {
+				return fmt.Errorf("block %d: exp at least %d bytes, got %d", bm.Index, bm.expSize, len(raw))
+			}
+			if err := fn(bm, raw[:bm.expSize]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := v.client.GetBlocksBySHA256(fm.Path, shas, v.queryOpts(), linked); err != nil {
+		return err
+	}
+
+	// The rest may be linked to blocks written with SchemaCompact, whose checksum is a field.
+	var rest []string
+	for _, h := range shas {
+		if bySHA[h] != nil {
+			rest = append(rest, h)
+		}
+	}
+	return v.client.GetBlocksByField(fm.Path, "h", rest, v.queryOpts(), linked)
+}
+
+// ListBlocks returns a slice of block meta information belonging to path exactly.
+// There may be multiple timestamps that match.
+// Versions are listed whichever Schema they were written with.
+//
+// The path must be an exact match.
+func (v *InfluxVolume) ListBlocks(path string, opts ListOptions) ([]*BlockMeta, error) {
+	return v.listBlocks(path, opts)
+}
+
+// fileKeyOfTags returns the fileKey of the version with the file-level tags in tags.
+func fileKeyOfTags(path string, tags map[string]string) fileKey {
+	return fileKey{
+		Path:      path,
+		BlockSize: "bs=" + tags["bs"],
+		SHA256:    "sha256=" + tags["sha256"],
+		Size:      "sz=" + tags["sz"],
+	}
+}
+
+// ListFiles returns a list of filenames matching pattern, according to opts.ListMatch
+func (v *InfluxVolume) ListFiles(pattern string, opts ListOptions) ([]string, error) {
+	// For now, assuming ByPrefix is the only choice.
+	if !opts.IncludeUncommitted {
+		return v.listFiles(pattern)
+	}
+
+	names := []string{}
+	if err := v.client.ShowMeasurementsByPrefixFunc(pattern, v.database, func(name string) error {
+		if name != commitMeasurement && name != manifestMeasurement {
+			names = append(names, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Stat returns the FileMeta of the versions of the file at path, oldest first.
+// Committed versions are read from their manifests or commit points, without listing any blocks.
+func (v *InfluxVolume) Stat(path string, opts ListOptions) ([]*FileMeta, error) {
+	if !opts.IncludeUncommitted {
+		fms, err := v.versions(path)
+		if err == nil && len(fms) == 0 {
+			err = ErrNotExist
+		}
+		return fms, err
+	}
+	bms, err := v.ListBlocks(path, opts)
 	if err != nil {
+		return nil, err
+	}
+	return FileMetas(bms), nil
+}
+
+// Delete drops the commit, the manifest and every block series belonging to the version of the file described by fm,
+// whichever schema they were written with.
+// Blocks of other versions that were linked to this version's blocks become unreadable.
+func (v *InfluxVolume) Delete(fm *FileMeta) error {
+	tags := map[string]string{
+		"bs":     strconv.Itoa(fm.BlockSize),
+		"sha256": fmt.Sprintf("%x", fm.SHA256[:]),
+	}
+	if err := v.client.DropSeries(fm.Path, tags, v.queryOpts()); err != nil {
 		return err
 	}
-	if err := bm.SetSHA256String(hexSha); err != nil {
+
+	tags["path"] = fm.Path
+	if err := v.client.DropSeries(manifestMeasurement, tags, v.queryOpts()); err != nil {
 		return err
 	}
+	tags["sz"] = strconv.Itoa(fm.Size)
+	return v.client.DropSeries(commitMeasurement, tags, v.queryOpts())
+}
 
-	m.blocks = append(m.blocks, bm)
-	return nil
+// Internal struct to quickly look up a timestamp-less FileMeta from the tags of its points.
+// Each value keeps its key= prefix, as it appeared in series keys.
+type fileKey struct {
+	Path      string
+	SHA256    string
+	Size      string
+	BlockSize string
 }
 
 // getV returns the value in a key-value pair separated by =.
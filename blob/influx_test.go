@@ -0,0 +1,600 @@
+package blob_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+	"github.com/mark-rushakoff/influx-blob/internal/influxclient"
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+// memFile is an in-memory io.WriterAt for downloads, safe for concurrent use.
+type memFile struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := int(off) + len(p); end > len(f.buf) {
+		f.buf = append(f.buf, make([]byte, end-len(f.buf))...)
+	}
+	return copy(f.buf[off:], p), nil
+}
+
+// randomFile returns size bytes of reproducible random content and its FileMeta.
+func randomFile(t testing.TB, path string, size, blockSize int, time int64) ([]byte, *blob.FileMeta) {
+	t.Helper()
+
+	src := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(src)
+	fm, err := blob.NewFileMeta(bytes.NewReader(src))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm.Path = path
+	fm.BlockSize = blockSize
+	fm.Time = time
+	return src, fm
+}
+
+func TestInfluxVolume_RoundTrip(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	e := engine.NewEngine(8, 4)
+	v := blob.NewInfluxVolume(s.URL, "blob", "")
+
+	src, fm := randomFile(t, "/my/file", 100*1024+3, 1024, 1500000000)
+	up := e.UploadFile(bytes.NewReader(src), fm, blob.NewBatchUploader(v, blob.BatchOptions{MaxPoints: 8}))
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+	if writes, _ := s.Requests(); writes >= fm.NumBlocks() {
+		t.Fatalf("exp blocks to be batched, got %d writes for %d blocks", writes, fm.NumBlocks())
+	}
+
+	names, err := v.ListFiles("/my", blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(names) != 1 || names[0] != "/my/file" {
+		t.Fatalf("exp [/my/file], got %v", names)
+	}
+
+	fms, err := v.Stat("/my/file", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 1 || fms[0].Time != fm.Time || fms[0].Size != fm.Size || fms[0].SHA256 != fm.SHA256 {
+		t.Fatalf("exp stat to match uploaded file, got %+v", fms)
+	}
+
+	bms, err := v.ListBlocks("/my/file", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	_, queriesBefore := s.Requests()
+	out := &memFile{}
+	down, err := e.DownloadFile(out, blob.LatestBlocks(bms), v)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if err := down.Err(); err != nil {
+		t.Fatalf("exp no download err, got %s", err)
+	}
+	if !bytes.Equal(out.buf, src) {
+		t.Fatalf("downloaded content did not match")
+	}
+	if _, queries := s.Requests(); queries-queriesBefore >= fm.NumBlocks() {
+		t.Fatalf("exp ranged queries, got %d queries for %d blocks", queries-queriesBefore, fm.NumBlocks())
+	}
+
+	// The single block path must agree with the ranged one.
+	data, err := v.DownloadBlock(bms[1])
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if !bytes.Equal(data, src[1024:2048]) {
+		t.Fatalf("single block download did not match")
+	}
+
+	if err := v.Delete(fms[0]); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if _, err := v.Stat("/my/file", blob.ListOptions{}); err != blob.ErrNotExist {
+		t.Fatalf("exp ErrNotExist after delete, got %v", err)
+	}
+}
+
+func TestInfluxVolume_SameContentTwoBlockSizes(t *testing.T) {
+	for _, schema := range []blob.Schema{blob.SchemaSeries, blob.SchemaManifest, blob.SchemaCompact} {
+		s := influxtest.NewServer()
+
+		e := engine.NewEngine(8, 4)
+		v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: schema})
+
+		// The versions share the file checksum and block indexes, and differ only in block size.
+		src, fm := randomFile(t, "/my/file", 4*1024+3, 1024, 1500000000)
+		roundTrip(t, e, v, src, fm)
+		_, fm2 := randomFile(t, "/my/file", 4*1024+3, 512, 1500000100)
+		roundTrip(t, e, v, src, fm2)
+
+		bms, err := v.ListBlocks(fm.Path, blob.ListOptions{})
+		if err != nil {
+			t.Fatalf("%s: exp no err, got %s", schema, err)
+		}
+		fms := blob.FileMetas(bms)
+		if len(fms) != 2 {
+			t.Fatalf("%s: exp two versions, got %+v", schema, fms)
+		}
+		for _, fm := range fms {
+			out := new(memFile)
+			down, err := e.DownloadFile(out, blob.BlocksOf(fm, bms), v)
+			if err != nil {
+				t.Fatalf("%s: exp no err, got %s", schema, err)
+			}
+			down.Wait()
+			if err := down.Err(); err != nil {
+				t.Fatalf("%s: exp no download err for block size %d, got %s", schema, fm.BlockSize, err)
+			}
+			if !bytes.Equal(out.buf, src) {
+				t.Fatalf("%s: content with block size %d did not match", schema, fm.BlockSize)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestInfluxVolume_PathEscaping(t *testing.T) {
+	const path = "/my dir/a,b=c"
+
+	for _, schema := range []blob.Schema{blob.SchemaSeries, blob.SchemaManifest, blob.SchemaCompact} {
+		s := influxtest.NewServer()
+
+		e := engine.NewEngine(8, 4)
+		v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: schema})
+
+		src, fm := randomFile(t, path, 4*1024+3, 1024, 1500000000)
+		roundTrip(t, e, v, src, fm)
+
+		names, err := v.ListFiles("/my dir/", blob.ListOptions{ListMatch: blob.ByPrefix, IncludeUncommitted: true})
+		if err != nil || len(names) != 1 || names[0] != path {
+			t.Fatalf("%s: exp [%s], got %v (%v)", schema, path, names, err)
+		}
+		if fms, err := v.Stat(path, blob.ListOptions{}); err != nil || len(fms) != 1 || fms[0].Path != path {
+			t.Fatalf("%s: exp one version of %s, got %v (%v)", schema, path, fms, err)
+		}
+		s.Close()
+	}
+}
+
+func TestInfluxVolume_Commit(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	v := blob.NewInfluxVolume(s.URL, "blob", "")
+	src, fm := randomFile(t, "/my/file", 2*1024, 1024, 1500000000)
+
+	// Upload the blocks without committing, as an interrupted upload would.
+	for i := 0; i < fm.NumBlocks(); i++ {
+		bm := fm.NewBlockMeta(i)
+		data := src[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()]
+		if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+		if err := v.UploadBlock(data, bm); err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+	}
+
+	names, err := v.ListFiles("/", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("exp uncommitted file to be hidden, got %v", names)
+	}
+	if _, err := v.ListBlocks(fm.Path, blob.ListOptions{}); err != blob.ErrNotExist {
+		t.Fatalf("exp ErrNotExist before commit, got %v", err)
+	}
+	fms, err := v.Stat(fm.Path, blob.ListOptions{IncludeUncommitted: true})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 1 || fms[0].Committed {
+		t.Fatalf("exp one uncommitted version, got %+v", fms)
+	}
+
+	if err := v.Commit(fm); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	names, err = v.ListFiles("/", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(names) != 1 || names[0] != fm.Path {
+		t.Fatalf("exp [%s], got %v", fm.Path, names)
+	}
+	fms, err = v.Stat(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 1 || !fms[0].Committed || fms[0].Time != fm.Time {
+		t.Fatalf("exp one committed version, got %+v", fms)
+	}
+
+	if err := v.Delete(fms[0]); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if names, err := v.ListFiles("/", blob.ListOptions{}); err != nil || len(names) != 0 {
+		t.Fatalf("exp commit to be deleted, got %v (%v)", names, err)
+	}
+}
+
+func TestInfluxVolume_LinkBlock(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	e := engine.NewEngine(4, 4)
+	v := blob.NewInfluxVolume(s.URL, "blob", "")
+
+	old, fm1 := randomFile(t, "/my/file", 16*1024, 1024, 1500000000)
+	up := e.UploadFile(bytes.NewReader(old), fm1, v)
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+
+	cur := append([]byte(nil), old...)
+	copy(cur[5*1024:], "changed")
+	fm2, err := blob.NewFileMeta(bytes.NewReader(cur))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm2.Path, fm2.BlockSize, fm2.Time = "/my/file", 1024, 1500000001
+
+	prev, err := v.ListBlocks("/my/file", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	up = e.UploadFileDelta(bytes.NewReader(cur), fm2, blob.NewBatchUploader(v, blob.BatchOptions{}), prev)
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+	if n := up.Stats().SkippedBlocks; n != fm2.NumBlocks()-1 {
+		t.Fatalf("exp %d linked blocks, got %d", fm2.NumBlocks()-1, n)
+	}
+
+	var stored int
+	for _, p := range s.Points("blob", "/my/file") {
+		if p.Tags["sha256"] == fmt.Sprintf("%x", fm2.SHA256[:]) && p.Fields["z"] != nil {
+			stored++
+		}
+	}
+	if stored != 1 {
+		t.Fatalf("exp only the changed block to be stored again, got %d", stored)
+	}
+
+	bms, err := v.ListBlocks("/my/file", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	latest := blob.LatestBlocks(bms)
+	out := &memFile{}
+	down, err := e.DownloadFile(out, latest, v)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if err := down.Err(); err != nil {
+		t.Fatalf("exp no download err, got %s", err)
+	}
+	if !bytes.Equal(out.buf, cur) {
+		t.Fatalf("downloaded content did not match")
+	}
+
+	data, err := v.DownloadBlock(latest[0])
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if !bytes.Equal(data, cur[:1024]) {
+		t.Fatalf("linked block download did not match")
+	}
+}
+
+func TestInfluxVolume_Faults(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	e := engine.NewEngine(1, 1)
+	v := blob.NewInfluxVolume(s.URL, "blob", "")
+	src, fm := randomFile(t, "/my/file", 4*1024, 1024, 1500000000)
+
+	// A failed write is reported against the block.
+	s.SetFaults(influxtest.Faults{FailWrites: 1, Status: 500})
+	up := e.UploadFile(bytes.NewReader(src), fm, v)
+	up.Wait()
+	if up.Blocks[0].Err() == nil {
+		t.Fatalf("exp first block to fail")
+	}
+	for _, b := range up.Blocks[1:] {
+		if err := b.Err(); err != nil {
+			t.Fatalf("exp later blocks to succeed, got %s", err)
+		}
+	}
+
+	// A silently dropped point prevents the commit, and shows up as a missing block on download.
+	s.SetFaults(influxtest.Faults{DropPoint: func(p influxtest.Point) bool {
+		return p.Tags["bi"] == "0"
+	}})
+	up = e.UploadFile(bytes.NewReader(src), fm, v)
+	up.Wait()
+	if err := up.Err(); !errors.Is(err, blob.ErrBlockMissing) {
+		t.Fatalf("exp commit to fail with ErrBlockMissing, got %v", err)
+	}
+
+	s.SetFaults(influxtest.Faults{})
+	bms, err := v.ListBlocks("/my/file", blob.ListOptions{IncludeUncommitted: true})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(bms) != fm.NumBlocks()-1 {
+		t.Fatalf("exp %d blocks listed, got %d", fm.NumBlocks()-1, len(bms))
+	}
+	if _, err := v.DownloadBlock(fm.NewBlockMeta(0)); err == nil {
+		t.Fatalf("exp err downloading dropped block")
+	}
+
+	// Failed queries surface as errors.
+	s.SetFaults(influxtest.Faults{FailQueries: 1})
+	if _, err := v.ListBlocks("/my/file", blob.ListOptions{IncludeUncommitted: true}); err == nil {
+		t.Fatalf("exp err from failed query")
+	}
+}
+
+func TestInfluxVolume_DownloadBlock_InvalidZ85(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	v := blob.NewInfluxVolume(s.URL, "blob", "")
+	src, fm := randomFile(t, "/my/file", 8, 8, 1500000000)
+	bm := fm.NewBlockMeta(0)
+	if err := bm.SetSHA256(bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The encoded block is the right length, but its third character is not in the Z85 alphabet.
+	line := fmt.Sprintf("%s,bi=0,bs=8,bsha256=%x,sha256=%x,sz=8 b=0i,z=\"ab~defghij\" %d\n",
+		fm.Path, bm.SHA256[:], fm.SHA256[:], fm.Time)
+	resp, err := http.Post(s.URL+"/write?db=blob&precision=s", "text/plain", strings.NewReader(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("exp write to succeed, got status %d", resp.StatusCode)
+	}
+
+	_, err = v.DownloadBlock(bm)
+	var ze *blob.Z85Error
+	if !errors.As(err, &ze) || ze.Offset != 2 || !errors.Is(err, blob.ErrZ85InvalidChar) {
+		t.Fatalf("exp invalid character at offset 2, got %v", err)
+	}
+}
+
+func TestInfluxVolume_SplitFields(t *testing.T) {
+	const maxField = 100
+
+	for _, schema := range []blob.Schema{blob.SchemaSeries, blob.SchemaManifest, blob.SchemaCompact} {
+		for _, enc := range blob.Encodings {
+			s := influxtest.NewServer()
+
+			e := engine.NewEngine(8, 4)
+			v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Encoding: enc, Schema: schema, MaxFieldSize: maxField})
+
+			// Batched uploads append each line, while UploadBlock streams it.
+			src, fm := randomFile(t, "/batched", 4*1024+3, 1024, 1500000000)
+			roundTrip(t, e, v, src, fm)
+
+			src2, fm2 := randomFile(t, "/streamed", 2*1024+1, 1024, 1500000000)
+			for i := 0; i < fm2.NumBlocks(); i++ {
+				bm := fm2.NewBlockMeta(i)
+				data := src2[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()]
+				if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+				if err := v.UploadBlock(data, bm); err != nil {
+					t.Fatalf("%s/%s: exp no err, got %s", schema, enc.Name(), err)
+				}
+			}
+			bms, err := v.ListBlocks(fm2.Path, blob.ListOptions{IncludeUncommitted: true})
+			if err != nil {
+				t.Fatalf("%s/%s: exp no err, got %s", schema, enc.Name(), err)
+			}
+			for _, bm := range bms {
+				data, err := v.DownloadBlock(bm)
+				if err != nil {
+					t.Fatalf("%s/%s: exp no err downloading block %d, got %s", schema, enc.Name(), bm.Index, err)
+				}
+				if !bytes.Equal(data, src2[bm.FileOffset():int(bm.FileOffset())+bm.ExpSize()]) {
+					t.Fatalf("%s/%s: block %d did not match", schema, enc.Name(), bm.Index)
+				}
+			}
+
+			for _, path := range []string{fm.Path, fm2.Path} {
+				for _, p := range s.Points("blob", path) {
+					// Only the last, short block of each file fits in a single field.
+					if z, ok := p.Fields["z"].(string); ok {
+						if len(z) > maxField || p.Fields["zn"] != nil {
+							t.Fatalf("%s/%s: exp z of at most %d bytes, got %d", schema, enc.Name(), maxField, len(z))
+						}
+						continue
+					}
+					n, ok := p.Fields["zn"].(int64)
+					if !ok || n < 2 {
+						t.Fatalf("%s/%s: exp block split across fields, got %v", schema, enc.Name(), p.Fields)
+					}
+					for i := 0; i < int(n); i++ {
+						if part, _ := p.Fields[fmt.Sprintf("z%d", i)].(string); part == "" || len(part) > maxField {
+							t.Fatalf("%s/%s: exp field z%d of at most %d bytes, got %d", schema, enc.Name(), i, maxField, len(part))
+						}
+					}
+				}
+			}
+			s.Close()
+		}
+	}
+}
+
+func TestInfluxVolume_UploadBlock_ContentLength(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	// Check the length each write declares against the body that follows it.
+	var mu sync.Mutex
+	var mismatch string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/write" && r.ContentLength != int64(len(body)) {
+			mu.Lock()
+			mismatch = fmt.Sprintf("Content-Length %d for a body of %d bytes", r.ContentLength, len(body))
+			mu.Unlock()
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		s.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	for _, maxField := range []int{0, 100} {
+		for _, enc := range blob.Encodings {
+			v := blob.NewInfluxVolumeWithOptions(proxy.URL, "blob", "", blob.InfluxVolumeOptions{
+				Encoding:     enc,
+				MaxFieldSize: maxField,
+				Client:       influxclient.ClientOptions{DisableGzip: true},
+			})
+			src, fm := randomFile(t, fmt.Sprintf("/len/%s/%d", enc.Name(), maxField), 4*1024+3, 1024, 1500000000)
+			for i := 0; i < fm.NumBlocks(); i++ {
+				bm := fm.NewBlockMeta(i)
+				data := src[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()]
+				if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+				if err := v.UploadBlock(data, bm); err != nil {
+					t.Fatalf("%s/%d: exp no err, got %s", enc.Name(), maxField, err)
+				}
+			}
+			mu.Lock()
+			if mismatch != "" {
+				t.Fatalf("%s/%d: exp exact Content-Length, got %s", enc.Name(), maxField, mismatch)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+func TestInfluxVolume_LegacyVersions(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	// writeLegacy writes the first n blocks of a version uploaded before commit points existed,
+	// with no enc field on its blocks.
+	writeLegacy := func(src []byte, fm *blob.FileMeta, n int) {
+		t.Helper()
+		var lines []string
+		for i := 0; i < n; i++ {
+			bm := fm.NewBlockMeta(i)
+			data := src[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()]
+			if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, fmt.Sprintf("%s,bi=%d,bs=%d,bsha256=%x,sha256=%x,sz=%d b=0i,z=\"%s\" %d\n",
+				fm.Path, i, fm.BlockSize, bm.SHA256[:], fm.SHA256[:], fm.Size, blob.Z85.AppendEncode(nil, data), fm.Time))
+		}
+		resp, err := http.Post(s.URL+"/write?db=blob&precision=s", "text/plain", strings.NewReader(strings.Join(lines, "")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	src, fm := randomFile(t, "/legacy", 8, 8, 1400000000)
+	writeLegacy(src, fm, 1)
+	// A legacy upload that was interrupted after its first block.
+	src3, fm3 := randomFile(t, "/interrupted", 16, 8, 1400000000)
+	writeLegacy(src3, fm3, 1)
+
+	// A version still being uploaded with the same schema.
+	old := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: blob.SchemaSeries})
+	src2, fm2 := randomFile(t, "/pending", 8, 8, 1500000000)
+	bm2 := fm2.NewBlockMeta(0)
+	if err := bm2.SetSHA256(bytes.NewReader(src2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.UploadBlock(src2, bm2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading writes nothing, so legacy versions stay hidden until committed.
+	v := blob.NewInfluxVolume(s.URL, "blob", "")
+	writes, _ := s.Requests()
+	if names, err := v.ListFiles("/", blob.ListOptions{ListMatch: blob.ByPrefix}); err != nil || len(names) != 0 {
+		t.Fatalf("exp no committed files, got %v (%v)", names, err)
+	}
+	if _, err := v.Stat(fm.Path, blob.ListOptions{}); err != blob.ErrNotExist {
+		t.Fatalf("exp legacy version hidden before commit, got %v", err)
+	}
+	if after, _ := s.Requests(); after != writes {
+		t.Fatalf("exp no writes from reads, got %d", after-writes)
+	}
+
+	committed, err := v.CommitLegacy("/")
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(committed) != 1 || committed[0].Path != fm.Path {
+		t.Fatalf("exp only the complete legacy version committed, got %+v", committed)
+	}
+	names, err := v.ListFiles("/", blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(names) != 1 || names[0] != fm.Path {
+		t.Fatalf("exp only the legacy file, got %v", names)
+	}
+	fms, err := v.Stat(fm.Path, blob.ListOptions{})
+	if err != nil || len(fms) != 1 || !fms[0].Committed || fms[0].Time != fm.Time {
+		t.Fatalf("exp legacy version committed at its time, got %+v (%v)", fms, err)
+	}
+	for _, p := range []string{fm2.Path, fm3.Path} {
+		if _, err := v.Stat(p, blob.ListOptions{}); err != blob.ErrNotExist {
+			t.Fatalf("exp %s to stay hidden, got %v", p, err)
+		}
+	}
+
+	bms, err := v.ListBlocks(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	data, err := v.DownloadBlock(bms[0])
+	if err != nil || !bytes.Equal(data, src) {
+		t.Fatalf("exp legacy block to download, got %q (%v)", data, err)
+	}
+
+	if committed, err := v.CommitLegacy("/"); err != nil || len(committed) != 0 {
+		t.Fatalf("exp nothing left to commit, got %+v (%v)", committed, err)
+	}
+}
@@ -0,0 +1,271 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/mark-rushakoff/influx-blob/internal/influxclient"
+)
+
+// manifestMeasurement holds one point per committed version of a file, written by SchemaManifest and later schemas:
+//
+// Tags:
+//   path: The path of the file.
+//   bs, sha256: The block size and checksum of the version, as tagged on its blocks.
+//
+// Fields:
+//   v: The Schema the version's blocks were written with.
+//      Manifests written before schemas were recorded have none, and are SchemaManifest.
+//   sz: The size of the file.
+//   enc: The name of the Encoding of the version's blocks, which do not record it themselves.
+//        Manifests written before then have none, and their blocks have the enc field of SchemaSeries.
+//   nb: The number of blocks.
+//   blocks: The SHA256 of the concatenated hex checksums of the blocks, in order, plain ASCII hex representation.
+//           It is a hash of the list of blocks rather than the list itself, which is read from the blocks' own points.
+//   attrs: The version's Attrs as JSON, if any are set.
+//
+// The point's time is the time of the version.
+//
+// Blocks written with SchemaManifest have the tags bi, bs, bsha256 and sha256,
+// and the same fields as with SchemaSeries except enc, plus fsz, the size of the file.
+// The size is a field rather than a tag, and is not named sz so that it does not collide with the tag of
+// blocks written with SchemaSeries. As sha256 already determines the size, this does not reduce the number of series:
+// there is still one per block, as with SchemaSeries.
+const manifestMeasurement = "blob_manifests"
+
+// blockKey returns the measurement and tags of the series that bm is written to, escaped for line protocol.
+// SchemaManifest only drops the sz tag of SchemaSeries, so both write a series per block;
+// SchemaCompact writes one per version.
+func (v *InfluxVolume) blockKey(bm *BlockMeta) string {
+	fm := bm.FileMeta
+	switch v.schema {
+	case SchemaManifest:
+		return fmt.Sprintf("%s,bi=%d,bs=%d,bsha256=%x,sha256=%x", escapeMeasurement(fm.Path), bm.Index, fm.BlockSize, bm.SHA256[:], fm.SHA256[:])
+	case SchemaCompact:
+		return fmt.Sprintf("%s,bs=%d,sha256=%x,%s=%d", escapeMeasurement(fm.Path), fm.BlockSize, fm.SHA256[:], compactTag, SchemaCompact)
+	}
+	return fmt.Sprintf("%s,bi=%d,bs=%d,bsha256=%x,sha256=%x,sz=%d", escapeMeasurement(fm.Path), bm.Index, fm.BlockSize, bm.SHA256[:], fm.SHA256[:], fm.Size)
+}
+
+// blockFields returns the fields, after b, that the schema adds to bm.
+func (v *InfluxVolume) blockFields(bm *BlockMeta) string {
+	switch v.schema {
+	case SchemaManifest:
+		return fmt.Sprintf(",fsz=%di", bm.FileMeta.Size)
+	case SchemaCompact:
+		return fmt.Sprintf(",fsz=%di,h=\"%x\"", bm.FileMeta.Size, bm.SHA256[:])
+	}
+	return ""
+}
+
+// commitManifest writes the manifest point of fm's version, with a hash of the checksums of the blocks stored for it.
+// It fails without writing anything if any block of the version is missing.
+func (v *InfluxVolume) commitManifest(fm *FileMeta) error {
+	n := fm.NumBlocks()
+	sums := make([]string, n)
+	record := func(bi int, sum string) error {
+		if bi < 0 || bi >= n {
+			return fmt.Errorf("%s: unexpected block index %d", fm.Path, bi)
+		}
+		if sums[bi] != "" && sums[bi] != sum {
+			return fmt.Errorf("%s: more than one block stored at index %d", fm.Path, bi)
+		}
+		sums[bi] = sum
+		return nil
+	}
+
+	compact := false
+	where := fmt.Sprintf("bs = '%d' AND sha256 = '%x'", fm.BlockSize, fm.SHA256[:])
+	q := fmt.Sprintf("SELECT last(b) FROM %q WHERE %s GROUP BY bi, bsha256, %s", fm.Path, where, compactTag)
+	if err := v.client.Query(q, v.queryOpts(), func(h *influxclient.SeriesHeader, _ []json.RawMessage) error {
+		if layoutOfTags(h.Tags) == SchemaCompact {
+			compact = true
+			return nil
+		}
+		bi, err := strconv.Atoi(h.Tags["bi"])
+		if err != nil {
+			return fmt.Errorf("%s: unexpected block index %q", fm.Path, h.Tags["bi"])
+		}
+		return record(bi, h.Tags["bsha256"])
+	}); err != nil {
+		return err
+	}
+	if compact {
+		if err := v.compactBlocks(fm.Path, where, func(_ map[string]string, bi int, _ int64, sum string, _ int) error {
+			return record(bi, sum)
+		}); err != nil {
+			return err
+		}
+	}
+
+	list := sha256.New()
+	for i, s := range sums {
+		if s == "" {
+			return fmt.Errorf("cannot commit %s: block %d: %w", fm.Path, i, ErrBlockMissing)
+		}
+		list.Write([]byte(s))
+	}
+
+	attrs, err := attrsField(fm)
+	if err != nil {
+		return err
+	}
+	if err := v.sendWrite([]byte(fmt.Sprintf("%s,bs=%d,path=%s,sha256=%x blocks=\"%x\",enc=\"%s\",nb=%di,sz=%di,v=%di%s %d\n",
+		manifestMeasurement, fm.BlockSize, escapeTag(fm.Path), fm.SHA256[:], list.Sum(nil), v.encoding.Name(), n, fm.Size, v.schema, attrs, fm.Time,
+	))); err != nil {
+		return err
+	}
+	v.recordEncoding(manifestKeyOf(fm), v.encoding.Name())
+	return nil
+}
+
+// blockEncoding returns the encoding of a block of path read from src.
+//
+// Blocks written with SchemaSeries record their encoding, unless they were written before encodings were,
+// in which case they are Z85. Blocks written with later schemas take the encoding from their version's manifest,
+// or if the version is not committed yet, are assumed to have been written with the volume's own encoding.
+func (v *InfluxVolume) blockEncoding(path string, src influxclient.BlockSource) (Encoding, error) {
+	if src.Encoding != "" || src.Size != "" {
+		return EncodingByName(src.Encoding)
+	}
+
+	mk := manifestKey{Path: path, BlockSize: src.BlockSize, SHA256: src.FileSHA256}
+	v.encMu.Lock()
+	name, ok := v.encs[mk]
+	v.encMu.Unlock()
+	if !ok {
+		var found bool
+		q := fmt.Sprintf("SELECT last(enc) FROM %q WHERE path = %s AND bs = %s AND sha256 = %s", manifestMeasurement,
+			influxclient.QuoteString(path), influxclient.QuoteString(src.BlockSize), influxclient.QuoteString(src.FileSHA256))
+		if err := v.client.Query(q, v.queryOpts(), func(_ *influxclient.SeriesHeader, row []json.RawMessage) error {
+			if len(row) < 2 {
+				return fmt.Errorf("short row in response to: %s", q)
+			}
+			found = true
+			return json.Unmarshal(row[1], &name)
+		}); err != nil {
+			return nil, err
+		}
+		if !found {
+			return v.encoding, nil
+		}
+		v.recordEncoding(mk, name)
+	}
+	return EncodingByName(name)
+}
+
+// recordEncoding remembers the encoding named in the manifest of the version identified by mk.
+func (v *InfluxVolume) recordEncoding(mk manifestKey, name string) {
+	v.encMu.Lock()
+	defer v.encMu.Unlock()
+
+	if v.encs == nil {
+		v.encs = make(map[manifestKey]string)
+	}
+	v.encs[mk] = name
+}
+
+// attrsField returns the attrs field holding fm.Attrs, with a leading comma, or nothing if none are set.
+func attrsField(fm *FileMeta) (string, error) {
+	if fm.Attrs.IsZero() {
+		return "", nil
+	}
+	buf, err := json.Marshal(fm.Attrs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(",attrs=\"%s\"", escapeField(string(buf))), nil
+}
+
+// manifests returns the versions of the file at path that have a manifest, oldest first.
+func (v *InfluxVolume) manifests(path string) ([]*FileMeta, error) {
+	qopts := v.queryOpts()
+	qopts.Epoch = "s"
+
+	byKey := make(map[fileKey]*FileMeta)
+	var fms []*FileMeta
+	q := fmt.Sprintf("SELECT sz, attrs, v, enc FROM %q WHERE path = %s GROUP BY bs, sha256", manifestMeasurement, influxclient.QuoteString(path))
+	if err := v.client.Query(q, qopts, func(h *influxclient.SeriesHeader, row []json.RawMessage) error {
+		if len(row) < 5 {
+			return fmt.Errorf("short row in response to: %s", q)
+		}
+		var sz int
+		if err := json.Unmarshal(row[1], &sz); err != nil {
+			return err
+		}
+		fk := fileKeyOfTags(path, map[string]string{"bs": h.Tags["bs"], "sha256": h.Tags["sha256"], "sz": strconv.Itoa(sz)})
+
+		// Rows are ordered by time, so a version committed more than once ends up with its latest manifest.
+		fm := byKey[fk]
+		if fm == nil {
+			var err error
+			if fm, err = fileMetaFromFileKey(fk); err != nil {
+				return err
+			}
+			fm.Committed = true
+			byKey[fk] = fm
+			fms = append(fms, fm)
+		}
+		if err := json.Unmarshal(row[0], &fm.Time); err != nil {
+			return err
+		}
+		var schema *Schema
+		if err := json.Unmarshal(row[3], &schema); err != nil {
+			return err
+		}
+		fm.Schema = SchemaManifest
+		if schema != nil {
+			fm.Schema = *schema
+		}
+		var enc *string
+		if err := json.Unmarshal(row[4], &enc); err != nil {
+			return err
+		}
+		if enc != nil {
+			v.recordEncoding(manifestKeyOf(fm), *enc)
+		}
+		return unmarshalAttrs(path, row[2], &fm.Attrs)
+	}); err != nil {
+		return nil, err
+	}
+
+	sortFileMetas(fms)
+	return fms, nil
+}
+
+// unmarshalAttrs sets attrs from col, a column holding the JSON of the attrs field, or null if it was not set.
+func unmarshalAttrs(path string, col json.RawMessage, attrs *Attrs) error {
+	var s *string
+	if err := json.Unmarshal(col, &s); err != nil {
+		return err
+	}
+	if s == nil {
+		*attrs = Attrs{}
+		return nil
+	}
+	if err := json.Unmarshal([]byte(*s), attrs); err != nil {
+		return fmt.Errorf("attrs of %s: %v", path, err)
+	}
+	return nil
+}
+
+// fileKeyOf returns the fileKey of fm's version.
+func fileKeyOf(fm *FileMeta) fileKey {
+	return fileKeyOfTags(fm.Path, map[string]string{
+		"bs":     strconv.Itoa(fm.BlockSize),
+		"sha256": fmt.Sprintf("%x", fm.SHA256[:]),
+		"sz":     strconv.Itoa(fm.Size),
+	})
+}
+
+// manifestKey identifies a version by the path, bs and sha256 tags of its manifest.
+type manifestKey struct {
+	Path, BlockSize, SHA256 string
+}
+
+// manifestKeyOf returns the manifestKey of fm's version.
+func manifestKeyOf(fm *FileMeta) manifestKey {
+	return manifestKey{Path: fm.Path, BlockSize: strconv.Itoa(fm.BlockSize), SHA256: fmt.Sprintf("%x", fm.SHA256[:])}
+}
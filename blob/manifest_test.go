@@ -0,0 +1,262 @@
+package blob_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+// roundTrip uploads src as fm through v, then downloads the latest version at fm.Path and checks it matches.
+func roundTrip(t testing.TB, e *engine.Engine, v *blob.InfluxVolume, src []byte, fm *blob.FileMeta) {
+	t.Helper()
+
+	up := e.UploadFile(bytes.NewReader(src), fm, blob.NewBatchUploader(v, blob.BatchOptions{MaxPoints: 8}))
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+
+	bms, err := v.ListBlocks(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	out := new(memFile)
+	down, err := e.DownloadFile(out, blob.LatestBlocks(bms), v)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if err := down.Err(); err != nil {
+		t.Fatalf("exp no download err, got %s", err)
+	}
+	if !bytes.Equal(out.buf, src) {
+		t.Fatalf("downloaded content did not match")
+	}
+}
+
+func TestInfluxVolume_SchemaManifest(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	e := engine.NewEngine(8, 4)
+	v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: blob.SchemaManifest})
+
+	src, fm := randomFile(t, "/my/file", 10*1024+3, 1024, 1500000000)
+	fm.Attrs.Labels = map[string]string{"k": "v"}
+	roundTrip(t, e, v, src, fm)
+
+	for _, p := range s.Points("blob", "/my/file") {
+		if _, ok := p.Tags["sz"]; ok || p.Fields["fsz"] != int64(fm.Size) {
+			t.Fatalf("exp file size as a field, got tags %v and fields %v", p.Tags, p.Fields)
+		}
+	}
+	manifests := s.Points("blob", "blob_manifests")
+	if len(manifests) != 1 || manifests[0].Fields["nb"] != int64(fm.NumBlocks()) || manifests[0].Tags["path"] != fm.Path {
+		t.Fatalf("exp one manifest, got %+v", manifests)
+	}
+
+	_, before := s.Requests()
+	names, err := v.ListFiles("/my", blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(names) != 1 || names[0] != fm.Path {
+		t.Fatalf("exp [%s], got %v", fm.Path, names)
+	}
+	fms, err := v.Stat(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 1 || !fms[0].Committed || fms[0].Time != fm.Time || fms[0].Size != fm.Size || fms[0].Attrs.Labels["k"] != "v" {
+		t.Fatalf("exp stat to match uploaded file, got %+v", fms)
+	}
+	// Listing and stat each read the manifests and commits, but no blocks.
+	if _, after := s.Requests(); after-before != 4 {
+		t.Fatalf("exp two queries each to list and stat, got %d", after-before)
+	}
+
+	// Start a second version without committing it.
+	src2, fm2 := randomFile(t, fm.Path, 4*1024, 1024, 1500000100)
+	for i := 0; i < fm2.NumBlocks()-1; i++ {
+		bm := fm2.NewBlockMeta(i)
+		data := src2[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()]
+		if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+		if err := v.UploadBlock(data, bm); err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+	}
+	if fms, err := v.Stat(fm.Path, blob.ListOptions{}); err != nil || len(fms) != 1 {
+		t.Fatalf("exp uncommitted version to be hidden, got %v (%v)", fms, err)
+	}
+	fms, err = v.Stat(fm.Path, blob.ListOptions{IncludeUncommitted: true})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 2 || fms[1].Committed || fms[1].Size != fm2.Size || fms[1].Time != fm2.Time {
+		t.Fatalf("exp committed and uncommitted versions, got %+v", fms)
+	}
+	if err := v.Commit(fm2); !errors.Is(err, blob.ErrBlockMissing) {
+		t.Fatalf("exp ErrBlockMissing committing incomplete version, got %v", err)
+	}
+
+	// A volume writing the older schema still reads the file.
+	old := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: blob.SchemaSeries})
+	if fms, err := old.Stat(fm.Path, blob.ListOptions{}); err != nil || len(fms) != 1 || fms[0].Schema != blob.SchemaManifest {
+		t.Fatalf("exp one version of schema 2, got %v (%v)", fms, err)
+	}
+
+	if err := v.Delete(fm); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if _, err := v.Stat(fm.Path, blob.ListOptions{}); err != blob.ErrNotExist {
+		t.Fatalf("exp ErrNotExist after delete, got %v", err)
+	}
+}
+
+func TestInfluxVolume_Migrate(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	e := engine.NewEngine(8, 4)
+	old := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: blob.SchemaSeries})
+	v := blob.NewInfluxVolume(s.URL, "blob", "")
+
+	// Two versions in the old schema, the second linking its unchanged blocks to the first.
+	src, fm := randomFile(t, "/old/file", 6*1024+1, 1024, 1500000000)
+	fm.Attrs.Owner = "someone"
+	roundTrip(t, e, old, src, fm)
+
+	src2 := append([]byte(nil), src...)
+	src2[0] ^= 0xff
+	fm2, err := blob.NewFileMeta(bytes.NewReader(src2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm2.Path, fm2.BlockSize, fm2.Time = fm.Path, 1024, 1500000100
+	bms, err := old.ListBlocks(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bm := range bms {
+		nbm := fm2.NewBlockMeta(bm.Index)
+		if bm.Index == 0 {
+			if err := nbm.SetSHA256(bytes.NewReader(src2[:1024])); err != nil {
+				t.Fatal(err)
+			}
+			if err := old.UploadBlock(src2[:1024], nbm); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		nbm.SHA256 = bm.SHA256
+		if err := old.LinkBlock(nbm, bm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := old.Commit(fm2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new schema reads the old versions before they are migrated.
+	fms, err := v.Stat(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 2 || fms[0].Schema != blob.SchemaSeries || fms[0].Attrs.Owner != "someone" {
+		t.Fatalf("exp two old versions, got %+v", fms)
+	}
+
+	seriesBefore := s.SeriesN("blob")
+	migrated, err := v.Migrate(fm.Path)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(migrated) != 2 {
+		t.Fatalf("exp two versions migrated, got %+v", migrated)
+	}
+	if migrated, err := v.Migrate(fm.Path); err != nil || len(migrated) != 0 {
+		t.Fatalf("exp nothing left to migrate, got %v (%v)", migrated, err)
+	}
+	if after := s.SeriesN("blob"); after > seriesBefore {
+		t.Fatalf("exp old series to be dropped, got %d series before and %d after", seriesBefore, after)
+	}
+	if commits := s.Points("blob", "blob_commits"); len(commits) != 0 {
+		t.Fatalf("exp old commits to be dropped, got %+v", commits)
+	}
+	for _, p := range s.Points("blob", fm.Path) {
+		if _, ok := p.Tags["sz"]; ok {
+			t.Fatalf("exp no blocks left in the old schema, got %+v", p)
+		}
+	}
+
+	fms, err = v.Stat(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 2 || fms[0].Schema != blob.SchemaManifest || fms[0].Time != fm.Time || fms[0].Attrs.Owner != "someone" {
+		t.Fatalf("exp migrated versions to match, got %+v", fms)
+	}
+
+	bms, err = v.ListBlocks(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	for i, exp := range [][]byte{src, src2} {
+		out := new(memFile)
+		down, err := e.DownloadFile(out, blob.BlocksOf(blob.FileMetas(bms)[i], bms), v)
+		if err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+		down.Wait()
+		if err := down.Err(); err != nil {
+			t.Fatalf("exp no download err, got %s", err)
+		}
+		if !bytes.Equal(out.buf, exp) {
+			t.Fatalf("version %d did not match after migrating", i)
+		}
+	}
+}
+
+func TestInfluxVolume_VersionTimes(t *testing.T) {
+	for _, schema := range []blob.Schema{blob.SchemaSeries, blob.SchemaManifest, blob.SchemaCompact} {
+		s := influxtest.NewServer()
+
+		e := engine.NewEngine(8, 4)
+		v := blob.NewInfluxVolumeWithOptions(s.URL, "blob", "", blob.InfluxVolumeOptions{Schema: schema})
+
+		// The first version is committed, and the second only uploaded.
+		src, fm := randomFile(t, "/my/file", 3*1024, 1024, 1500000000)
+		roundTrip(t, e, v, src, fm)
+		src2, fm2 := randomFile(t, fm.Path, 2*1024, 1024, 1500000100)
+		for i := 0; i < fm2.NumBlocks(); i++ {
+			bm := fm2.NewBlockMeta(i)
+			data := src2[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()]
+			if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.UploadBlock(data, bm); err != nil {
+				t.Fatalf("%s: exp no err, got %s", schema, err)
+			}
+		}
+
+		fms, err := v.Stat(fm.Path, blob.ListOptions{})
+		if err != nil || len(fms) != 1 || fms[0].Time != fm.Time {
+			t.Fatalf("%s: exp committed version at %d, got %+v (%v)", schema, fm.Time, fms, err)
+		}
+		bms, err := v.ListBlocks(fm.Path, blob.ListOptions{IncludeUncommitted: true})
+		if err != nil {
+			t.Fatalf("%s: exp no err, got %s", schema, err)
+		}
+		fms = blob.FileMetas(bms)
+		if len(fms) != 2 || fms[0].Time != fm.Time || fms[1].Time != fm2.Time || fms[1].Committed {
+			t.Fatalf("%s: exp versions at %d and %d, got %+v", schema, fm.Time, fm2.Time, fms)
+		}
+		s.Close()
+	}
+}
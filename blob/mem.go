@@ -0,0 +1,240 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemVolume is a Volume that keeps every block in memory.
+// It follows the same semantics as InfluxVolume, including multiple versions per path,
+// which makes it suitable for tests and dry runs.
+type MemVolume struct {
+	mu    sync.RWMutex
+	files map[string]map[memVersionKey]*memVersion
+}
+
+var _ Volume = (*MemVolume)(nil)
+
+// memVersionKey identifies a version of a file, like the file-level tags of an InfluxVolume series.
+type memVersionKey struct {
+	SHA256    [sha256.Size]byte
+	BlockSize int
+	Size      int
+}
+
+type memVersion struct {
+	// Time of the most recently uploaded block.
+	time      int64
+	blocks    map[memBlockKey][]byte
+	committed bool
+	attrs     Attrs
+}
+
+// memBlockKey identifies a block, like the block-level tags of an InfluxVolume series.
+type memBlockKey struct {
+	Index  int
+	SHA256 [sha256.Size]byte
+}
+
+func NewMemVolume() *MemVolume {
+	return &MemVolume{
+		files: make(map[string]map[memVersionKey]*memVersion),
+	}
+}
+
+func versionKeyOf(fm *FileMeta) memVersionKey {
+	return memVersionKey{SHA256: fm.SHA256, BlockSize: fm.BlockSize, Size: fm.Size}
+}
+
+// UploadBlock stores a copy of data.
+func (v *MemVolume) UploadBlock(data []byte, bm *BlockMeta) error {
+	if len(data) != bm.expSize {
+		return fmt.Errorf("block %d: exp %d bytes, got %d", bm.Index, bm.expSize, len(data))
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.putLocked(bm, append([]byte(nil), data...))
+	return nil
+}
+
+// LinkBlock stores bm with the same data as src, an identical block of another version.
+// Stored data is never modified, so the two blocks share it.
+func (v *MemVolume) LinkBlock(bm, src *BlockMeta) error {
+	if src.SHA256 != bm.SHA256 {
+		return fmt.Errorf("block %d: cannot link to block %d with different checksum", bm.Index, src.Index)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	data, ok := v.block(src)
+	if !ok {
+		return fmt.Errorf("block %d of %s: %w", src.Index, src.Path, ErrBlockMissing)
+	}
+	v.putLocked(bm, data)
+	return nil
+}
+
+// putLocked stores data as bm, creating its version if necessary. v.mu must be held.
+func (v *MemVolume) putLocked(bm *BlockMeta, data []byte) {
+	ver := v.versionLocked(bm.FileMeta)
+	ver.blocks[memBlockKey{Index: bm.Index, SHA256: bm.SHA256}] = data
+}
+
+// versionLocked returns the version of fm, creating it if necessary,
+// and keeps its time up to date with fm. v.mu must be held.
+func (v *MemVolume) versionLocked(fm *FileMeta) *memVersion {
+	versions := v.files[fm.Path]
+	if versions == nil {
+		versions = make(map[memVersionKey]*memVersion)
+		v.files[fm.Path] = versions
+	}
+	vk := versionKeyOf(fm)
+	ver := versions[vk]
+	if ver == nil {
+		ver = &memVersion{blocks: make(map[memBlockKey][]byte)}
+		versions[vk] = ver
+	}
+
+	if fm.Time > ver.time {
+		ver.time = fm.Time
+	}
+	return ver
+}
+
+// Commit marks the version of fm as committed.
+func (v *MemVolume) Commit(fm *FileMeta) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	ver := v.versionLocked(fm)
+	ver.committed = true
+	ver.attrs = fm.Attrs
+	return nil
+}
+
+// DownloadBlock returns a copy of the block's data.
+func (v *MemVolume) DownloadBlock(bm *BlockMeta) ([]byte, error) {
+	v.mu.RLock()
+	data, ok := v.block(bm)
+	v.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("block %d of %s: %w", bm.Index, bm.Path, ErrBlockMissing)
+	}
+
+	if err := bm.CompareSHA256Against(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// DownloadBlocks calls fn with a copy of each block in bms that is present in the volume.
+func (v *MemVolume) DownloadBlocks(bms []*BlockMeta, fn func(bm *BlockMeta, data []byte) error) error {
+	for _, bm := range bms {
+		v.mu.RLock()
+		data, ok := v.block(bm)
+		v.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := fn(bm, append([]byte(nil), data...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// block returns the stored data for bm. v.mu must be held.
+func (v *MemVolume) block(bm *BlockMeta) ([]byte, bool) {
+	ver := v.files[bm.Path][versionKeyOf(bm.FileMeta)]
+	if ver == nil {
+		return nil, false
+	}
+	data, ok := ver.blocks[memBlockKey{Index: bm.Index, SHA256: bm.SHA256}]
+	return data, ok
+}
+
+// ListFiles returns the sorted paths beginning with pattern.
+func (v *MemVolume) ListFiles(pattern string, opts ListOptions) ([]string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	names := []string{}
+	for path, versions := range v.files {
+		if !strings.HasPrefix(path, pattern) {
+			continue
+		}
+		for _, ver := range versions {
+			if len(ver.blocks) > 0 && (ver.committed || opts.IncludeUncommitted) {
+				names = append(names, path)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListBlocks returns new BlockMeta for every stored block at path,
+// ordered by version time and then block index.
+func (v *MemVolume) ListBlocks(path string, opts ListOptions) ([]*BlockMeta, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var bms []*BlockMeta
+	for vk, ver := range v.files[path] {
+		if !ver.committed && !opts.IncludeUncommitted {
+			continue
+		}
+		fm := &FileMeta{
+			Path:      path,
+			SHA256:    vk.SHA256,
+			BlockSize: vk.BlockSize,
+			Size:      vk.Size,
+			Time:      ver.time,
+			Committed: ver.committed,
+			Attrs:     ver.attrs,
+		}
+		for bk := range ver.blocks {
+			bm := fm.NewBlockMeta(bk.Index)
+			bm.SHA256 = bk.SHA256
+			bms = append(bms, bm)
+		}
+	}
+
+	if len(bms) == 0 {
+		return nil, ErrNotExist
+	}
+
+	sortBlocks(bms)
+	return bms, nil
+}
+
+// Stat returns the FileMeta of the versions of the file at path, oldest first.
+func (v *MemVolume) Stat(path string, opts ListOptions) ([]*FileMeta, error) {
+	bms, err := v.ListBlocks(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return FileMetas(bms), nil
+}
+
+// Delete removes the version of the file described by fm.
+// Deleting a version that does not exist is not an error.
+func (v *MemVolume) Delete(fm *FileMeta) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	versions := v.files[fm.Path]
+	delete(versions, versionKeyOf(fm))
+	if len(versions) == 0 {
+		delete(v.files, fm.Path)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package blob_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+)
+
+// putFile uploads content to v as a new version of path, one block at a time.
+func putFile(t *testing.T, v blob.Volume, path, content string, blockSize int, time int64) *blob.FileMeta {
+	t.Helper()
+
+	fm, err := blob.NewFileMeta(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm.Path = path
+	fm.BlockSize = blockSize
+	fm.Time = time
+
+	for i := 0; i < fm.NumBlocks(); i++ {
+		bm := fm.NewBlockMeta(i)
+		data := []byte(content[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()])
+		if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+			t.Fatalf("exp no err, got %s", err)
+		}
+		if err := v.UploadBlock(data, bm); err != nil {
+			t.Fatalf("exp no err uploading block %d, got %s", i, err)
+		}
+	}
+	if err := v.Commit(fm); err != nil {
+		t.Fatalf("exp no err committing, got %s", err)
+	}
+	return fm
+}
+
+func TestMemVolume(t *testing.T) {
+	v := blob.NewMemVolume()
+
+	putFile(t, v, "/a/one", "hello world", 4, 100)
+	putFile(t, v, "/a/one", "goodbye world", 4, 200)
+	putFile(t, v, "/b/two", "xyz", 4, 100)
+
+	names, err := v.ListFiles("/a", blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(names) != 1 || names[0] != "/a/one" {
+		t.Fatalf("exp [/a/one], got %v", names)
+	}
+
+	fms, err := v.Stat("/a/one", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 2 || fms[0].Time != 100 || fms[1].Time != 200 {
+		t.Fatalf("exp two versions oldest first, got %v", fms)
+	}
+
+	bms, err := v.ListBlocks("/a/one", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	var got []byte
+	for _, bm := range blob.LatestBlocks(bms) {
+		data, err := v.DownloadBlock(bm)
+		if err != nil {
+			t.Fatalf("exp no err downloading block %d, got %s", bm.Index, err)
+		}
+		got = append(got, data...)
+	}
+	if string(got) != "goodbye world" {
+		t.Fatalf("exp latest version content, got %q", got)
+	}
+
+	// Tampering with a downloaded copy must not affect the stored block.
+	bm := blob.LatestBlocks(bms)[0]
+	data, _ := v.DownloadBlock(bm)
+	data[0] = 'X'
+	if _, err := v.DownloadBlock(bm); err != nil {
+		t.Fatalf("exp stored block to be unaffected, got %s", err)
+	}
+
+	if err := v.Delete(fms[1]); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if fms, err := v.Stat("/a/one", blob.ListOptions{}); err != nil || len(fms) != 1 || fms[0].Time != 100 {
+		t.Fatalf("exp only the older version to remain, got %v (%v)", fms, err)
+	}
+	if err := v.Delete(fms[0]); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if _, err := v.Stat("/a/one", blob.ListOptions{}); err != blob.ErrNotExist {
+		t.Fatalf("exp ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package blob
+
+import "fmt"
+
+const (
+	defaultTargetBlocks = 1024
+	defaultMinBlockSize = 1024
+	// InfluxDB has no limit on a line of its own, only on the request body, max-body-size, which defaults to 25 MB.
+	// Blocks longer than a field can hold are split across several fields.
+	defaultMaxLineSize = 25000000
+
+	// Upper bound on the bytes of a block's line protocol that are not encoded data:
+	// the tags, the reserved field, quoting and the timestamp. Does not include the path.
+	blockLineOverhead = 256
+)
+
+// PlanOptions are the inputs to choosing a block size.
+// Zero values are replaced with defaults.
+type PlanOptions struct {
+	// TargetBlocks is the number of blocks the file should ideally be split into.
+	TargetBlocks int
+
+	// MinBlockSize is the smallest block size to use, however small the file.
+	MinBlockSize int
+
+	// MaxLineSize is the largest single line of line protocol the server accepts,
+	// which is the limit on the size of a write request's body unless a proxy imposes a smaller one.
+	// The block size is limited so that a block's encoded line fits within it.
+	MaxLineSize int
+
+	// MaxFieldSize is the largest string field the server accepts, as in InfluxVolumeOptions.
+	// Blocks whose encoding is longer are split across fields, whose names count against MaxLineSize.
+	MaxFieldSize int
+
+	// Encoding is the encoding the blocks will be stored with. Nil means Z85.
+	Encoding Encoding
+}
+
+// PlanBlockSize sets fm.BlockSize based on fm.Size and the limits in opts.
+// The chosen size is a power of two, so that it is always a whole number of Z85 frames.
+//
+// fm.Path must already be set, as it counts against opts.MaxLineSize.
+func (fm *FileMeta) PlanBlockSize(opts PlanOptions) error {
+	if opts.TargetBlocks <= 0 {
+		opts.TargetBlocks = defaultTargetBlocks
+	}
+	if opts.MinBlockSize <= 0 {
+		opts.MinBlockSize = defaultMinBlockSize
+	}
+	if opts.MaxLineSize <= 0 {
+		opts.MaxLineSize = defaultMaxLineSize
+	}
+	if opts.MaxFieldSize <= 0 {
+		opts.MaxFieldSize = defaultMaxFieldSize
+	}
+
+	if opts.Encoding == nil {
+		opts.Encoding = Z85
+	}
+
+	// Largest power of two whose encoded line still fits on the server.
+	maxData := opts.MaxLineSize - blockLineOverhead - len(fm.Path)
+	maxBS := 4
+	for blockDataLen(opts.Encoding, opts.MaxFieldSize, maxBS*2) <= maxData {
+		maxBS *= 2
+	}
+	if blockDataLen(opts.Encoding, opts.MaxFieldSize, maxBS) > maxData {
+		return fmt.Errorf("max line size %d is too small to hold any block of %s", opts.MaxLineSize, fm.Path)
+	}
+
+	bs := 4
+	for bs < opts.MinBlockSize || bs*opts.TargetBlocks < fm.Size {
+		bs *= 2
+	}
+	if bs > maxBS {
+		bs = maxBS
+	}
+
+	fm.BlockSize = bs
+	return nil
+}
+
+// blockDataLen returns the largest number of bytes that the data of a block of n bytes takes in its line,
+// once encoded with e and escaped, including the names of the extra fields it is split across
+// if its encoding is longer than maxField.
+func blockDataLen(e Encoding, maxField, n int) int {
+	size := escapedLen(e, n)
+	if l := e.EncodedLen(n); l > maxField {
+		parts := (l + maxField - 1) / maxField
+		size += parts*len(fmt.Sprintf(`",z%d="`, parts)) + len(fmt.Sprintf(`,zn=%di`, parts))
+	}
+	return size
+}
@@ -0,0 +1,96 @@
+package blob_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+	"github.com/mark-rushakoff/influx-blob/internal/influxclient"
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+func TestFileMeta_PlanBlockSize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+		opts blob.PlanOptions
+		exp  int
+	}{
+		{name: "small file uses min", size: 10, exp: 1024},
+		{name: "grows to target blocks", size: 1024 * 4096, exp: 4096},
+		{name: "rounds up to power of two", size: 1024*4096 + 1, exp: 8192},
+		{name: "capped by request body size", size: 1 << 40, exp: 16 << 20},
+		{name: "capped by line size", size: 1 << 30, opts: blob.PlanOptions{MaxLineSize: 64 * 1024}, exp: 32 * 1024},
+		{name: "split fields count against the line", size: 1 << 30, opts: blob.PlanOptions{MaxLineSize: 64 * 1024, MaxFieldSize: 8}, exp: 16 * 1024},
+		{name: "custom limits", size: 1 << 20, opts: blob.PlanOptions{TargetBlocks: 16, MaxLineSize: 1 << 20}, exp: 64 * 1024},
+		{name: "base64 needs no escaping", size: 1 << 30, opts: blob.PlanOptions{Encoding: blob.Base64, MaxLineSize: 64 * 1024}, exp: 32 * 1024},
+		{name: "ascii85 leaves room for escaping", size: 1 << 30, opts: blob.PlanOptions{Encoding: blob.Ascii85, MaxLineSize: 64 * 1024}, exp: 16 * 1024},
+	} {
+		fm := &blob.FileMeta{Path: "/my/file", Size: tc.size}
+		if err := fm.PlanBlockSize(tc.opts); err != nil {
+			t.Fatalf("%s: exp no err, got %s", tc.name, err)
+		}
+		if fm.BlockSize != tc.exp {
+			t.Fatalf("%s: exp block size %d, got %d", tc.name, tc.exp, fm.BlockSize)
+		}
+	}
+
+	fm := &blob.FileMeta{Path: "/my/file", Size: 10}
+	if err := fm.PlanBlockSize(blob.PlanOptions{MaxLineSize: 100}); err == nil {
+		t.Fatalf("exp err for impossibly small line size")
+	}
+}
+
+func TestFileMeta_PlanBlockSize_SplitFields(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	// Record the longest line written, on the way to the fake server.
+	var mu sync.Mutex
+	var longest int
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			if len(line) > longest {
+				longest = len(line)
+			}
+		}
+		mu.Unlock()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		s.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	const maxLine = 16 * 1024
+	for _, enc := range blob.Encodings {
+		v := blob.NewInfluxVolumeWithOptions(proxy.URL, "blob", "", blob.InfluxVolumeOptions{
+			Encoding:     enc,
+			MaxFieldSize: 10,
+			Client:       influxclient.ClientOptions{DisableGzip: true},
+		})
+		src, fm := randomFile(t, "/plan/"+enc.Name(), 64*1024, 0, 1500000000)
+		// A single target block makes the line size the only limit.
+		if err := fm.PlanBlockSize(blob.PlanOptions{TargetBlocks: 1, MaxLineSize: maxLine, Encoding: v.Encoding(), MaxFieldSize: v.MaxFieldSize()}); err != nil {
+			t.Fatalf("%s: exp no err, got %s", enc.Name(), err)
+		}
+		if fm.BlockSize <= 10 {
+			t.Fatalf("%s: exp blocks split across fields, got block size %d", enc.Name(), fm.BlockSize)
+		}
+
+		mu.Lock()
+		longest = 0
+		mu.Unlock()
+		roundTrip(t, engine.NewEngine(4, 4), v, src, fm)
+		mu.Lock()
+		if longest > maxLine {
+			t.Fatalf("%s: exp lines of at most %d bytes with block size %d, got %d", enc.Name(), maxLine, fm.BlockSize, longest)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,443 @@
+package blob
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReplicatedVolume mirrors every write to several underlying volumes,
+// and reads from whichever replica is healthy.
+//
+// A replica is marked unhealthy when a request to it fails, and healthy again when one succeeds.
+// Reads try healthy replicas first, in the order they were given, then unhealthy ones.
+type ReplicatedVolume struct {
+	replicas []Volume
+	quorum   int
+
+	mu        sync.Mutex
+	unhealthy []bool
+}
+
+var _ Volume = (*ReplicatedVolume)(nil)
+
+// rangeDownloader matches the engine's BlockRangeDownloader,
+// without making blob depend on engine.
+type rangeDownloader interface {
+	DownloadBlocks(bms []*BlockMeta, fn func(bm *BlockMeta, data []byte) error) error
+}
+
+// blockLinker matches the engine's BlockLinker.
+type blockLinker interface {
+	LinkBlock(bm, src *BlockMeta) error
+}
+
+// NewReplicatedVolume returns a ReplicatedVolume over replicas.
+// An upload succeeds once quorum replicas have accepted it; a quorum of zero means all of them.
+func NewReplicatedVolume(quorum int, replicas ...Volume) *ReplicatedVolume {
+	if quorum <= 0 || quorum > len(replicas) {
+		quorum = len(replicas)
+	}
+	return &ReplicatedVolume{
+		replicas:  replicas,
+		quorum:    quorum,
+		unhealthy: make([]bool, len(replicas)),
+	}
+}
+
+// Encoding returns the least compact encoding of any replica, so that blocks planned for it fit every replica.
+// Replicas that do not encode blocks are ignored; if none do, it returns nil.
+func (v *ReplicatedVolume) Encoding() Encoding {
+	const probe = 1 << 20
+
+	var enc Encoding
+	for _, r := range v.replicas {
+		e, ok := r.(Encoder)
+		if !ok {
+			continue
+		}
+		if re := e.Encoding(); enc == nil || re.EncodedLen(probe) > enc.EncodedLen(probe) {
+			enc = re
+		}
+	}
+	return enc
+}
+
+// MaxFieldSize returns the smallest field size of any replica, so that blocks planned for it fit every replica.
+// Replicas that do not limit fields are ignored; if none do, it returns zero.
+func (v *ReplicatedVolume) MaxFieldSize() int {
+	var n int
+	for _, r := range v.replicas {
+		if l, ok := r.(FieldLimiter); ok && (n == 0 || l.MaxFieldSize() < n) {
+			n = l.MaxFieldSize()
+		}
+	}
+	return n
+}
+
+// Batched returns a ReplicatedVolume with the same quorum over each replica's batched volume,
+// for replicas that are Batchers, and over the replica itself otherwise.
+func (v *ReplicatedVolume) Batched(opts BatchOptions) Volume {
+	replicas := make([]Volume, len(v.replicas))
+	for i, r := range v.replicas {
+		if b, ok := r.(Batcher); ok {
+			r = b.Batched(opts)
+		}
+		replicas[i] = r
+	}
+	return NewReplicatedVolume(v.quorum, replicas...)
+}
+
+// Replicas returns the underlying volumes, in the order they were given.
+func (v *ReplicatedVolume) Replicas() []Volume {
+	return append([]Volume(nil), v.replicas...)
+}
+
+func (v *ReplicatedVolume) setHealth(i int, err error) {
+	v.mu.Lock()
+	v.unhealthy[i] = err != nil
+	v.mu.Unlock()
+}
+
+// ordered returns the indexes of the replicas, healthy ones first.
+func (v *ReplicatedVolume) ordered() []int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	idx := make([]int, 0, len(v.replicas))
+	for i := range v.replicas {
+		if !v.unhealthy[i] {
+			idx = append(idx, i)
+		}
+	}
+	for i := range v.replicas {
+		if v.unhealthy[i] {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// replicaErrors describes the failures of individual replicas.
+type replicaErrors map[int]error
+
+func (e replicaErrors) Error() string {
+	idx := make([]int, 0, len(e))
+	for i := range e {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+
+	msgs := make([]string, len(idx))
+	for j, i := range idx {
+		msgs[j] = fmt.Sprintf("replica %d: %v", i, e[i])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the failure of each replica, so that callers can inspect them with errors.Is and errors.As.
+func (e replicaErrors) Unwrap() []error {
+	idx := make([]int, 0, len(e))
+	for i := range e {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+
+	errs := make([]error, len(idx))
+	for j, i := range idx {
+		errs[j] = e[i]
+	}
+	return errs
+}
+
+// UploadBlock uploads to every replica concurrently,
+// and succeeds if at least the quorum of replicas succeeded.
+func (v *ReplicatedVolume) UploadBlock(data []byte, bm *BlockMeta) error {
+	return v.writeQuorum(fmt.Sprintf("block %d", bm.Index), func(r Volume) error {
+		return r.UploadBlock(data, bm)
+	})
+}
+
+// LinkBlock links bm to src on every replica concurrently, with the same quorum as UploadBlock.
+// A replica that cannot link blocks gets a copy of src's data from its own storage instead.
+func (v *ReplicatedVolume) LinkBlock(bm, src *BlockMeta) error {
+	return v.writeQuorum(fmt.Sprintf("block %d", bm.Index), func(r Volume) error {
+		if l, ok := r.(blockLinker); ok {
+			return l.LinkBlock(bm, src)
+		}
+		data, err := r.DownloadBlock(src)
+		if err != nil {
+			return err
+		}
+		return r.UploadBlock(data, bm)
+	})
+}
+
+// writeQuorum calls write on every replica concurrently,
+// and succeeds if at least the quorum of replicas succeeded.
+// what describes the write in the returned error.
+func (v *ReplicatedVolume) writeQuorum(what string, write func(r Volume) error) error {
+	errs := make([]error, len(v.replicas))
+	var wg sync.WaitGroup
+	for i, r := range v.replicas {
+		wg.Add(1)
+		go func(i int, r Volume) {
+			defer wg.Done()
+			errs[i] = write(r)
+			v.setHealth(i, errs[i])
+		}(i, r)
+	}
+	wg.Wait()
+
+	failed := make(replicaErrors)
+	for i, err := range errs {
+		if err != nil {
+			failed[i] = err
+		}
+	}
+	if ok := len(v.replicas) - len(failed); ok < v.quorum {
+		return fmt.Errorf("%s: only %d of %d replicas succeeded, need %d: %v", what, ok, len(v.replicas), v.quorum, failed)
+	}
+	return nil
+}
+
+// DownloadBlock returns the block from the first replica that has a copy matching the block's checksum.
+func (v *ReplicatedVolume) DownloadBlock(bm *BlockMeta) ([]byte, error) {
+	failed := make(replicaErrors)
+	for _, i := range v.ordered() {
+		data, err := v.replicas[i].DownloadBlock(bm)
+		if err == nil {
+			err = bm.CompareSHA256Against(bytes.NewReader(data))
+		}
+		v.setHealth(i, err)
+		if err == nil {
+			return data, nil
+		}
+		failed[i] = err
+	}
+	return nil, failed
+}
+
+// DownloadBlocks fetches the blocks in one request from the first healthy replica that supports it,
+// then fetches any block that was missing or corrupt from the remaining replicas one at a time.
+func (v *ReplicatedVolume) DownloadBlocks(bms []*BlockMeta, fn func(bm *BlockMeta, data []byte) error) error {
+	got := make(map[*BlockMeta]bool, len(bms))
+	var fnErr error
+
+	for _, i := range v.ordered() {
+		rd, ok := v.replicas[i].(rangeDownloader)
+		if !ok {
+			continue
+		}
+		err := rd.DownloadBlocks(bms, func(bm *BlockMeta, data []byte) error {
+			if got[bm] || bm.CompareSHA256Against(bytes.NewReader(data)) != nil {
+				return nil
+			}
+			got[bm] = true
+			if err := fn(bm, data); err != nil {
+				fnErr = err
+				return err
+			}
+			return nil
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		v.setHealth(i, err)
+		break
+	}
+
+	for _, bm := range bms {
+		if got[bm] {
+			continue
+		}
+		data, err := v.DownloadBlock(bm)
+		if err != nil {
+			// Reported as missing.
+			continue
+		}
+		if err := fn(bm, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListFiles lists the files of every replica that answers, merged and sorted,
+// so that a file which only reached some replicas is still listed, as Stat finds it.
+func (v *ReplicatedVolume) ListFiles(pattern string, opts ListOptions) ([]string, error) {
+	failed := make(replicaErrors)
+	answered := false
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, i := range v.ordered() {
+		rnames, err := v.replicas[i].ListFiles(pattern, opts)
+		v.setHealth(i, err)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		answered = true
+
+		for _, name := range rnames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if !answered {
+		return nil, failed
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Commit commits the version on every replica concurrently, with the same quorum as UploadBlock.
+func (v *ReplicatedVolume) Commit(fm *FileMeta) error {
+	return v.writeQuorum(fmt.Sprintf("commit of %s", fm.Path), func(r Volume) error {
+		return r.Commit(fm)
+	})
+}
+
+// ListBlocks lists the blocks of every replica that answers, merged,
+// so that a block which only reached some replicas is still listed.
+// A replica that does not have the file at all is not considered unhealthy.
+// Each version is listed once, committed if any replica committed it,
+// with the blocks of every replica, whether or not that replica committed the version too.
+func (v *ReplicatedVolume) ListBlocks(path string, opts ListOptions) ([]*BlockMeta, error) {
+	ropts := opts
+	ropts.IncludeUncommitted = true
+
+	failed := make(replicaErrors)
+	answered := false
+	files := make(map[fileKey]*FileMeta)
+	type blockKey struct {
+		fk     fileKey
+		index  int
+		sha256 [32]byte
+	}
+	seen := make(map[blockKey]bool)
+	var merged []*BlockMeta
+	for _, i := range v.ordered() {
+		bms, err := v.replicas[i].ListBlocks(path, ropts)
+		if err == ErrNotExist {
+			answered = true
+			continue
+		}
+		v.setHealth(i, err)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		answered = true
+
+		for _, fm := range FileMetas(bms) {
+			mergeFileMeta(files, fm)
+		}
+		for _, bm := range bms {
+			fk := fileKeyOf(bm.FileMeta)
+			bk := blockKey{fk: fk, index: bm.Index, sha256: bm.SHA256}
+			if seen[bk] {
+				continue
+			}
+			seen[bk] = true
+			nbm := *bm
+			nbm.FileMeta = files[fk]
+			merged = append(merged, &nbm)
+		}
+	}
+	if !answered {
+		return nil, failed
+	}
+
+	if !opts.IncludeUncommitted {
+		committed := merged[:0]
+		for _, bm := range merged {
+			if bm.Committed {
+				committed = append(committed, bm)
+			}
+		}
+		merged = committed
+	}
+	if len(merged) == 0 {
+		return nil, ErrNotExist
+	}
+	sortBlocks(merged)
+	return merged, nil
+}
+
+// Stat returns the versions of the file reported by every replica that answers, merged as by ListBlocks.
+func (v *ReplicatedVolume) Stat(path string, opts ListOptions) ([]*FileMeta, error) {
+	failed := make(replicaErrors)
+	answered := false
+	files := make(map[fileKey]*FileMeta)
+	var fms []*FileMeta
+	for _, i := range v.ordered() {
+		rfms, err := v.replicas[i].Stat(path, opts)
+		if err == ErrNotExist {
+			answered = true
+			continue
+		}
+		v.setHealth(i, err)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		answered = true
+
+		for _, fm := range rfms {
+			if files[fileKeyOf(fm)] == nil {
+				fms = append(fms, mergeFileMeta(files, fm))
+			} else {
+				mergeFileMeta(files, fm)
+			}
+		}
+	}
+	if !answered {
+		return nil, failed
+	}
+	if len(fms) == 0 {
+		return nil, ErrNotExist
+	}
+	sortFileMetas(fms)
+	return fms, nil
+}
+
+// mergeFileMeta merges fm, as reported by one replica, into the version with the same key in files,
+// adding a copy of it if there is none, and returns the merged version.
+// A committed report takes precedence, as uncommitted versions only take the time of their latest block.
+func mergeFileMeta(files map[fileKey]*FileMeta, fm *FileMeta) *FileMeta {
+	fk := fileKeyOf(fm)
+	m := files[fk]
+	if m == nil {
+		c := *fm
+		files[fk] = &c
+		return &c
+	}
+	switch {
+	case fm.Committed && !m.Committed:
+		*m = *fm
+	case fm.Committed == m.Committed && fm.Time > m.Time:
+		m.Time = fm.Time
+	}
+	return m
+}
+
+// Delete removes the version from every replica.
+func (v *ReplicatedVolume) Delete(fm *FileMeta) error {
+	failed := make(replicaErrors)
+	for i, r := range v.replicas {
+		err := r.Delete(fm)
+		v.setHealth(i, err)
+		if err != nil {
+			failed[i] = err
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package blob_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+// faultyVolume wraps a Volume, optionally failing uploads or corrupting downloads.
+type faultyVolume struct {
+	blob.Volume
+	failUploads bool
+	corrupt     bool
+}
+
+func (v *faultyVolume) UploadBlock(data []byte, bm *blob.BlockMeta) error {
+	if v.failUploads {
+		return errors.New("upload refused")
+	}
+	return v.Volume.UploadBlock(data, bm)
+}
+
+func (v *faultyVolume) DownloadBlock(bm *blob.BlockMeta) ([]byte, error) {
+	data, err := v.Volume.DownloadBlock(bm)
+	if err == nil && v.corrupt {
+		data[0] ^= 0xFF
+	}
+	return data, err
+}
+
+func TestReplicatedVolume_Quorum(t *testing.T) {
+	a, b := blob.NewMemVolume(), blob.NewMemVolume()
+	down := &faultyVolume{Volume: blob.NewMemVolume(), failUploads: true}
+
+	fm := putFile(t, blob.NewReplicatedVolume(2, a, down, b), "/f", "replicate me", 4, 100)
+	if fms, err := b.Stat("/f", blob.ListOptions{}); err != nil || len(fms) != 1 {
+		t.Fatalf("exp file on healthy replica, got %v (%v)", fms, err)
+	}
+
+	all := blob.NewReplicatedVolume(0, a, down, b)
+	if err := all.UploadBlock([]byte("repl"), fm.NewBlockMeta(0)); err == nil {
+		t.Fatalf("exp err when quorum of all replicas is not met")
+	}
+}
+
+func TestReplicatedVolume_DownloadFallback(t *testing.T) {
+	good := blob.NewMemVolume()
+	bad := &faultyVolume{Volume: blob.NewMemVolume()}
+	v := blob.NewReplicatedVolume(0, bad, good)
+
+	putFile(t, v, "/f", "hello world!", 4, 100)
+	bad.corrupt = true
+
+	var got []byte
+	for _, bm := range blob.LatestBlocks(mustListBlocks(t, v, "/f")) {
+		data, err := v.DownloadBlock(bm)
+		if err != nil {
+			t.Fatalf("exp fallback to healthy replica, got %s", err)
+		}
+		got = append(got, data...)
+	}
+	if string(got) != "hello world!" {
+		t.Fatalf("exp uncorrupted content, got %q", got)
+	}
+
+	// Ranged downloads fall back per block as well.
+	got = make([]byte, 12)
+	bms := blob.LatestBlocks(mustListBlocks(t, v, "/f"))
+	if err := v.DownloadBlocks(bms, func(bm *blob.BlockMeta, data []byte) error {
+		copy(got[bm.FileOffset():], data)
+		return nil
+	}); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if string(got) != "hello world!" {
+		t.Fatalf("exp uncorrupted content from ranged download, got %q", got)
+	}
+}
+
+func mustListBlocks(t *testing.T, v blob.Volume, path string) []*blob.BlockMeta {
+	t.Helper()
+	bms, err := v.ListBlocks(path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err listing %s, got %s", path, err)
+	}
+	return bms
+}
+
+func TestReplicatedVolume_MergesListings(t *testing.T) {
+	a, b := blob.NewMemVolume(), blob.NewMemVolume()
+	content := "split across replicas"
+	fm, err := blob.NewFileMeta(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.Path, fm.BlockSize, fm.Time = "/f", 4, 100
+
+	// With a quorum of one, each block may reach only one replica.
+	for i := 0; i < fm.NumBlocks(); i++ {
+		bm := fm.NewBlockMeta(i)
+		data := []byte(content[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()])
+		if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		r := a
+		if i%2 == 1 {
+			r = b
+		}
+		if err := r.UploadBlock(data, bm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Commit(fm); err != nil {
+		t.Fatal(err)
+	}
+
+	v := blob.NewReplicatedVolume(1, a, b)
+	bms := mustListBlocks(t, v, "/f")
+	if len(bms) != fm.NumBlocks() || len(blob.FileMetas(bms)) != 1 || !bms[0].Committed {
+		t.Fatalf("exp every block of one committed version, got %d blocks of %+v", len(bms), blob.FileMetas(bms))
+	}
+	var got []byte
+	for _, bm := range bms {
+		data, err := v.DownloadBlock(bm)
+		if err != nil {
+			t.Fatalf("exp no err downloading block %d, got %s", bm.Index, err)
+		}
+		got = append(got, data...)
+	}
+	if string(got) != content {
+		t.Fatalf("exp %q, got %q", content, got)
+	}
+
+	fms, err := v.Stat("/f", blob.ListOptions{})
+	if err != nil || len(fms) != 1 || fms[0].Time != 100 {
+		t.Fatalf("exp one committed version, got %v (%v)", fms, err)
+	}
+}
+
+func TestReplicatedVolume_ListFilesMerges(t *testing.T) {
+	a, b := blob.NewMemVolume(), blob.NewMemVolume()
+	putFile(t, a, "/d/only-a", "on one replica", 4, 100)
+	putFile(t, b, "/d/only-b", "on the other", 4, 100)
+	putFile(t, a, "/d/both", "on both", 4, 100)
+	putFile(t, b, "/d/both", "on both", 4, 100)
+
+	v := blob.NewReplicatedVolume(1, a, b)
+	names, err := v.ListFiles("/d/", blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if exp := "/d/both /d/only-a /d/only-b"; strings.Join(names, " ") != exp {
+		t.Fatalf("exp %s, got %v", exp, names)
+	}
+	for _, name := range names {
+		if _, err := v.Stat(name, blob.ListOptions{}); err != nil {
+			t.Fatalf("exp listed file %s to stat, got %s", name, err)
+		}
+	}
+}
+
+func TestReplicatedVolume_BatchedAndEncoding(t *testing.T) {
+	servers := []*influxtest.Server{influxtest.NewServer(), influxtest.NewServer()}
+	for _, s := range servers {
+		defer s.Close()
+	}
+	a := blob.NewInfluxVolumeWithOptions(servers[0].URL, "blob", "", blob.InfluxVolumeOptions{Encoding: blob.Z85})
+	b := blob.NewInfluxVolumeWithOptions(servers[1].URL, "blob", "", blob.InfluxVolumeOptions{Encoding: blob.Base64})
+	v := blob.NewReplicatedVolume(0, a, b)
+
+	// Blocks are planned for the replica whose encoding is longest.
+	if enc := v.Encoding(); enc != blob.Base64 {
+		t.Fatalf("exp base64, got %v", enc)
+	}
+
+	src, fm := randomFile(t, "/my/file", 16*1024, 1024, 1500000000)
+	e := engine.NewEngine(16, 4)
+	up := e.UploadFile(bytes.NewReader(src), fm, v.Batched(blob.BatchOptions{MaxPoints: fm.NumBlocks(), FlushInterval: time.Minute}))
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+	for i, s := range servers {
+		// Every block in one write, and the commit in another.
+		if writes, _ := s.Requests(); writes != 2 {
+			t.Fatalf("exp replica %d to get its blocks in a single batch, got %d writes", i, writes)
+		}
+	}
+
+	bms, err := v.ListBlocks(fm.Path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	out := new(memFile)
+	down, err := e.DownloadFile(out, bms, v)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if err := down.Err(); err != nil {
+		t.Fatalf("exp no download err, got %s", err)
+	}
+	if !bytes.Equal(out.buf, src) {
+		t.Fatalf("downloaded content did not match")
+	}
+}
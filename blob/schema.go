@@ -0,0 +1,479 @@
+package blob
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mark-rushakoff/influx-blob/internal/influxclient"
+)
+
+// Schema identifies the layout of the points an InfluxVolume writes.
+// Every version records the schema it was written with, and an InfluxVolume reads all of them,
+// whichever schema it writes.
+type Schema int
+
+const (
+	// SchemaSeries repeats every file-level fact as tags of each block's series,
+	// and marks committed versions with points in the commit measurement.
+	SchemaSeries Schema = 1
+
+	// SchemaManifest writes a single manifest point per committed version,
+	// so that files and versions can be listed from the manifests alone.
+	// Blocks only carry the tags that identify their version and themselves,
+	// which still makes one series per block, as many as SchemaSeries.
+	SchemaManifest Schema = 2
+
+	// SchemaCompact writes manifests as SchemaManifest does, but stores every block of a version in one series,
+	// keeping the block index in the time of its point and the block checksum in a field,
+	// so that the number of series does not grow with the number of blocks.
+	SchemaCompact Schema = 3
+
+	// DefaultSchema is the schema new versions are written with, unless InfluxVolumeOptions says otherwise.
+	DefaultSchema = SchemaManifest
+
+	// LatestSchema is the newest schema an InfluxVolume can write.
+	LatestSchema = SchemaCompact
+)
+
+func (s Schema) String() string {
+	switch s {
+	case SchemaSeries:
+		return "series"
+	case SchemaManifest:
+		return "manifest"
+	case SchemaCompact:
+		return "compact"
+	}
+	return fmt.Sprintf("Schema(%d)", int(s))
+}
+
+// layoutOfTags returns the schema a block was written with, from the tags of its series.
+func layoutOfTags(tags map[string]string) Schema {
+	if v := tags[compactTag]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return SchemaCompact
+		}
+		return Schema(n)
+	}
+	if tags["sz"] != "" {
+		return SchemaSeries
+	}
+	return SchemaManifest
+}
+
+// commits returns the versions of the file at path that have a commit point, oldest first.
+// Only SchemaSeries writes commit points.
+func (v *InfluxVolume) commits(path string) ([]*FileMeta, error) {
+	qopts := v.queryOpts()
+	qopts.Epoch = "s"
+
+	byKey := make(map[fileKey]*FileMeta)
+	var fms []*FileMeta
+	// Only one selector per query: InfluxDB reports time zero for queries with several.
+	q := fmt.Sprintf("SELECT c, attrs FROM %q WHERE path = %s GROUP BY bs, sha256, sz", commitMeasurement, influxclient.QuoteString(path))
+	if err := v.client.Query(q, qopts, func(h *influxclient.SeriesHeader, row []json.RawMessage) error {
+		if len(row) < 3 {
+			return fmt.Errorf("short row in response to: %s", q)
+		}
+		fk := fileKeyOfTags(path, h.Tags)
+
+		// Rows are ordered by time, so a version committed more than once ends up with its latest commit.
+		fm := byKey[fk]
+		if fm == nil {
+			var err error
+			if fm, err = fileMetaFromFileKey(fk); err != nil {
+				return err
+			}
+			fm.Committed = true
+			fm.Schema = SchemaSeries
+			byKey[fk] = fm
+			fms = append(fms, fm)
+		}
+		if err := json.Unmarshal(row[0], &fm.Time); err != nil {
+			return err
+		}
+		// Versions committed before attributes were stored have none.
+		return unmarshalAttrs(path, row[2], &fm.Attrs)
+	}); err != nil {
+		return nil, err
+	}
+
+	sortFileMetas(fms)
+	return fms, nil
+}
+
+// CommitLegacy commits every complete version of the files under prefix that was uploaded before commit points existed,
+// when each version was published as its blocks were uploaded, and returns the versions it committed.
+// Those versions were written with SchemaSeries and, unlike later uploads, without the enc field on their blocks.
+// Until they are committed, they are only listed with IncludeUncommitted, and are not migrated.
+func (v *InfluxVolume) CommitLegacy(prefix string) ([]*FileMeta, error) {
+	var paths []string
+	if err := v.client.ShowMeasurementsByPrefixFunc(prefix, v.database, func(name string) error {
+		if name != commitMeasurement && name != manifestMeasurement {
+			paths = append(paths, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var committed []*FileMeta
+	for _, p := range paths {
+		fms, err := v.commitLegacyPath(p)
+		committed = append(committed, fms...)
+		if err != nil {
+			return committed, err
+		}
+	}
+	return committed, nil
+}
+
+// commitLegacyPath writes commit points for the complete versions of the file at path that CommitLegacy commits,
+// each at the time of its latest block.
+func (v *InfluxVolume) commitLegacyPath(path string) ([]*FileMeta, error) {
+	bms, err := v.listBlocks(path, ListOptions{IncludeUncommitted: true})
+	if err == ErrNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	present := make(map[fileKey]int)
+	skip := make(map[fileKey]bool)
+	for fm, n := range presentBlocks(bms) {
+		present[fileKeyOf(fm)] = n
+		if fm.Committed {
+			skip[fileKeyOf(fm)] = true
+		}
+	}
+
+	// Versions with an encoding recorded on their blocks were uploaded since commits existed.
+	q := fmt.Sprintf("SELECT count(enc) FROM %q WHERE sz != '' GROUP BY bs, sha256, sz", path)
+	if err := v.client.Query(q, v.queryOpts(), func(h *influxclient.SeriesHeader, _ []json.RawMessage) error {
+		skip[fileKeyOfTags(path, h.Tags)] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	qopts := v.queryOpts()
+	qopts.Epoch = "s"
+	var legacy []*FileMeta
+	q = fmt.Sprintf("SELECT last(b) FROM %q WHERE sz != '' GROUP BY bs, sha256, sz", path)
+	if err := v.client.Query(q, qopts, func(h *influxclient.SeriesHeader, row []json.RawMessage) error {
+		if len(row) < 2 {
+			return fmt.Errorf("short row in response to: %s", q)
+		}
+		fk := fileKeyOfTags(path, h.Tags)
+		if skip[fk] {
+			return nil
+		}
+		fm, err := fileMetaFromFileKey(fk)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(row[0], &fm.Time); err != nil {
+			return err
+		}
+		// An interrupted upload stays uncommitted.
+		if present[fk] < fm.NumBlocks() {
+			return nil
+		}
+		legacy = append(legacy, fm)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for i, fm := range legacy {
+		if err := v.commitSeries(fm); err != nil {
+			return legacy[:i], err
+		}
+		fm.Committed = true
+	}
+	return legacy, nil
+}
+
+// versions returns the committed versions of the file at path, oldest first,
+// from their manifests, or from their commit points if they have no manifest.
+// No blocks are listed.
+func (v *InfluxVolume) versions(path string) ([]*FileMeta, error) {
+	fms, err := v.manifests(path)
+	if err != nil {
+		return nil, err
+	}
+	commits, err := v.commits(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A version being migrated briefly has both, and the manifest is newer.
+	seen := make(map[fileKey]bool, len(fms))
+	for _, fm := range fms {
+		seen[fileKeyOf(fm)] = true
+	}
+	for _, fm := range commits {
+		if !seen[fileKeyOf(fm)] {
+			fms = append(fms, fm)
+		}
+	}
+
+	sortFileMetas(fms)
+	return fms, nil
+}
+
+// listBlocks lists the blocks of the file at path, whichever schema each version was written with.
+// Committed versions take their time and attributes from their manifest or commit point.
+func (v *InfluxVolume) listBlocks(path string, opts ListOptions) ([]*BlockMeta, error) {
+	committed, err := v.versions(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(committed) == 0 && !opts.IncludeUncommitted {
+		return nil, ErrNotExist
+	}
+
+	files := make(map[fileKey]*FileMeta, len(committed))
+	for _, fm := range committed {
+		files[fileKeyOf(fm)] = fm
+	}
+
+	// Blocks written with SchemaSeries carry the file size as the sz tag, later schemas as the fsz field.
+	type blockKey struct {
+		fm     *FileMeta
+		index  int
+		sha256 string
+	}
+	seen := make(map[blockKey]*BlockMeta)
+	var bms []*BlockMeta
+	// add lists the block at index bi of the version with the block size and checksum in tags,
+	// written at time t with the given layout.
+	add := func(tags map[string]string, sz string, layout Schema, bi int, sum string, t int64) error {
+		fk := fileKeyOfTags(path, map[string]string{"bs": tags["bs"], "sha256": tags["sha256"], "sz": sz})
+		fm := files[fk]
+		if fm == nil {
+			if !opts.IncludeUncommitted {
+				return nil
+			}
+			var err error
+			if fm, err = fileMetaFromFileKey(fk); err != nil {
+				return err
+			}
+			fm.Schema = layout
+			files[fk] = fm
+		}
+		if !fm.Committed && t > fm.Time {
+			// Uncommitted versions take the time of their latest block.
+			fm.Time = t
+		}
+
+		// A block rewritten by an interrupted migration is stored under both schemas.
+		// Report the older, so that the migration is finished next time.
+		bk := blockKey{fm: fm, index: bi, sha256: sum}
+		if bm := seen[bk]; bm != nil {
+			if layout < bm.layout {
+				bm.layout = layout
+			}
+			return nil
+		}
+
+		bm := fm.NewBlockMeta(bi)
+		seen[bk] = bm
+		bm.layout = layout
+		if err := bm.SetSHA256String(sum); err != nil {
+			return err
+		}
+		bms = append(bms, bm)
+		return nil
+	}
+
+	qopts := v.queryOpts()
+	qopts.Epoch = "s"
+
+	// Blocks written with SchemaManifest hold the file size in the fsz field.
+	// It is read with its own query, as InfluxDB reports time zero for queries with more than one selector.
+	type seriesKey struct{ bi, bs, bsha256, sha256 string }
+	sizes := make(map[seriesKey]int)
+	q := fmt.Sprintf("SELECT last(fsz) FROM %q WHERE sz = '' AND %s = '' GROUP BY bi, bs, bsha256, sha256", path, compactTag)
+	if err := v.client.Query(q, qopts, func(h *influxclient.SeriesHeader, row []json.RawMessage) error {
+		if len(row) < 2 {
+			return fmt.Errorf("short row in response to: %s", q)
+		}
+		var fsz int
+		if err := json.Unmarshal(row[1], &fsz); err != nil {
+			return err
+		}
+		sizes[seriesKey{h.Tags["bi"], h.Tags["bs"], h.Tags["bsha256"], h.Tags["sha256"]}] = fsz
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Series written with SchemaCompact hold many blocks each, and are read with their own query if there are any.
+	compact := false
+	q = fmt.Sprintf("SELECT last(b) FROM %q GROUP BY bi, bs, bsha256, sha256, sz, %s", path, compactTag)
+	if err := v.client.Query(q, qopts, func(h *influxclient.SeriesHeader, row []json.RawMessage) error {
+		if len(row) < 2 {
+			return fmt.Errorf("short row in response to: %s", q)
+		}
+		layout := layoutOfTags(h.Tags)
+		if layout >= SchemaCompact {
+			compact = true
+			return nil
+		}
+		sz := h.Tags["sz"]
+		if layout == SchemaManifest {
+			fsz, ok := sizes[seriesKey{h.Tags["bi"], h.Tags["bs"], h.Tags["bsha256"], h.Tags["sha256"]}]
+			if !ok {
+				return fmt.Errorf("%s: block %s has no file size", path, h.Tags["bi"])
+			}
+			sz = strconv.Itoa(fsz)
+		}
+		var t int64
+		if err := json.Unmarshal(row[0], &t); err != nil {
+			return err
+		}
+		bi, err := strconv.Atoi(h.Tags["bi"])
+		if err != nil {
+			return err
+		}
+		return add(h.Tags, sz, layout, bi, h.Tags["bsha256"], t)
+	}); err != nil {
+		return nil, err
+	}
+	if compact {
+		if err := v.compactBlocks(path, "", func(tags map[string]string, bi int, t int64, sum string, fsz int) error {
+			return add(tags, strconv.Itoa(fsz), SchemaCompact, bi, sum, t)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(bms) == 0 {
+		return nil, ErrNotExist
+	}
+	sortBlocks(bms)
+	return bms, nil
+}
+
+// listFiles returns the paths matching the prefix with at least one committed version, of any schema.
+func (v *InfluxVolume) listFiles(prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, q := range []string{
+		fmt.Sprintf("SELECT last(nb) FROM %q WHERE path =~ %s GROUP BY path", manifestMeasurement, influxclient.PrefixRegex(prefix)),
+		fmt.Sprintf("SELECT last(c) FROM %q WHERE path =~ %s GROUP BY path", commitMeasurement, influxclient.PrefixRegex(prefix)),
+	} {
+		if err := v.client.Query(q, v.queryOpts(), func(h *influxclient.SeriesHeader, _ []json.RawMessage) error {
+			if p := h.Tags["path"]; !seen[p] {
+				seen[p] = true
+				names = append(names, p)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Migrate rewrites, in place, every committed version of the file at path that has blocks stored
+// with an older schema than the volume writes, and returns the versions it rewrote.
+//
+// Each old block is written again with the volume's schema, or linked to an identical block that already was,
+// before the version is committed again and the old points are dropped.
+// Readers see the version throughout, so Migrate may run while the file is in use,
+// and may be run again to finish a migration that was interrupted.
+func (v *InfluxVolume) Migrate(path string) ([]*FileMeta, error) {
+	bms, err := v.ListBlocks(path, ListOptions{})
+	if err == ErrNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Blocks already in the current schema, which rewritten blocks can link to rather than copy.
+	current := make(map[[32]byte]*BlockMeta)
+	for _, bm := range bms {
+		if bm.layout >= v.schema {
+			current[bm.SHA256] = bm
+		}
+	}
+
+	var migrated []*FileMeta
+	for _, fm := range FileMetas(bms) {
+		blocks := BlocksOf(fm, bms)
+		old := fm.Schema < v.schema
+		for _, bm := range blocks {
+			old = old || bm.layout < v.schema
+		}
+		if !old {
+			continue
+		}
+		if err := v.migrateVersion(fm, blocks, current); err != nil {
+			return migrated, fmt.Errorf("migrating %s (sha256 %x): %v", fm.Path, fm.SHA256[:], err)
+		}
+		migrated = append(migrated, fm)
+	}
+	return migrated, nil
+}
+
+// migrateVersion rewrites the blocks of fm that are in an older schema, commits fm in the volume's schema,
+// then drops the points that were written with any older schema.
+func (v *InfluxVolume) migrateVersion(fm *FileMeta, blocks []*BlockMeta, current map[[32]byte]*BlockMeta) error {
+	for _, bm := range blocks {
+		if bm.layout >= v.schema {
+			continue
+		}
+		if src := current[bm.SHA256]; src != nil {
+			if err := v.LinkBlock(bm, src); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := v.DownloadBlock(bm)
+		if err != nil {
+			return err
+		}
+		if err := v.UploadBlock(data, bm); err != nil {
+			return err
+		}
+		current[bm.SHA256] = bm
+	}
+
+	if err := v.Commit(fm); err != nil {
+		return err
+	}
+	for s := SchemaSeries; s < v.schema; s++ {
+		if err := v.dropLayout(fm, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropLayout drops the block series and commit point of fm's version that were written with schema s.
+func (v *InfluxVolume) dropLayout(fm *FileMeta, s Schema) error {
+	tags := map[string]string{
+		"bs":     strconv.Itoa(fm.BlockSize),
+		"sha256": fmt.Sprintf("%x", fm.SHA256[:]),
+	}
+	switch s {
+	case SchemaSeries:
+		tags["sz"] = strconv.Itoa(fm.Size)
+		if err := v.client.DropSeries(fm.Path, tags, v.queryOpts()); err != nil {
+			return err
+		}
+		tags["path"] = fm.Path
+		return v.client.DropSeries(commitMeasurement, tags, v.queryOpts())
+	case SchemaManifest:
+		// Series without the sz tag or the tag of later schemas. The manifest is shared by every schema that writes one.
+		tags["sz"] = ""
+		tags[compactTag] = ""
+		return v.client.DropSeries(fm.Path, tags, v.queryOpts())
+	}
+	return fmt.Errorf("unknown schema %d", s)
+}
@@ -0,0 +1,209 @@
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BlockProblem describes what is wrong with a stored block.
+type BlockProblem string
+
+const (
+	// Missing blocks have no readable copy in the volume.
+	Missing BlockProblem = "missing"
+
+	// Duplicate blocks share an index with another block of the same version, under a different checksum.
+	Duplicate BlockProblem = "duplicate"
+
+	// Oversize blocks decode to more data than the block size allows.
+	Oversize BlockProblem = "oversize"
+
+	// Corrupt blocks cannot be decoded, or decode to data that is too short or does not match their checksum.
+	Corrupt BlockProblem = "corrupt"
+
+	// Unexpected blocks have an index beyond the number of blocks implied by the file and block sizes.
+	Unexpected BlockProblem = "unexpected"
+)
+
+// File checksum results reported by VerifyFile.
+const (
+	ChecksumOK         = "ok"
+	ChecksumMismatch   = "mismatch"
+	ChecksumUnverified = "unverified"
+)
+
+// BlockIssue is a problem found with one stored block.
+type BlockIssue struct {
+	Index   int          `json:"bi"`
+	SHA256  string       `json:"bsha256"`
+	Problem BlockProblem `json:"problem"`
+	Detail  string       `json:"detail,omitempty"`
+}
+
+// VerifyReport is the result of verifying one version of a file.
+type VerifyReport struct {
+	Path      string `json:"path"`
+	SHA256    string `json:"sha256"`
+	Time      int64  `json:"time"`
+	Committed bool   `json:"committed"`
+
+	// Blocks is the number of blocks implied by the file and block sizes.
+	Blocks int `json:"blocks"`
+	// Verified is the number of those blocks that were read back and matched their checksum.
+	Verified int `json:"verified"`
+
+	Issues []*BlockIssue `json:"issues,omitempty"`
+
+	// FileChecksum is ChecksumOK or ChecksumMismatch after comparing the blocks, in order,
+	// against the checksum of the whole file, or ChecksumUnverified if any block could not be read.
+	FileChecksum string `json:"file_checksum"`
+}
+
+// OK reports whether the version had no problems.
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0 && r.FileChecksum == ChecksumOK
+}
+
+func (r *VerifyReport) add(bm *BlockMeta, p BlockProblem, detail string) {
+	r.Issues = append(r.Issues, &BlockIssue{
+		Index:   bm.Index,
+		SHA256:  fmt.Sprintf("%x", bm.SHA256[:]),
+		Problem: p,
+		Detail:  detail,
+	})
+}
+
+// Verify verifies every version of the file at path that ListBlocks returns with opts, oldest first.
+func Verify(v Volume, path string, opts ListOptions) ([]*VerifyReport, error) {
+	bms, err := v.ListBlocks(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*VerifyReport
+	for _, fm := range FileMetas(bms) {
+		r, err := VerifyFile(v, fm, BlocksOf(fm, bms))
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// VerifyFile reads back each of bms, the stored blocks of the version fm, from v without keeping them,
+// checking each block against its own checksum and the sequence of blocks against the checksum of fm.
+//
+// Problems with the stored data are described in the report.
+// An error is only returned if v fails for another reason, such as being unreachable.
+func VerifyFile(v Volume, fm *FileMeta, bms []*BlockMeta) (*VerifyReport, error) {
+	n := fm.NumBlocks()
+	r := &VerifyReport{
+		Path:      fm.Path,
+		SHA256:    fmt.Sprintf("%x", fm.SHA256[:]),
+		Time:      fm.Time,
+		Committed: fm.Committed,
+		Blocks:    n,
+	}
+
+	byIndex := make(map[int][]*BlockMeta, n)
+	for _, bm := range bms {
+		if bm.Index < 0 || bm.Index >= n {
+			r.add(bm, Unexpected, fmt.Sprintf("file of %d bytes has %d blocks of %d bytes", fm.Size, n, fm.BlockSize))
+			continue
+		}
+		byIndex[bm.Index] = append(byIndex[bm.Index], bm)
+	}
+
+	// Stream the blocks, in order, through the whole file checksum as they are read.
+	pr, pw := io.Pipe()
+	sum := make(chan error, 1)
+	go func() {
+		err := fm.CompareSHA256Against(pr)
+		pr.Close()
+		sum <- err
+	}()
+
+	broken := false
+	for i := 0; i < n; i++ {
+		copies := byIndex[i]
+		if len(copies) == 0 {
+			r.Issues = append(r.Issues, &BlockIssue{Index: i, Problem: Missing, Detail: "no block stored"})
+			broken = true
+			continue
+		}
+		for _, bm := range copies[1:] {
+			r.add(bm, Duplicate, fmt.Sprintf("%d blocks stored at index %d", len(copies), i))
+		}
+
+		var data []byte
+		for _, bm := range copies {
+			d, err := v.DownloadBlock(bm)
+			if err == nil {
+				data = d
+				break
+			}
+			p, ok := classifyBlockError(err)
+			if !ok {
+				pw.CloseWithError(err)
+				<-sum
+				return nil, fmt.Errorf("block %d of %s: %v", bm.Index, bm.Path, err)
+			}
+			r.add(bm, p, err.Error())
+		}
+		if data == nil {
+			broken = true
+			continue
+		}
+
+		r.Verified++
+		if !broken {
+			pw.Write(data)
+		}
+	}
+
+	if broken {
+		pw.CloseWithError(errUnverified)
+		<-sum
+		r.FileChecksum = ChecksumUnverified
+		return r, nil
+	}
+
+	pw.Close()
+	err := <-sum
+	var ce *ChecksumError
+	var se *SizeError
+	switch {
+	case err == nil:
+		r.FileChecksum = ChecksumOK
+	case errors.As(err, &ce), errors.As(err, &se):
+		r.FileChecksum = ChecksumMismatch
+	default:
+		return nil, err
+	}
+	return r, nil
+}
+
+// errUnverified stops the whole file checksum once a block could not be read.
+var errUnverified = errors.New("file checksum not verified")
+
+// classifyBlockError returns the problem with the stored block described by err, a failed DownloadBlock,
+// or false if err does not describe a problem with the stored data.
+func classifyBlockError(err error) (BlockProblem, bool) {
+	var se *SizeError
+	var ce *ChecksumError
+	var de *DecodeError
+	switch {
+	case errors.As(err, &se):
+		if se.Got > se.Exp {
+			return Oversize, true
+		}
+		return Corrupt, true
+	case errors.As(err, &ce), errors.As(err, &de):
+		return Corrupt, true
+	case errors.Is(err, ErrBlockMissing):
+		return Missing, true
+	}
+	return "", false
+}
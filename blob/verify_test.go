@@ -0,0 +1,129 @@
+package blob_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+)
+
+func TestVerify(t *testing.T) {
+	root, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	v, err := blob.NewDirVolume(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putFile(t, v, "/good", "all of these blocks are fine", 4, 100)
+	putFile(t, v, "/bad", "0000111122223333444455", 4, 100)
+
+	// blockFile returns the file holding block i of /bad.
+	blockFile := func(i int) string {
+		t.Helper()
+		matches, err := filepath.Glob(filepath.Join(root, "*bad", "*", strconv.Itoa(i)+"-*"))
+		if err != nil || len(matches) != 1 {
+			t.Fatalf("exp one file for block %d, got %v (%v)", i, matches, err)
+		}
+		return matches[0]
+	}
+	if err := ioutil.WriteFile(blockFile(1), []byte("XXXX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blockFile(2), []byte("2222 and then some"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(blockFile(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second block 4, with different content, duplicates the first.
+	fms, err := v.Stat("/bad", blob.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := fms[0].NewBlockMeta(4)
+	if err := dup.SetSHA256(strings.NewReader("9999")); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.UploadBlock([]byte("9999"), dup); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := blob.Verify(v, "/good", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(reports) != 1 || !reports[0].OK() || reports[0].Verified != 7 {
+		t.Fatalf("exp one good version of 7 blocks, got %+v", reports[0])
+	}
+
+	reports, err = blob.Verify(v, "/bad", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	r := reports[0]
+	if r.OK() || r.FileChecksum != blob.ChecksumUnverified {
+		t.Fatalf("exp unverified file checksum, got %+v", r)
+	}
+	got := make(map[blob.BlockProblem][]int)
+	for _, is := range r.Issues {
+		got[is.Problem] = append(got[is.Problem], is.Index)
+	}
+	for p, exp := range map[blob.BlockProblem]int{
+		blob.Corrupt:   1,
+		blob.Oversize:  2,
+		blob.Missing:   3,
+		blob.Duplicate: 4,
+	} {
+		if len(got[p]) != 1 || got[p][0] != exp {
+			t.Errorf("exp %s block %d, got %v", p, exp, got[p])
+		}
+	}
+	// Blocks 0 and 5, and whichever copy of block 4 is correct.
+	if r.Verified != 3 {
+		t.Errorf("exp 3 verified blocks, got %d", r.Verified)
+	}
+}
+
+func TestVerifyFile_ChecksumMismatch(t *testing.T) {
+	v := blob.NewMemVolume()
+
+	content := "blocks that are fine on their own"
+	fm, err := blob.NewFileMeta(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.Path, fm.BlockSize = "/f", 8
+	fm.SHA256[0] ^= 0xff
+
+	var bms []*blob.BlockMeta
+	for i := 0; i < fm.NumBlocks(); i++ {
+		bm := fm.NewBlockMeta(i)
+		data := []byte(content[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()])
+		if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.UploadBlock(data, bm); err != nil {
+			t.Fatal(err)
+		}
+		bms = append(bms, bm)
+	}
+
+	r, err := blob.VerifyFile(v, fm, bms)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(r.Issues) != 0 || r.Verified != fm.NumBlocks() || r.FileChecksum != blob.ChecksumMismatch {
+		t.Fatalf("exp every block verified but file checksum mismatched, got %+v", r)
+	}
+}
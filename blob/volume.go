@@ -0,0 +1,118 @@
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+// ErrNotExist is returned by a Volume when no version of a file exists at a path.
+var ErrNotExist = errors.New("file does not exist")
+
+// ErrBlockMissing is wrapped by the error a Volume returns when it has no copy of a block it was asked for.
+var ErrBlockMissing = errors.New("block missing")
+
+// Volume is a store of files that have been split into blocks.
+// All methods are safe for concurrent use.
+type Volume interface {
+	// UploadBlock stores data as the block described by bm.
+	UploadBlock(data []byte, bm *BlockMeta) error
+
+	// DownloadBlock returns the raw data of the block described by bm,
+	// after verifying it against bm's checksum.
+	DownloadBlock(bm *BlockMeta) ([]byte, error)
+
+	// Commit marks the version of the file described by fm as completely uploaded.
+	// Until then, readers ignore the version unless they ask for uncommitted versions.
+	Commit(fm *FileMeta) error
+
+	// ListFiles returns the paths of files matching pattern, according to opts.ListMatch.
+	// Files with only uncommitted versions are omitted unless opts.IncludeUncommitted is set.
+	ListFiles(pattern string, opts ListOptions) ([]string, error)
+
+	// ListBlocks returns the blocks of every committed version of the file at path,
+	// or of every version if opts.IncludeUncommitted is set.
+	// Blocks of the same version share a single FileMeta.
+	// It returns ErrNotExist if there are no such blocks at path.
+	ListBlocks(path string, opts ListOptions) ([]*BlockMeta, error)
+
+	// Stat returns the FileMeta of the versions of the file at path that ListBlocks would return, oldest first.
+	// It returns ErrNotExist if there is no such version.
+	Stat(path string, opts ListOptions) ([]*FileMeta, error)
+
+	// Delete removes the version of the file described by fm, along with all of its blocks
+	// and its commit.
+	Delete(fm *FileMeta) error
+}
+
+type ListMatch int
+
+const (
+	ByPrefix ListMatch = iota
+)
+
+type ListOptions struct {
+	Database  string
+	ListMatch ListMatch
+
+	// IncludeUncommitted includes versions that are still being uploaded, or whose upload failed.
+	IncludeUncommitted bool
+}
+
+// FileMetas returns the distinct FileMeta referenced by bms, oldest first.
+func FileMetas(bms []*BlockMeta) []*FileMeta {
+	var fms []*FileMeta
+	seen := make(map[*FileMeta]bool)
+	for _, bm := range bms {
+		if !seen[bm.FileMeta] {
+			seen[bm.FileMeta] = true
+			fms = append(fms, bm.FileMeta)
+		}
+	}
+
+	sortFileMetas(fms)
+	return fms
+}
+
+// sortFileMetas orders fms oldest first, keeping versions written at the same time in their current order.
+func sortFileMetas(fms []*FileMeta) {
+	sort.SliceStable(fms, func(i, j int) bool { return fms[i].Time < fms[j].Time })
+}
+
+// LatestBlocks returns the blocks in bms that belong to the most recent version of the file,
+// ordered by block index.
+func LatestBlocks(bms []*BlockMeta) []*BlockMeta {
+	fms := FileMetas(bms)
+	if len(fms) == 0 {
+		return nil
+	}
+	return BlocksOf(fms[len(fms)-1], bms)
+}
+
+// BlocksOf returns the blocks in bms that belong to fm, ordered by block index.
+func BlocksOf(fm *FileMeta, bms []*BlockMeta) []*BlockMeta {
+	var out []*BlockMeta
+	for _, bm := range bms {
+		if bm.FileMeta == fm {
+			out = append(out, bm)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Index < out[j].Index })
+	return out
+}
+
+// sortBlocks orders bms by the time of their version, then by block index.
+// Versions written at the same time are ordered by checksum so that the order is stable.
+func sortBlocks(bms []*BlockMeta) {
+	sort.Slice(bms, func(i, j int) bool {
+		fi, fj := bms[i].FileMeta, bms[j].FileMeta
+		if fi != fj {
+			if fi.Time != fj.Time {
+				return fi.Time < fj.Time
+			}
+			return bytes.Compare(fi.SHA256[:], fj.SHA256[:]) < 0
+		}
+		return bms[i].Index < bms[j].Index
+	})
+}
@@ -0,0 +1,104 @@
+package blob_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+func TestLatestBlocks(t *testing.T) {
+	older := &blob.FileMeta{Path: "/f", Size: 8, BlockSize: 4, Time: 100}
+	newer := &blob.FileMeta{Path: "/f", Size: 12, BlockSize: 4, Time: 200}
+
+	bms := []*blob.BlockMeta{
+		newer.NewBlockMeta(2),
+		older.NewBlockMeta(0),
+		newer.NewBlockMeta(0),
+		older.NewBlockMeta(1),
+		newer.NewBlockMeta(1),
+	}
+
+	if fms := blob.FileMetas(bms); len(fms) != 2 || fms[0] != older || fms[1] != newer {
+		t.Fatalf("exp FileMetas oldest first, got %v", fms)
+	}
+
+	latest := blob.LatestBlocks(bms)
+	if len(latest) != 3 {
+		t.Fatalf("exp 3 blocks, got %d", len(latest))
+	}
+	for i, bm := range latest {
+		if bm.FileMeta != newer || bm.Index != i {
+			t.Fatalf("exp block %d of newest version, got block %d of %v", i, bm.Index, bm.FileMeta)
+		}
+	}
+}
+
+func TestVolumes_Attrs(t *testing.T) {
+	root, err := ioutil.TempDir("", "attrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dv, err := blob.NewDirVolume(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	attrs := blob.Attrs{
+		Mode:        0640,
+		ModTime:     1500000000123456789,
+		Owner:       "someone",
+		ContentType: "text/plain; charset=utf-8",
+		Labels:      map[string]string{"team": "a \"quoted\" name", "path": `C:\dir`},
+	}
+
+	for name, v := range map[string]blob.Volume{
+		"mem":    blob.NewMemVolume(),
+		"dir":    dv,
+		"influx": blob.NewInfluxVolume(s.URL, "blob", ""),
+	} {
+		// A version without attributes, as committed before they were stored.
+		putFile(t, v, "/plain", "no attributes", 4, 100)
+
+		content := "with attributes"
+		fm, err := blob.NewFileMeta(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm.Path, fm.BlockSize, fm.Time, fm.Attrs = "/rich", 64, 100, attrs
+		bm := fm.NewBlockMeta(0)
+		if err := bm.SetSHA256(strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.UploadBlock([]byte(content), bm); err != nil {
+			t.Fatalf("%s: exp no err, got %s", name, err)
+		}
+		if err := v.Commit(fm); err != nil {
+			t.Fatalf("%s: exp no err, got %s", name, err)
+		}
+
+		fms, err := v.Stat("/rich", blob.ListOptions{})
+		if err != nil {
+			t.Fatalf("%s: exp no err, got %s", name, err)
+		}
+		if len(fms) != 1 || !reflect.DeepEqual(fms[0].Attrs, attrs) {
+			t.Fatalf("%s: exp attrs %+v, got %+v", name, attrs, fms[0].Attrs)
+		}
+
+		fms, err = v.Stat("/plain", blob.ListOptions{})
+		if err != nil {
+			t.Fatalf("%s: exp no err, got %s", name, err)
+		}
+		if len(fms) != 1 || !fms[0].Attrs.IsZero() {
+			t.Fatalf("%s: exp no attrs, got %+v", name, fms[0].Attrs)
+		}
+	}
+}
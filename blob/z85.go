@@ -1,6 +1,11 @@
 package blob
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
 
 var btoa = [85]byte{
 	/*00 - 09:*/ '0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
@@ -104,3 +109,195 @@ func Z85DecodeAppend(dst []byte, src []byte) []byte {
 
 	return dst
 }
+
+// Kinds of invalid input reported by Z85DecodeAppendStrict, wrapped in a *Z85Error.
+var (
+	ErrZ85InvalidChar = errors.New("invalid character")
+	ErrZ85Overflow    = errors.New("frame overflows 32 bits")
+	ErrZ85Length      = errors.New("length is not a multiple of 5")
+)
+
+// Z85Error describes input that is not valid Z85.
+type Z85Error struct {
+	// Offset is the position in the input of the invalid character, of the first character of the frame that overflowed,
+	// or, for an invalid length, of the incomplete final frame.
+	Offset int
+
+	// Err is ErrZ85InvalidChar, ErrZ85Overflow or ErrZ85Length.
+	Err error
+}
+
+func (e *Z85Error) Error() string {
+	return fmt.Sprintf("illegal Z85 data at input byte %d: %v", e.Offset, e.Err)
+}
+
+func (e *Z85Error) Unwrap() error {
+	return e.Err
+}
+
+// Z85DecodeAppendStrict decodes src into dst like Z85DecodeAppend,
+// but returns a *Z85Error instead of decoding anything that Z85EncodeAppend could not have produced:
+// characters outside the Z85 alphabet, frames whose value does not fit in 4 bytes,
+// and input that does not end on a whole frame.
+// On error, dst holds the frames decoded before the invalid one.
+// As with Z85DecodeAppend, it is acceptable for dst to overlap src.
+func Z85DecodeAppendStrict(dst []byte, src []byte) ([]byte, error) {
+	nFrames := len(src) / 5
+
+	for i := 0; i < nFrames; i++ {
+		head := i * 5
+
+		// Convert Ascii Frame to uint64, so that overflow can be detected.
+		var v uint64
+		for j := 0; j < 5; j++ {
+			b := atob[src[head+j]]
+			if b == 0xFF {
+				return dst, &Z85Error{Offset: head + j, Err: ErrZ85InvalidChar}
+			}
+			v = v*85 + uint64(b)
+		}
+		if v > 0xFFFFFFFF {
+			return dst, &Z85Error{Offset: head, Err: ErrZ85Overflow}
+		}
+
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], uint32(v))
+		dst = append(dst, buf[:]...)
+	}
+
+	if nFrames*5 < len(src) {
+		return dst, &Z85Error{Offset: nFrames * 5, Err: ErrZ85Length}
+	}
+	return dst, nil
+}
+
+// NewZ85Encoder returns a new Z85 stream encoder.
+// Data written to the returned writer is encoded and written to w, one whole frame at a time.
+// As with encoding/base64, the caller must Close the returned encoder to flush any final short frame,
+// which is padded with zeros as Z85EncodeAppend does. Closing the encoder does not close w.
+func NewZ85Encoder(w io.Writer) io.WriteCloser {
+	return &z85Encoder{w: w}
+}
+
+type z85Encoder struct {
+	w   io.Writer
+	err error
+
+	// Bytes of an incomplete frame, waiting for the next Write or Close.
+	frame  [4]byte
+	nFrame int
+
+	out [1280]byte // Room for 256 encoded frames.
+}
+
+func (e *z85Encoder) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n := len(p)
+
+	// Complete a frame left over from the previous write.
+	if e.nFrame > 0 {
+		c := copy(e.frame[e.nFrame:], p)
+		e.nFrame += c
+		p = p[c:]
+		if e.nFrame < 4 {
+			return n, nil
+		}
+		if e.err = e.flush(e.frame[:]); e.err != nil {
+			return 0, e.err
+		}
+		e.nFrame = 0
+	}
+
+	// Encode as many whole frames as fit in the output buffer at a time.
+	for len(p) >= 4 {
+		c := len(p) / 4 * 4
+		if max := len(e.out) / 5 * 4; c > max {
+			c = max
+		}
+		if e.err = e.flush(p[:c]); e.err != nil {
+			return n - len(p), e.err
+		}
+		p = p[c:]
+	}
+
+	e.nFrame = copy(e.frame[:], p)
+	return n, nil
+}
+
+// flush encodes src, which must fit in e.out, and writes it to e.w.
+func (e *z85Encoder) flush(src []byte) error {
+	_, err := e.w.Write(Z85EncodeAppend(e.out[:0], src))
+	return err
+}
+
+// Close flushes any pending short frame to the underlying writer.
+// Subsequent writes are an error.
+func (e *z85Encoder) Close() error {
+	if e.err == nil && e.nFrame > 0 {
+		e.err = e.flush(e.frame[:e.nFrame])
+		e.nFrame = 0
+	}
+	if e.err != nil {
+		return e.err
+	}
+	e.err = errors.New("z85: write to closed encoder")
+	return nil
+}
+
+// NewZ85Decoder returns a new Z85 stream decoder, which reads encoded data from r
+// and validates it as Z85DecodeAppendStrict does.
+// Invalid input is reported as a *Z85Error, with Offset counted from the start of the stream.
+// Because encoded data is always whole frames, the decoded stream includes the padding of the final frame.
+func NewZ85Decoder(r io.Reader) io.Reader {
+	return &z85Decoder{r: r}
+}
+
+type z85Decoder struct {
+	r   io.Reader
+	err error
+
+	// Encoded input not yet decoded, always less than a frame between reads.
+	in  [1280]byte
+	nIn int
+	// Number of encoded bytes decoded so far.
+	offset int
+
+	// Decoded data not yet returned.
+	out    []byte
+	outBuf [1024]byte
+}
+
+func (d *z85Decoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		n, err := d.r.Read(d.in[d.nIn:])
+		d.nIn += n
+
+		whole := d.nIn / 5 * 5
+		out, derr := Z85DecodeAppendStrict(d.outBuf[:0], d.in[:whole])
+		d.out = out
+		if derr != nil {
+			ze := *derr.(*Z85Error)
+			ze.Offset += d.offset
+			d.err = &ze
+			continue
+		}
+		d.nIn = copy(d.in[:], d.in[whole:d.nIn])
+		d.offset += whole
+
+		if err == io.EOF && d.nIn > 0 {
+			d.err = &Z85Error{Offset: d.offset, Err: ErrZ85Length}
+		} else if err != nil {
+			d.err = err
+		}
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
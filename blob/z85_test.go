@@ -1,7 +1,12 @@
 package blob_test
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
 	"testing"
+	"testing/iotest"
 
 	"github.com/mark-rushakoff/influx-blob/blob"
 )
@@ -24,3 +29,111 @@ func TestZ85DecodeAppend_HelloWorld(t *testing.T) {
 		t.Fatalf("exp %q, got %q", exp, dst)
 	}
 }
+
+func TestZ85DecodeAppendStrict(t *testing.T) {
+	dst, err := blob.Z85DecodeAppendStrict(nil, []byte("HelloWorld"))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if exp := "\x86\x4F\xD2\x6F\xB5\x59\xF7\x5B"; string(dst) != exp {
+		t.Fatalf("exp %q, got %q", exp, dst)
+	}
+
+	for _, tc := range []struct {
+		in     string
+		offset int
+		err    error
+		n      int
+	}{
+		{in: "Hello Worl", offset: 5, err: blob.ErrZ85InvalidChar, n: 4},
+		{in: "HelloWor\"d", offset: 8, err: blob.ErrZ85InvalidChar, n: 4},
+		{in: "Hello#####", offset: 5, err: blob.ErrZ85Overflow, n: 4},
+		{in: "#####", offset: 0, err: blob.ErrZ85Overflow},
+		{in: "HelloWorl", offset: 5, err: blob.ErrZ85Length, n: 4},
+		{in: "Hel", offset: 0, err: blob.ErrZ85Length},
+	} {
+		dst, err := blob.Z85DecodeAppendStrict(nil, []byte(tc.in))
+		var ze *blob.Z85Error
+		if !errors.As(err, &ze) {
+			t.Errorf("%q: exp *Z85Error, got %v", tc.in, err)
+			continue
+		}
+		if ze.Offset != tc.offset || !errors.Is(err, tc.err) {
+			t.Errorf("%q: exp %v at %d, got %v", tc.in, tc.err, tc.offset, err)
+		}
+		if len(dst) != tc.n {
+			t.Errorf("%q: exp %d bytes decoded before the error, got %d", tc.in, tc.n, len(dst))
+		}
+	}
+}
+
+func TestZ85DecodeAppendStrict_RoundTrip(t *testing.T) {
+	src := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(src)
+
+	enc := blob.Z85EncodeAppend(nil, src)
+	dst, err := blob.Z85DecodeAppendStrict(enc[:0], enc)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if !bytes.Equal(dst, src) {
+		t.Fatalf("decoded data did not match")
+	}
+}
+
+func TestZ85Encoder(t *testing.T) {
+	src := make([]byte, 10*1024+3)
+	rand.New(rand.NewSource(2)).Read(src)
+	exp := blob.Z85EncodeAppend(nil, src)
+
+	// Writes of every size cross frame boundaries differently.
+	for _, size := range []int{1, 3, 4, 7, 1024, len(src)} {
+		var buf bytes.Buffer
+		enc := blob.NewZ85Encoder(&buf)
+		for p := src; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := enc.Write(p[:n]); err != nil {
+				t.Fatalf("writes of %d: exp no err, got %s", size, err)
+			}
+			p = p[n:]
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatalf("writes of %d: exp no err closing, got %s", size, err)
+		}
+		if !bytes.Equal(buf.Bytes(), exp) {
+			t.Fatalf("writes of %d: encoded stream did not match Z85EncodeAppend", size)
+		}
+	}
+}
+
+func TestZ85Decoder(t *testing.T) {
+	src := make([]byte, 10*1024+3)
+	rand.New(rand.NewSource(3)).Read(src)
+	enc := blob.Z85EncodeAppend(nil, src)
+
+	got, err := ioutil.ReadAll(blob.NewZ85Decoder(iotest.OneByteReader(bytes.NewReader(enc))))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	// The final short frame decodes with its padding.
+	if len(got) != len(src)+1 || !bytes.Equal(got[:len(src)], src) {
+		t.Fatalf("decoded stream did not match source")
+	}
+
+	// Errors report their offset from the start of the stream.
+	bad := append([]byte(nil), enc...)
+	bad[5000] = '~'
+	_, err = ioutil.ReadAll(blob.NewZ85Decoder(bytes.NewReader(bad)))
+	var ze *blob.Z85Error
+	if !errors.As(err, &ze) || ze.Offset != 5000 || !errors.Is(err, blob.ErrZ85InvalidChar) {
+		t.Fatalf("exp invalid character at 5000, got %v", err)
+	}
+
+	_, err = ioutil.ReadAll(blob.NewZ85Decoder(bytes.NewReader(enc[:len(enc)-2])))
+	if !errors.As(err, &ze) || ze.Offset != len(enc)-5 || !errors.Is(err, blob.ErrZ85Length) {
+		t.Fatalf("exp bad length at %d, got %v", len(enc)-5, err)
+	}
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/mark-rushakoff/influx-blob/blob"
@@ -10,6 +11,15 @@ type FileTransferContext struct {
 	Blocks []*BlockTransferContext
 
 	fm *blob.FileMeta
+
+	// When the destination is a Committer, committed is closed once the commit has been attempted.
+	committed chan struct{}
+	commitErr error
+}
+
+// FileMeta returns the meta-information of the file being transferred.
+func (c *FileTransferContext) FileMeta() *blob.FileMeta {
+	return c.fm
 }
 
 // Blocks execution until all underlying blocks have transferred.
@@ -18,6 +28,27 @@ func (c *FileTransferContext) Wait() {
 	for _, b := range c.Blocks {
 		b.Wait()
 	}
+	if c.committed != nil {
+		<-c.committed
+	}
+}
+
+// commitWhenDone commits fm through cm once every block has transferred successfully.
+// It must be called before the context is returned to the caller.
+func (c *FileTransferContext) commitWhenDone(cm Committer, fm *blob.FileMeta) {
+	c.committed = make(chan struct{})
+	go func() {
+		defer close(c.committed)
+		for _, b := range c.Blocks {
+			b.Wait()
+		}
+		if c.blocksErr() != nil {
+			return
+		}
+		if err := cm.Commit(fm); err != nil {
+			c.commitErr = fmt.Errorf("commit: %w", err)
+		}
+	}()
 }
 
 // Returns a FileTransferStats indicating the duration of the transfer
@@ -40,21 +71,53 @@ func (c *FileTransferContext) Stats() *FileTransferStats {
 		}
 	}
 
+	skipped := 0
+	for _, b := range c.Blocks {
+		if b.skipped {
+			skipped++
+		}
+	}
+
 	return &FileTransferStats{
-		Duration: lastFinish.Sub(firstStart),
-		Bytes:    c.fm.Size,
+		Duration:      lastFinish.Sub(firstStart),
+		Bytes:         c.fm.Size,
+		SkippedBlocks: skipped,
 	}
 }
 
+// Err returns the first error encountered by any of the underlying blocks, or by the commit,
+// or nil if every block transferred successfully. Not safe to call until Wait returns.
+func (c *FileTransferContext) Err() error {
+	if err := c.blocksErr(); err != nil {
+		return err
+	}
+	return c.commitErr
+}
+
+func (c *FileTransferContext) blocksErr() error {
+	for _, b := range c.Blocks {
+		if err := b.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type FileTransferStats struct {
 	Duration time.Duration
 	Bytes    int
+
+	// Number of blocks that did not need to be transferred because the destination already had them,
+	// or because they were linked to a previous version.
+	SkippedBlocks int
 }
 
 type BlockTransferContext struct {
 	startedAt  time.Time
 	finishedAt time.Time
 	done       chan struct{}
+	err        error
+	skipped    bool
 
 	bm *blob.BlockMeta
 }
@@ -71,3 +134,16 @@ func (c *BlockTransferContext) Done() bool {
 func (c *BlockTransferContext) Wait() {
 	<-c.done
 }
+
+// Skipped reports whether the block was not transferred because the destination already had it,
+// or because it was linked to an identical block of a previous version.
+// Not safe to call until Wait returns.
+func (c *BlockTransferContext) Skipped() bool {
+	return c.skipped
+}
+
+// Err returns the error that caused the block to fail, or nil if it transferred successfully.
+// Not safe to call until Wait returns.
+func (c *BlockTransferContext) Err() error {
+	return c.err
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+)
+
+// CopyDestination is a BlockUploader that can report which blocks it already holds.
+type CopyDestination interface {
+	BlockUploader
+	ListBlocks(path string, opts blob.ListOptions) ([]*blob.BlockMeta, error)
+}
+
+// Any blob.Volume can be the destination of a copy.
+var _ CopyDestination = blob.Volume(nil)
+
+type copyTask struct {
+	ctx *BlockTransferContext
+	dst *blob.BlockMeta
+
+	src BlockDownloader
+	to  BlockUploader
+}
+
+func (e *Engine) handleCopies() {
+	for task := range e.copies {
+		e.handleCopy(task)
+	}
+}
+
+// CopyFile copies the blocks in bms from src to dst, one block at a time through memory.
+// The copy keeps the checksum, block size and time of the source version,
+// and is stored at dstPath, or at the source path if dstPath is empty.
+//
+// Blocks that dst already holds for the same version, with the same checksum, are skipped,
+// even if an earlier copy of the version was never committed.
+// If dst is a Committer, the copy is committed once every block is present.
+// All of bms must have the same FileMeta.
+func (e *Engine) CopyFile(bms []*blob.BlockMeta, src BlockDownloader, dst CopyDestination, dstPath string) (*FileTransferContext, error) {
+	if len(bms) == 0 {
+		return nil, fmt.Errorf("(%T).CopyFile: must have at least one BlockMeta", e)
+	}
+
+	fm := bms[0].FileMeta
+	dstFM := *fm
+	if dstPath != "" {
+		dstFM.Path = dstPath
+	}
+
+	present, err := presentBlocks(dst, &dstFM)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &FileTransferContext{
+		Blocks: make([]*BlockTransferContext, len(bms)),
+		fm:     fm,
+	}
+	var tasks []copyTask
+	now := time.Now()
+	for i, bm := range bms {
+		if bm.FileMeta != fm {
+			return nil, fmt.Errorf("(%T).CopyFile: all BlockMeta must have same FileMeta", e)
+		}
+		c := &BlockTransferContext{
+			bm:   bm,
+			done: make(chan struct{}),
+		}
+		ctx.Blocks[i] = c
+
+		if present[blockKey{bm.Index, bm.SHA256}] {
+			c.skipped = true
+			c.startedAt, c.finishedAt = now, now
+			close(c.done)
+			continue
+		}
+
+		dbm := dstFM.NewBlockMeta(bm.Index)
+		dbm.SHA256 = bm.SHA256
+		tasks = append(tasks, copyTask{ctx: c, dst: dbm, src: src, to: dst})
+	}
+
+	if cm, ok := dst.(Committer); ok {
+		ctx.commitWhenDone(cm, &dstFM)
+	}
+
+	go func() {
+		for _, t := range tasks {
+			e.copies <- t
+		}
+	}()
+
+	return ctx, nil
+}
+
+// CopyPrefix copies every version of every file whose path begins with prefix from src to dst,
+// replacing prefix with dstPrefix in the destination paths.
+// It returns one FileTransferContext per version copied.
+func (e *Engine) CopyPrefix(prefix string, src blob.Volume, dst CopyDestination, dstPrefix string) ([]*FileTransferContext, error) {
+	paths, err := src.ListFiles(prefix, blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil {
+		return nil, err
+	}
+
+	var ctxs []*FileTransferContext
+	for _, p := range paths {
+		bms, err := src.ListBlocks(p, blob.ListOptions{})
+		if err == blob.ErrNotExist {
+			continue
+		} else if err != nil {
+			return ctxs, err
+		}
+
+		dstPath := dstPrefix + strings.TrimPrefix(p, prefix)
+		for _, fm := range blob.FileMetas(bms) {
+			ctx, err := e.CopyFile(blob.BlocksOf(fm, bms), src, dst, dstPath)
+			if err != nil {
+				return ctxs, err
+			}
+			ctxs = append(ctxs, ctx)
+		}
+	}
+	return ctxs, nil
+}
+
+type blockKey struct {
+	index  int
+	sha256 [sha256.Size]byte
+}
+
+// presentBlocks returns the blocks that dst already holds for the version described by fm.
+func presentBlocks(dst CopyDestination, fm *blob.FileMeta) (map[blockKey]bool, error) {
+	present := make(map[blockKey]bool)
+
+	bms, err := dst.ListBlocks(fm.Path, blob.ListOptions{IncludeUncommitted: true})
+	if err == blob.ErrNotExist {
+		return present, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, bm := range bms {
+		f := bm.FileMeta
+		if f.SHA256 == fm.SHA256 && f.BlockSize == fm.BlockSize && f.Size == fm.Size {
+			present[blockKey{bm.Index, bm.SHA256}] = true
+		}
+	}
+	return present, nil
+}
+
+func (e *Engine) handleCopy(t copyTask) {
+	defer close(t.ctx.done)
+
+	t.ctx.startedAt = time.Now()
+	defer func() { t.ctx.finishedAt = time.Now() }()
+
+	bm := t.ctx.bm
+	data, err := t.src.DownloadBlock(bm)
+	if err == nil {
+		// Don't trust the source to have verified the block; a bad copy would be permanent.
+		err = bm.CompareSHA256Against(bytes.NewReader(data))
+	}
+	if err == nil {
+		err = t.to.UploadBlock(data, t.dst)
+	}
+	if err != nil {
+		t.ctx.err = fmt.Errorf("block %d: %v", bm.Index, err)
+	}
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"time"
@@ -12,6 +13,9 @@ import (
 const (
 	defaultUploaders   = 10
 	defaultDownloaders = 25
+
+	// Number of contiguous blocks requested at once from a BlockRangeDownloader.
+	blocksPerRange = 64
 )
 
 type Engine struct {
@@ -19,6 +23,7 @@ type Engine struct {
 
 	uploads   chan uploadTask
 	downloads chan downloadTask
+	copies    chan copyTask
 }
 
 func NewEngine(uploaders, downloaders int) *Engine {
@@ -35,10 +40,13 @@ func NewEngine(uploaders, downloaders int) *Engine {
 
 		uploads:   make(chan uploadTask, uploaders),
 		downloads: make(chan downloadTask, downloaders),
+		copies:    make(chan copyTask, uploaders),
 	}
 
 	for i := 0; i < uploaders; i++ {
 		go e.handleUploads()
+		// Copies are bound by the speed of the destination, so they get as many workers as uploads.
+		go e.handleCopies()
 	}
 	for i := 0; i < downloaders; i++ {
 		go e.handleDownloads()
@@ -55,7 +63,39 @@ type BlockUploader interface {
 	UploadBlock(data []byte, bm *blob.BlockMeta) error
 }
 
+// Committer is implemented by a BlockUploader that must be told when every block of a file has been uploaded.
+// Uploads and copies commit the file once all of its blocks have succeeded.
+type Committer interface {
+	Commit(fm *blob.FileMeta) error
+}
+
+// BlockLinker is implemented by a BlockUploader that can store a block as a reference
+// to an identical block already stored for another version of the same file.
+type BlockLinker interface {
+	BlockUploader
+
+	LinkBlock(bm, src *blob.BlockMeta) error
+}
+
+var (
+	_ BlockLinker = (*blob.InfluxVolume)(nil)
+	_ BlockLinker = (*blob.BatchUploader)(nil)
+	_ BlockLinker = (*blob.MemVolume)(nil)
+	_ BlockLinker = (*blob.DirVolume)(nil)
+	_ BlockLinker = (*blob.ReplicatedVolume)(nil)
+
+	_ Committer = blob.Volume(nil)
+	_ Committer = (*blob.BatchUploader)(nil)
+)
+
+// Any blob.Volume can be used directly as the source or destination of a transfer.
+var (
+	_ BlockUploader   = blob.Volume(nil)
+	_ BlockDownloader = blob.Volume(nil)
+)
+
 // UploadFile reads from f via fm and uploads through bu.
+// If bu is a Committer, the file is committed once every block has been uploaded.
 func (e *Engine) UploadFile(f io.ReaderAt, fm *blob.FileMeta, bu BlockUploader) *FileTransferContext {
 	nBlocks := fm.NumBlocks()
 	ctx := &FileTransferContext{
@@ -70,6 +110,10 @@ func (e *Engine) UploadFile(f io.ReaderAt, fm *blob.FileMeta, bu BlockUploader)
 		}
 	}
 
+	if cm, ok := bu.(Committer); ok {
+		ctx.commitWhenDone(cm, fm)
+	}
+
 	go func() {
 		for i := 0; i < nBlocks; i++ {
 			e.uploads <- uploadTask{ctx: ctx.Blocks[i], r: f, bu: bu}
@@ -79,6 +123,42 @@ func (e *Engine) UploadFile(f io.ReaderAt, fm *blob.FileMeta, bu BlockUploader)
 	return ctx
 }
 
+// UploadFileDelta uploads f like UploadFile, except that blocks whose checksum matches one of prev,
+// typically the blocks of the previous version of the file, are linked to that block through bl
+// instead of being uploaded again. Linked blocks are reported as skipped.
+// A block that fails to link is uploaded through bl instead.
+func (e *Engine) UploadFileDelta(f io.ReaderAt, fm *blob.FileMeta, bl BlockLinker, prev []*blob.BlockMeta) *FileTransferContext {
+	bySHA := make(map[[sha256.Size]byte]*blob.BlockMeta, len(prev))
+	for _, bm := range prev {
+		bySHA[bm.SHA256] = bm
+	}
+
+	nBlocks := fm.NumBlocks()
+	ctx := &FileTransferContext{
+		Blocks: make([]*BlockTransferContext, nBlocks),
+		fm:     fm,
+	}
+
+	for i := 0; i < nBlocks; i++ {
+		ctx.Blocks[i] = &BlockTransferContext{
+			bm:   fm.NewBlockMeta(i),
+			done: make(chan struct{}),
+		}
+	}
+
+	if cm, ok := bl.(Committer); ok {
+		ctx.commitWhenDone(cm, fm)
+	}
+
+	go func() {
+		for i := 0; i < nBlocks; i++ {
+			e.uploads <- uploadTask{ctx: ctx.Blocks[i], r: f, bu: bl, bl: bl, prev: bySHA}
+		}
+	}()
+
+	return ctx
+}
+
 func (e *Engine) handleUploads() {
 	for task := range e.uploads {
 		e.handleUpload(task)
@@ -89,6 +169,10 @@ type uploadTask struct {
 	ctx *BlockTransferContext
 	r   io.ReaderAt
 	bu  BlockUploader
+
+	// When bl is set, blocks with a checksum in prev are linked rather than uploaded.
+	bl   BlockLinker
+	prev map[[sha256.Size]byte]*blob.BlockMeta
 }
 
 func (e *Engine) handleUpload(t uploadTask) {
@@ -101,10 +185,18 @@ func (e *Engine) handleUpload(t uploadTask) {
 	if err := bm.SetSHA256(
 		io.NewSectionReader(t.r, bm.FileOffset(), int64(bm.ExpSize())),
 	); err != nil {
-		panic(err)
+		t.ctx.err = err
+		return
+	}
+	if src := t.prev[bm.SHA256]; t.bl != nil && src != nil {
+		// A block that cannot be linked, such as when src has since been deleted, is uploaded instead.
+		if err := t.bl.LinkBlock(bm, src); err == nil {
+			t.ctx.skipped = true
+			return
+		}
 	}
 	if err := UploadBlock(t.r, bm, t.bu); err != nil {
-		panic(err)
+		t.ctx.err = fmt.Errorf("block %d: %v", bm.Index, err)
 	}
 }
 
@@ -112,19 +204,37 @@ type BlockDownloader interface {
 	DownloadBlock(bm *blob.BlockMeta) ([]byte, error)
 }
 
+// BlockRangeDownloader is implemented by a BlockDownloader that can fetch many blocks in one request.
+type BlockRangeDownloader interface {
+	BlockDownloader
+
+	// DownloadBlocks fetches the blocks in bms, calling fn with each block's raw data as it arrives.
+	// Blocks that are not passed to fn are considered missing.
+	DownloadBlocks(bms []*blob.BlockMeta, fn func(bm *blob.BlockMeta, data []byte) error) error
+}
+
 type downloadTask struct {
 	ctx *BlockTransferContext
 	w   io.WriterAt
 	bd  BlockDownloader
+
+	// When brd is set, all of ctxs are downloaded through brd instead of ctx through bd.
+	ctxs []*BlockTransferContext
+	brd  BlockRangeDownloader
 }
 
 func (e *Engine) handleDownloads() {
 	for task := range e.downloads {
-		e.handleDownload(task)
+		if task.brd != nil {
+			e.handleRangeDownload(task)
+		} else {
+			e.handleDownload(task)
+		}
 	}
 }
 
 // DownloadFile attempts to download bms through bd, writing each block to w.
+// If bd is a BlockRangeDownloader, contiguous runs of blocks are requested together.
 func (e *Engine) DownloadFile(w io.WriterAt, bms []*blob.BlockMeta, bd BlockDownloader) (*FileTransferContext, error) {
 	if len(bms) == 0 {
 		return nil, fmt.Errorf("(%T).DownloadFile: must have at least one BlockMeta", e)
@@ -147,6 +257,13 @@ func (e *Engine) DownloadFile(w io.WriterAt, bms []*blob.BlockMeta, bd BlockDown
 	}
 
 	go func() {
+		if brd, ok := bd.(BlockRangeDownloader); ok {
+			for _, ctxs := range blockRanges(ctx.Blocks, blocksPerRange) {
+				e.downloads <- downloadTask{ctxs: ctxs, w: w, brd: brd}
+			}
+			return
+		}
+
 		for _, ctx := range ctx.Blocks {
 			e.downloads <- downloadTask{ctx: ctx, w: w, bd: bd}
 		}
@@ -155,6 +272,20 @@ func (e *Engine) DownloadFile(w io.WriterAt, bms []*blob.BlockMeta, bd BlockDown
 	return ctx, nil
 }
 
+// blockRanges splits ctxs into runs of at most max blocks with consecutive block indexes.
+func blockRanges(ctxs []*BlockTransferContext, max int) [][]*BlockTransferContext {
+	var ranges [][]*BlockTransferContext
+	start := 0
+	for i := 1; i <= len(ctxs); i++ {
+		if i < len(ctxs) && i-start < max && ctxs[i].bm.Index == ctxs[i-1].bm.Index+1 {
+			continue
+		}
+		ranges = append(ranges, ctxs[start:i])
+		start = i
+	}
+	return ranges
+}
+
 func (e *Engine) handleDownload(t downloadTask) {
 	defer close(t.ctx.done)
 
@@ -162,7 +293,47 @@ func (e *Engine) handleDownload(t downloadTask) {
 	defer func() { t.ctx.finishedAt = time.Now() }()
 
 	if err := DownloadBlock(t.w, t.ctx.bm, t.bd); err != nil {
-		panic(err)
+		t.ctx.err = fmt.Errorf("block %d: %v", t.ctx.bm.Index, err)
+	}
+}
+
+func (e *Engine) handleRangeDownload(t downloadTask) {
+	startedAt := time.Now()
+	byMeta := make(map[*blob.BlockMeta]*BlockTransferContext, len(t.ctxs))
+	bms := make([]*blob.BlockMeta, len(t.ctxs))
+	for i, c := range t.ctxs {
+		c.startedAt = startedAt
+		byMeta[c.bm] = c
+		bms[i] = c.bm
+	}
+
+	err := t.brd.DownloadBlocks(bms, func(bm *blob.BlockMeta, data []byte) error {
+		c := byMeta[bm]
+		if c == nil || c.Done() {
+			// Not ours, or a duplicate of a block already written.
+			return nil
+		}
+
+		if err := writeBlock(t.w, bm, data); err != nil {
+			c.err = fmt.Errorf("block %d: %v", bm.Index, err)
+		}
+		c.finishedAt = time.Now()
+		close(c.done)
+		return nil
+	})
+
+	// Anything not yet done either failed along with the request or was never returned.
+	for _, c := range t.ctxs {
+		if c.Done() {
+			continue
+		}
+		if err != nil {
+			c.err = fmt.Errorf("block %d: %v", c.bm.Index, err)
+		} else {
+			c.err = fmt.Errorf("block %d: not found", c.bm.Index)
+		}
+		c.finishedAt = time.Now()
+		close(c.done)
 	}
 }
 
@@ -187,6 +358,11 @@ func DownloadBlock(w io.WriterAt, bm *blob.BlockMeta, bd BlockDownloader) error
 	if err != nil {
 		return err
 	}
+	return writeBlock(w, bm, data)
+}
+
+// writeBlock writes the downloaded data for bm to w and verifies its checksum.
+func writeBlock(w io.WriterAt, bm *blob.BlockMeta, data []byte) error {
 	if len(data) != bm.ExpSize() {
 		return fmt.Errorf("data did not match block size")
 	}
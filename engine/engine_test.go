@@ -3,6 +3,7 @@ package engine_test
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"strings"
 	"sync"
 	"testing"
@@ -77,6 +78,61 @@ func TestEngine_UploadFile(t *testing.T) {
 	}
 }
 
+// committingUploader fails uploads of the blocks in fail, and records commits.
+type committingUploader struct {
+	mockUploader
+	fail map[int]bool
+
+	commits []*blob.FileMeta
+}
+
+func (u *committingUploader) UploadBlock(data []byte, bm *blob.BlockMeta) error {
+	if u.fail[bm.Index] {
+		return errors.New("upload failed")
+	}
+	return u.mockUploader.UploadBlock(data, bm)
+}
+
+func (u *committingUploader) Commit(fm *blob.FileMeta) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.commits = append(u.commits, fm)
+	return nil
+}
+
+func TestEngine_UploadFile_Commit(t *testing.T) {
+	e := engine.NewEngine(2, 1)
+
+	f := strings.NewReader("abcdefghijkl")
+	fm, err := blob.NewFileMeta(f)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm.Path = "/my/file"
+	fm.BlockSize = 4
+
+	bu := &committingUploader{}
+	ctx := e.UploadFile(f, fm, bu)
+	ctx.Wait()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(bu.commits) != 1 || bu.commits[0] != fm {
+		t.Fatalf("exp one commit of the file, got %v", bu.commits)
+	}
+
+	// A failed block must leave the upload uncommitted.
+	bu = &committingUploader{fail: map[int]bool{1: true}}
+	ctx = e.UploadFile(f, fm, bu)
+	ctx.Wait()
+	if ctx.Err() == nil {
+		t.Fatalf("exp err from failed block")
+	}
+	if len(bu.commits) != 0 {
+		t.Fatalf("exp no commit after failure, got %v", bu.commits)
+	}
+}
+
 type mockBlockDownloader struct {
 	src []byte
 }
@@ -165,3 +221,314 @@ func TestEngine_DownloadFile(t *testing.T) {
 		t.Fatalf("Wrong blocks downloaded")
 	}
 }
+
+type mockRangeDownloader struct {
+	mockBlockDownloader
+
+	mu     sync.Mutex
+	ranges [][]int
+}
+
+var _ engine.BlockRangeDownloader = &mockRangeDownloader{}
+
+func (d *mockRangeDownloader) DownloadBlocks(bms []*blob.BlockMeta, fn func(*blob.BlockMeta, []byte) error) error {
+	idxs := make([]int, len(bms))
+	for i, bm := range bms {
+		idxs[i] = bm.Index
+	}
+	d.mu.Lock()
+	d.ranges = append(d.ranges, idxs)
+	d.mu.Unlock()
+
+	for _, bm := range bms {
+		// Leave out block 3 to simulate a block missing from the volume.
+		if bm.Index == 3 {
+			continue
+		}
+		data, err := d.DownloadBlock(bm)
+		if err != nil {
+			return err
+		}
+		if err := fn(bm, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestEngine_DownloadFile_Ranged(t *testing.T) {
+	e := engine.NewEngine(1, 1)
+
+	src := []byte("abcdefghijklmnop")
+	fm, err := blob.NewFileMeta(bytes.NewReader(src))
+	if err != nil {
+		t.Fatalf("Could not create file meta: %s", err)
+	}
+	fm.Path = "/my/file"
+	fm.BlockSize = 2
+	bd := &mockRangeDownloader{mockBlockDownloader: mockBlockDownloader{src: src}}
+
+	// Skip block 5 so that the blocks form two contiguous ranges.
+	var bms []*blob.BlockMeta
+	for i := 0; i < fm.NumBlocks(); i++ {
+		if i != 5 {
+			bms = append(bms, fm.NewBlockMeta(i))
+		}
+	}
+
+	w := &writerAt{}
+	ctx, err := e.DownloadFile(w, bms, bd)
+	if err != nil {
+		t.Fatalf("Failed to download file: %s", err)
+	}
+	ctx.Wait()
+
+	if len(bd.ranges) != 2 {
+		t.Fatalf("exp 2 range requests, got %v", bd.ranges)
+	}
+	for _, b := range ctx.Blocks {
+		if !b.Done() {
+			t.Fatalf("All blocks should have been marked done")
+		}
+	}
+	if ctx.Blocks[3].Err() == nil {
+		t.Fatalf("exp missing block 3 to report an error")
+	}
+	if ctx.Err() == nil {
+		t.Fatalf("exp file to report an error")
+	}
+	if !bytes.Equal(w.buf[:6], src[:6]) || !bytes.Equal(w.buf[12:], src[12:]) {
+		t.Fatalf("Wrong blocks downloaded: %q", w.buf)
+	}
+}
+
+func TestEngine_RoundTrip_MemVolume(t *testing.T) {
+	e := engine.NewEngine(4, 4)
+	v := blob.NewMemVolume()
+
+	src := []byte("the quick brown fox jumps over the lazy dog")
+	fm, err := blob.NewFileMeta(bytes.NewReader(src))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm.Path = "/my/file"
+	fm.BlockSize = 8
+
+	up := e.UploadFile(bytes.NewReader(src), fm, v)
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+
+	bms, err := v.ListBlocks("/my/file", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	w := &writerAt{}
+	down, err := e.DownloadFile(w, bms, v)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if err := down.Err(); err != nil {
+		t.Fatalf("exp no download err, got %s", err)
+	}
+
+	if !bytes.Equal(w.buf, src) {
+		t.Fatalf("exp %q, got %q", src, w.buf)
+	}
+}
+
+func TestEngine_CopyFile(t *testing.T) {
+	e := engine.NewEngine(2, 2)
+	src, dst := blob.NewMemVolume(), blob.NewMemVolume()
+
+	content := []byte("copy me block by block")
+	fm, err := blob.NewFileMeta(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm.Path = "/src/file"
+	fm.BlockSize = 4
+	fm.Time = 1234
+
+	up := e.UploadFile(bytes.NewReader(content), fm, src)
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+	bms, err := src.ListBlocks("/src/file", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	// Pretend an earlier copy was interrupted after the first block.
+	first := *bms[0].FileMeta
+	first.Path = "/dst/file"
+	bm := first.NewBlockMeta(0)
+	bm.SHA256 = bms[0].SHA256
+	if err := dst.UploadBlock(content[:4], bm); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	ctx, err := e.CopyFile(bms, src, dst, "/dst/file")
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	ctx.Wait()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("exp no copy err, got %s", err)
+	}
+	if n := ctx.Stats().SkippedBlocks; n != 1 {
+		t.Fatalf("exp 1 skipped block, got %d", n)
+	}
+
+	fms, err := dst.Stat("/dst/file", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(fms) != 1 || fms[0].Time != 1234 || fms[0].SHA256 != fm.SHA256 {
+		t.Fatalf("exp copy to preserve version, got %+v", fms)
+	}
+
+	w := &writerAt{}
+	down, err := e.DownloadFile(w, mustList(t, dst, "/dst/file"), dst)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if !bytes.Equal(w.buf, content) {
+		t.Fatalf("exp %q, got %q", content, w.buf)
+	}
+
+	// Copying the whole prefix again transfers nothing new.
+	ctxs, err := e.CopyPrefix("/src/", src, dst, "/dst/")
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(ctxs) != 1 {
+		t.Fatalf("exp 1 version copied, got %d", len(ctxs))
+	}
+	ctxs[0].Wait()
+	if n := ctxs[0].Stats().SkippedBlocks; n != fm.NumBlocks() {
+		t.Fatalf("exp all %d blocks skipped, got %d", fm.NumBlocks(), n)
+	}
+}
+
+func TestEngine_UploadFileDelta(t *testing.T) {
+	e := engine.NewEngine(2, 2)
+	v := blob.NewMemVolume()
+
+	old := []byte("aaaabbbbccccdddd")
+	fm1, err := blob.NewFileMeta(bytes.NewReader(old))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm1.Path = "/my/file"
+	fm1.BlockSize = 4
+	fm1.Time = 1
+	up := e.UploadFile(bytes.NewReader(old), fm1, v)
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+
+	// Change one block and move another.
+	cur := []byte("aaaaXXXXddddbbbb")
+	fm2, err := blob.NewFileMeta(bytes.NewReader(cur))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm2.Path = "/my/file"
+	fm2.BlockSize = 4
+	fm2.Time = 2
+	up = e.UploadFileDelta(bytes.NewReader(cur), fm2, v, mustList(t, v, "/my/file"))
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+	if n := up.Stats().SkippedBlocks; n != 3 {
+		t.Fatalf("exp 3 linked blocks, got %d", n)
+	}
+
+	w := &writerAt{}
+	down, err := e.DownloadFile(w, blob.LatestBlocks(mustList(t, v, "/my/file")), v)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if err := down.Err(); err != nil {
+		t.Fatalf("exp no download err, got %s", err)
+	}
+	if !bytes.Equal(w.buf, cur) {
+		t.Fatalf("exp %q, got %q", cur, w.buf)
+	}
+}
+
+// unlinkableVolume is a MemVolume that fails to link any block.
+type unlinkableVolume struct {
+	*blob.MemVolume
+}
+
+func (v unlinkableVolume) LinkBlock(bm, src *blob.BlockMeta) error {
+	return errors.New("source block is gone")
+}
+
+func TestEngine_UploadFileDelta_LinkFails(t *testing.T) {
+	e := engine.NewEngine(2, 2)
+	v := blob.NewMemVolume()
+
+	old := []byte("aaaabbbbcccc")
+	fm1, err := blob.NewFileMeta(bytes.NewReader(old))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm1.Path = "/my/file"
+	fm1.BlockSize = 4
+	fm1.Time = 1
+	up := e.UploadFile(bytes.NewReader(old), fm1, v)
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp no upload err, got %s", err)
+	}
+
+	cur := []byte("aaaaXXXXcccc")
+	fm2, err := blob.NewFileMeta(bytes.NewReader(cur))
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	fm2.Path = "/my/file"
+	fm2.BlockSize = 4
+	fm2.Time = 2
+	up = e.UploadFileDelta(bytes.NewReader(cur), fm2, unlinkableVolume{v}, mustList(t, v, "/my/file"))
+	up.Wait()
+	if err := up.Err(); err != nil {
+		t.Fatalf("exp blocks that failed to link to be uploaded, got %s", err)
+	}
+	if n := up.Stats().SkippedBlocks; n != 0 {
+		t.Fatalf("exp no skipped blocks, got %d", n)
+	}
+
+	w := &writerAt{}
+	down, err := e.DownloadFile(w, blob.LatestBlocks(mustList(t, v, "/my/file")), v)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	down.Wait()
+	if err := down.Err(); err != nil {
+		t.Fatalf("exp no download err, got %s", err)
+	}
+	if !bytes.Equal(w.buf, cur) {
+		t.Fatalf("exp %q, got %q", cur, w.buf)
+	}
+}
+
+func mustList(t *testing.T, v blob.Volume, path string) []*blob.BlockMeta {
+	t.Helper()
+	bms, err := v.ListBlocks(path, blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err listing %s, got %s", path, err)
+	}
+	return bms
+}
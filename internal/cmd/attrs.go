@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+)
+
+// metaFlag collects repeated -meta key=value flags.
+// The keys mode, mtime, owner and content-type override the attributes read from the local file;
+// any other key is stored as a label.
+type metaFlag map[string]string
+
+func (m metaFlag) String() string {
+	return formatLabels(m)
+}
+
+func (m metaFlag) Set(kv string) error {
+	eq := strings.IndexByte(kv, '=')
+	if eq <= 0 {
+		return fmt.Errorf("expected key=value, got %q", kv)
+	}
+	m[kv[:eq]] = kv[eq+1:]
+	return nil
+}
+
+// localAttrs returns the attributes of the open local file f, overridden by meta.
+func localAttrs(f *os.File, meta metaFlag) (blob.Attrs, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return blob.Attrs{}, err
+	}
+	a := blob.Attrs{
+		Mode:        info.Mode(),
+		ModTime:     info.ModTime().UnixNano(),
+		Owner:       fileOwner(info),
+		ContentType: mime.TypeByExtension(filepath.Ext(f.Name())),
+	}
+	if a.ContentType == "" {
+		head := make([]byte, 512)
+		n, _ := f.ReadAt(head, 0)
+		a.ContentType = http.DetectContentType(head[:n])
+	}
+
+	for k, v := range meta {
+		switch k {
+		case "mode":
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil {
+				return blob.Attrs{}, fmt.Errorf("mode must be octal: %v", err)
+			}
+			a.Mode = os.FileMode(mode)
+		case "mtime":
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return blob.Attrs{}, fmt.Errorf("mtime must be RFC 3339: %v", err)
+			}
+			a.ModTime = t.UnixNano()
+		case "owner":
+			a.Owner = v
+		case "content-type":
+			a.ContentType = v
+		default:
+			if a.Labels == nil {
+				a.Labels = make(map[string]string)
+			}
+			a.Labels[k] = v
+		}
+	}
+	return a, nil
+}
+
+// restoreAttrs applies the mode and modification time of fm, where known, to the local file.
+func restoreAttrs(local string, fm *blob.FileMeta) error {
+	if fm.Attrs.Mode != 0 {
+		if err := os.Chmod(local, fm.Attrs.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if fm.Attrs.ModTime != 0 {
+		mtime := time.Unix(0, fm.Attrs.ModTime)
+		if err := os.Chtimes(local, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatAttrs returns the attributes that are set, tab separated, for stat.
+func formatAttrs(a blob.Attrs) string {
+	var parts []string
+	if a.Mode != 0 {
+		parts = append(parts, fmt.Sprintf("mode %04o", a.Mode.Perm()))
+	}
+	if a.ModTime != 0 {
+		parts = append(parts, "mtime "+time.Unix(0, a.ModTime).UTC().Format(time.RFC3339))
+	}
+	if a.Owner != "" {
+		parts = append(parts, "owner "+a.Owner)
+	}
+	if a.ContentType != "" {
+		parts = append(parts, "type "+a.ContentType)
+	}
+	if len(a.Labels) > 0 {
+		parts = append(parts, "labels "+formatLabels(a.Labels))
+	}
+	return strings.Join(parts, "\t")
+}
+
+// formatLabels returns the labels as comma separated key=value pairs, sorted by key.
+func formatLabels(labels map[string]string) string {
+	kvs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/mark-rushakoff/influx-blob/blob"
@@ -10,84 +13,296 @@ import (
 )
 
 func Main(args []string) error {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	vf := volumeFlags{url: "http://localhost:8086", db: "blob"}
+	vf.register(fs, "")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	// Subcommands see their own name at args[1], as if there were no global flags.
+	args = append(args[:1:1], fs.Args()...)
+
 	if len(args) < 2 {
-		return fmt.Errorf("Usage: %s [up|down|ls] ARGS...", args[0])
+		return fmt.Errorf("Usage: %s [-url URL] [-db DB] [-rp RP] [-dir DIR] [-enc ENCODING] [-schema N] [-max-field BYTES] [up|down|sync|cp|ls|stat|rm|gc|commit|verify|migrate] ARGS...", args[0])
 	}
 
-	v := blob.NewInfluxVolume("http://localhost:8086", "blob", "")
+	v, err := vf.open()
+	if err != nil {
+		return err
+	}
 
-	e := engine.NewEngine(0, 0)
+	// Uploads go through a BatchUploader, which only fills batches
+	// as fast as there are concurrent uploaders to fill them.
+	e := engine.NewEngine(batchUploaders, 0)
 
-	var err error
 	switch args[1] {
 	case "up", "upload":
 		err = up(args, e, v)
 	case "down", "download":
 		err = down(args, e, v)
+	case "sync":
+		err = sync(args, e, v)
+	case "cp", "copy":
+		err = cp(args, e, v, vf)
 	case "ls", "list":
 		err = list(args, v)
+	case "stat":
+		err = stat(args, v)
+	case "rm", "remove":
+		err = remove(args, v)
+	case "gc":
+		err = gc(args, v)
+	case "commit":
+		err = commit(args, v)
+	case "verify", "fsck":
+		err = verify(args, v)
+	case "migrate":
+		err = migrate(args, v)
 	default:
-		err = fmt.Errorf("Available commands: get, put")
+		err = fmt.Errorf("Available commands: up, down, sync, cp, ls, stat, rm, gc, commit, verify, migrate")
 	}
 	return err
 }
 
-func up(args []string, e *engine.Engine, v *blob.InfluxVolume) error {
-	if len(args) != 4 {
-		return fmt.Errorf("Usage: %s up /path/to/local/file /path/on/remote/machine", args[0])
+// volumeFlags selects either InfluxDB databases or a local directory as a volume.
+type volumeFlags struct {
+	url, db, rp string
+	quorum      int
+	dir         string
+	enc         string
+	schema      int
+	maxField    int
+}
+
+// register adds the volume flags to fs, each name starting with prefix.
+// The current values of f are the defaults.
+func (f *volumeFlags) register(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&f.url, prefix+"url", f.url, "InfluxDB HTTP URL; separate multiple URLs with commas to replicate across them")
+	fs.IntVar(&f.quorum, prefix+"quorum", f.quorum, "number of replicas that must accept each block; 0 means all")
+	fs.StringVar(&f.db, prefix+"db", f.db, "InfluxDB database")
+	fs.StringVar(&f.rp, prefix+"rp", f.rp, "InfluxDB retention policy")
+	fs.StringVar(&f.dir, prefix+"dir", f.dir, "use this local directory instead of InfluxDB")
+	fs.StringVar(&f.enc, prefix+"enc", f.enc, "encoding of uploaded blocks: z85, base64, base64raw or ascii85; z85 if not set")
+	fs.IntVar(&f.schema, prefix+"schema", f.schema, "layout of points written to InfluxDB: 1 for block series, 2 for per-file manifests, 3 for one series per version; 2 if not set")
+	fs.IntVar(&f.maxField, prefix+"max-field", f.maxField, "largest string field InfluxDB accepts, in bytes; longer encoded blocks are split across fields; 64 KiB if not set")
+}
+
+func (f *volumeFlags) open() (blob.Volume, error) {
+	if f.dir != "" {
+		return blob.NewDirVolume(f.dir)
 	}
 
-	in, err := os.Open(args[2])
+	enc, err := blob.EncodingByName(f.enc)
 	if err != nil {
+		return nil, err
+	}
+	schema := blob.Schema(f.schema)
+	if schema < 0 || schema > blob.LatestSchema {
+		return nil, fmt.Errorf("unknown schema %d", f.schema)
+	}
+	opts := blob.InfluxVolumeOptions{Encoding: enc, Schema: schema, MaxFieldSize: f.maxField}
+
+	urls := strings.Split(f.url, ",")
+	if len(urls) == 1 {
+		return blob.NewInfluxVolumeWithOptions(f.url, f.db, f.rp, opts), nil
+	}
+	replicas := make([]blob.Volume, len(urls))
+	for i, u := range urls {
+		replicas[i] = blob.NewInfluxVolumeWithOptions(u, f.db, f.rp, opts)
+	}
+	return blob.NewReplicatedVolume(f.quorum, replicas...), nil
+}
+
+const (
+	batchUploaders = 100
+	batchMaxPoints = 50
+)
+
+// uploadOptions are the choices that apply to every file uploaded by up or sync.
+type uploadOptions struct {
+	// Block size in bytes, or zero to choose one according to plan.
+	blockSize int
+	plan      blob.PlanOptions
+	// Upload every block, rather than linking those unchanged from the previous version.
+	full bool
+	// Attributes and labels to set on each file, as given to -meta.
+	meta metaFlag
+}
+
+// uploaderFor returns the BlockUploader that uploads to v go through, which batches blocks if v supports it,
+// and sets the encoding and field size of v in opts.plan, so that block sizes are planned for them.
+func uploaderFor(v blob.Volume, opts *uploadOptions) engine.BlockUploader {
+	if enc, ok := v.(blob.Encoder); ok {
+		opts.plan.Encoding = enc.Encoding()
+	}
+	if l, ok := v.(blob.FieldLimiter); ok {
+		opts.plan.MaxFieldSize = l.MaxFieldSize()
+	}
+	if b, ok := v.(blob.Batcher); ok {
+		return b.Batched(blob.BatchOptions{MaxPoints: batchMaxPoints})
+	}
+	return v
+}
+
+// checkBlockSize returns an error unless bs, given to -bs, is zero for a block size chosen from the file size,
+// or a positive multiple of 4, so that every block but the last Z85-encodes without padding.
+func checkBlockSize(bs int) error {
+	if bs < 0 || bs%4 != 0 {
+		return fmt.Errorf("-bs must be a positive multiple of 4, got %d", bs)
+	}
+	return nil
+}
+
+func up(args []string, e *engine.Engine, v blob.Volume) error {
+	fs := flag.NewFlagSet("up", flag.ContinueOnError)
+	opts := uploadOptions{meta: make(metaFlag)}
+	fs.IntVar(&opts.blockSize, "bs", 0, "block size in bytes; chosen from the file size if not set")
+	recursive := fs.Bool("r", false, "upload every file under a local directory")
+	fs.BoolVar(&opts.full, "full", false, "upload every block, even those unchanged from the previous version")
+	fs.IntVar(&opts.plan.TargetBlocks, "target-blocks", 0, "preferred number of blocks when choosing a block size")
+	fs.IntVar(&opts.plan.MaxLineSize, "max-line", 0, "largest line of line protocol the server accepts, in bytes; InfluxDB's default request body limit of 25 MB if not set")
+	fs.Var(opts.meta, "meta", "key=value label to store with the file; may be repeated. The keys mode, mtime, owner and content-type override the local file's attributes")
+	if err := fs.Parse(args[2:]); err != nil {
 		return err
 	}
-	defer in.Close()
+	if fs.NArg() != 2 {
+		return fmt.Errorf("Usage: %s up [-r] [-full] [-bs BYTES] [-target-blocks N] [-max-line BYTES] [-meta KEY=VALUE]... /path/to/local/file /path/on/remote/machine", args[0])
+	}
 
-	fm, err := blob.NewFileMeta(in)
-	if err != nil {
+	if err := checkBlockSize(opts.blockSize); err != nil {
 		return err
 	}
-	fm.Path = args[3]
-	fm.BlockSize = 1024
-	fm.Time = time.Now().Unix()
 
-	ctx := e.UploadFile(in, fm, v)
+	bu := uploaderFor(v, &opts)
+
+	if *recursive {
+		return upTree(e, v, bu, fs.Arg(0), fs.Arg(1), opts)
+	}
+
+	in, ctx, err := startUpload(e, v, bu, fs.Arg(0), fs.Arg(1), opts, func(fm *blob.FileMeta) {
+		fmt.Printf("Uploading %d bytes as %d blocks of %dB each.\n", fm.Size, fm.NumBlocks(), fm.BlockSize)
+	})
 	if err != nil {
 		return err
 	}
+	defer in.Close()
+	fm := ctx.FileMeta()
 
 	fmt.Println("Put initiated, waiting for completion.")
 	ctx.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	fmt.Println("Put complete!")
 
 	stats := ctx.Stats()
 	uploaders, _ := e.NumWorkers()
 	fmt.Printf("Uploaded %d bytes in %.2fs\n", stats.Bytes, stats.Duration.Seconds())
+	if stats.SkippedBlocks > 0 {
+		fmt.Printf("(%d of %d blocks were unchanged from the previous version and not uploaded again)\n", stats.SkippedBlocks, fm.NumBlocks())
+	}
 	fmt.Printf("(Used %d uploaders and %d chunks of %dB each)\n", uploaders, fm.NumBlocks(), fm.BlockSize)
 
 	return nil
 }
 
-func down(args []string, e *engine.Engine, v *blob.InfluxVolume) error {
-	if len(args) != 4 {
-		return fmt.Errorf("Usage: %s down /path/on/remote/machine /path/to/local/file", args[0])
+// startUpload opens the local file and starts uploading it as a new version of the remote path.
+//
+// Unless opts.full is set, blocks that are unchanged from the latest stored version are linked to it
+// rather than uploaded again, if bu supports that.
+// The latest version's block size is then reused unless opts.blockSize is set, so that unchanged regions line up.
+// If planned is not nil, it is called with the FileMeta of the new version before any block is uploaded.
+func startUpload(e *engine.Engine, v blob.Volume, bu engine.BlockUploader, local, remote string, opts uploadOptions, planned func(fm *blob.FileMeta)) (*os.File, *engine.FileTransferContext, error) {
+	bl, canLink := bu.(engine.BlockLinker)
+
+	var prev []*blob.BlockMeta
+	if canLink && !opts.full {
+		bms, err := v.ListBlocks(remote, blob.ListOptions{})
+		if err != nil && err != blob.ErrNotExist {
+			return nil, nil, err
+		}
+		prev = blob.LatestBlocks(bms)
+		if len(prev) > 0 && opts.blockSize <= 0 {
+			opts.blockSize = prev[0].BlockSize
+		}
 	}
 
-	bms, err := v.ListBlocks(args[2])
+	in, fm, err := openUpload(local, remote, opts)
 	if err != nil {
+		return nil, nil, err
+	}
+	if planned != nil {
+		planned(fm)
+	}
+	if len(prev) > 0 {
+		return in, e.UploadFileDelta(in, fm, bl, prev), nil
+	}
+	return in, e.UploadFile(in, fm, bu), nil
+}
+
+// openUpload opens the local file and returns it with the FileMeta it will be uploaded as,
+// including the file's attributes. Empty files are rejected.
+// A block size of zero chooses one according to opts.plan.
+func openUpload(local, remote string, opts uploadOptions) (*os.File, *blob.FileMeta, error) {
+	in, err := os.Open(local)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fm, err := blob.NewFileMeta(in)
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	if fm.Size == 0 {
+		// As up -r and sync skip, rather than commit a version that down cannot find.
+		in.Close()
+		return nil, nil, fmt.Errorf("%s is empty, and no volume stores a version without blocks", local)
+	}
+	fm.Path = remote
+	fm.Time = time.Now().Unix()
+	if opts.blockSize > 0 {
+		fm.BlockSize = opts.blockSize
+	} else if err := fm.PlanBlockSize(opts.plan); err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	if fm.Attrs, err = localAttrs(in, opts.meta); err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	return in, fm, nil
+}
+
+func down(args []string, e *engine.Engine, v blob.Volume) error {
+	fs := flag.NewFlagSet("down", flag.ContinueOnError)
+	recursive := fs.Bool("r", false, "download every file under a remote prefix into a local directory")
+	var lopts blob.ListOptions
+	fs.BoolVar(&lopts.IncludeUncommitted, "a", false, "include versions that have not been committed")
+	if err := fs.Parse(args[2:]); err != nil {
 		return err
 	}
-	if len(bms) == 0 {
-		return fmt.Errorf("No blocks found for path: %s", args[2])
+	if fs.NArg() != 2 {
+		return fmt.Errorf("Usage: %s down [-r] [-a] /path/on/remote/machine /path/to/local/file", args[0])
+	}
+	if *recursive {
+		return downTree(e, v, fs.Arg(0), fs.Arg(1), lopts)
+	}
+
+	bms, err := v.ListBlocks(fs.Arg(0), lopts)
+	if err == blob.ErrNotExist {
+		return fmt.Errorf("No blocks found for path: %s", fs.Arg(0))
+	} else if err != nil {
+		return err
 	}
+	bms = blob.LatestBlocks(bms)
 
-	out, err := os.OpenFile(args[3], os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	out, err := os.OpenFile(fs.Arg(1), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	// TODO: handle multiple FileMeta
 	ctx, err := e.DownloadFile(out, bms, v)
 	if err != nil {
 		return err
@@ -95,6 +310,9 @@ func down(args []string, e *engine.Engine, v *blob.InfluxVolume) error {
 
 	fmt.Println("Get initiated, waiting for completion.")
 	ctx.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	fmt.Println("Get complete!")
 
 	fm := bms[0].FileMeta
@@ -103,6 +321,9 @@ func down(args []string, e *engine.Engine, v *blob.InfluxVolume) error {
 		return err
 	}
 	fmt.Println("Checksum matches. Get successful.")
+	if err := restoreAttrs(fs.Arg(1), fm); err != nil {
+		return err
+	}
 
 	stats := ctx.Stats()
 	_, downloaders := e.NumWorkers()
@@ -112,19 +333,88 @@ func down(args []string, e *engine.Engine, v *blob.InfluxVolume) error {
 	return nil
 }
 
+// cp copies every version of a file, or of every file under a prefix, to another path or volume.
+// The destination volume defaults to the source volume.
+func cp(args []string, e *engine.Engine, src blob.Volume, srcFlags volumeFlags) error {
+	fs := flag.NewFlagSet("cp", flag.ContinueOnError)
+	prefix := fs.Bool("prefix", false, "treat the source and destination paths as prefixes")
+	to := srcFlags
+	to.register(fs, "to-")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if n := fs.NArg(); n != 1 && n != 2 {
+		return fmt.Errorf("Usage: %s cp [-prefix] [-to-url URL] [-to-db DB] [-to-rp RP] [-to-dir DIR] /path/on/source [/path/on/destination]", args[0])
+	}
+	srcPath, dstPath := fs.Arg(0), fs.Arg(0)
+	if fs.NArg() == 2 {
+		dstPath = fs.Arg(1)
+	}
+
+	dst, err := to.open()
+	if err != nil {
+		return err
+	}
+
+	var ctxs []*engine.FileTransferContext
+	if *prefix {
+		ctxs, err = e.CopyPrefix(srcPath, src, dst, dstPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		bms, err := src.ListBlocks(srcPath, blob.ListOptions{})
+		if err == blob.ErrNotExist {
+			return fmt.Errorf("No blocks found for path: %s", srcPath)
+		} else if err != nil {
+			return err
+		}
+		for _, fm := range blob.FileMetas(bms) {
+			ctx, err := e.CopyFile(blob.BlocksOf(fm, bms), src, dst, dstPath)
+			if err != nil {
+				return err
+			}
+			ctxs = append(ctxs, ctx)
+		}
+	}
+
+	var failed int
+	for _, ctx := range ctxs {
+		ctx.Wait()
+		fm := ctx.FileMeta()
+		if err := ctx.Err(); err != nil {
+			failed++
+			fmt.Printf("Failed to copy %s (sha256 %x): %v\n", fm.Path, fm.SHA256[:], err)
+			continue
+		}
+		stats := ctx.Stats()
+		fmt.Printf("Copied %s (sha256 %x): %d blocks, %d already present, in %.2fs\n",
+			fm.Path, fm.SHA256[:], len(ctx.Blocks), stats.SkippedBlocks, stats.Duration.Seconds())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d versions failed to copy", failed, len(ctxs))
+	}
+
+	return nil
+}
+
 // list shows all files that match the supplied prefix.
-func list(args []string, v *blob.InfluxVolume) error {
-	if l := len(args); l != 2 && l != 3 {
-		return fmt.Errorf("Usage: %s inspect [/path/prefix]", args[0])
+func list(args []string, v blob.Volume) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	opts := blob.ListOptions{ListMatch: blob.ByPrefix}
+	fs.BoolVar(&opts.IncludeUncommitted, "a", false, "include files that have no committed version")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("Usage: %s ls [-a] [/path/prefix]", args[0])
 	}
 
 	pattern := "/"
-	if len(args) == 3 {
-		pattern = args[2]
+	if fs.NArg() == 1 {
+		pattern = fs.Arg(0)
 	}
-	files, err := v.ListFiles(pattern, blob.ListOptions{
-		ListMatch: blob.ByPrefix,
-	})
+	files, err := v.ListFiles(pattern, opts)
 	if err != nil {
 		return err
 	}
@@ -135,3 +425,270 @@ func list(args []string, v *blob.InfluxVolume) error {
 
 	return nil
 }
+
+// stat shows every version of the file at the supplied path.
+func stat(args []string, v blob.Volume) error {
+	fs := flag.NewFlagSet("stat", flag.ContinueOnError)
+	var opts blob.ListOptions
+	fs.BoolVar(&opts.IncludeUncommitted, "a", false, "include versions that have not been committed")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("Usage: %s stat [-a] /path/on/remote/machine", args[0])
+	}
+
+	fms, err := v.Stat(fs.Arg(0), opts)
+	if err == blob.ErrNotExist {
+		return fmt.Errorf("No file found for path: %s", fs.Arg(0))
+	} else if err != nil {
+		return err
+	}
+
+	for _, fm := range fms {
+		state := "committed"
+		if !fm.Committed {
+			state = "uncommitted"
+		}
+		line := fmt.Sprintf("%s\t%s\t%d bytes\t%d blocks of %dB\tsha256 %x\t%s",
+			fm.Path, time.Unix(fm.Time, 0).UTC().Format(time.RFC3339), fm.Size, fm.NumBlocks(), fm.BlockSize, fm.SHA256[:], state)
+		if fm.Schema != 0 {
+			line += fmt.Sprintf("\tschema %d", fm.Schema)
+		}
+		if !fm.Attrs.IsZero() {
+			line += "\t" + formatAttrs(fm.Attrs)
+		}
+		fmt.Println(line)
+	}
+
+	return nil
+}
+
+// remove deletes every version of the file at the supplied path, committed or not.
+func remove(args []string, v blob.Volume) error {
+	if len(args) != 3 {
+		return fmt.Errorf("Usage: %s rm /path/on/remote/machine", args[0])
+	}
+
+	fms, err := v.Stat(args[2], blob.ListOptions{IncludeUncommitted: true})
+	if err == blob.ErrNotExist {
+		return fmt.Errorf("No file found for path: %s", args[2])
+	} else if err != nil {
+		return err
+	}
+
+	for _, fm := range fms {
+		if err := v.Delete(fm); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Removed %d version(s) of %s\n", len(fms), args[2])
+
+	return nil
+}
+
+// commit commits the complete but uncommitted versions of a file, or of every file under a prefix,
+// such as those uploaded before commits existed.
+func commit(args []string, v blob.Volume) error {
+	fs := flag.NewFlagSet("commit", flag.ContinueOnError)
+	prefix := fs.Bool("prefix", false, "commit every file under the path")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("Usage: %s commit [-prefix] /path/on/remote/machine", args[0])
+	}
+
+	paths := []string{fs.Arg(0)}
+	if *prefix {
+		var err error
+		paths, err = v.ListFiles(fs.Arg(0), blob.ListOptions{ListMatch: blob.ByPrefix, IncludeUncommitted: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	var n int
+	for _, p := range paths {
+		fms, err := blob.CommitComplete(v, p)
+		if err == blob.ErrNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, fm := range fms {
+			fmt.Printf("Committed %s (sha256 %x)\n", fm.Path, fm.SHA256[:])
+		}
+		n += len(fms)
+	}
+	fmt.Printf("Committed %d version(s)\n", n)
+	return nil
+}
+
+// gc deletes incomplete versions, and optionally all but the newest versions, of files under a prefix.
+func gc(args []string, v blob.Volume) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	var opts blob.GCOptions
+	fs.DurationVar(&opts.GracePeriod, "grace", time.Hour, "incomplete versions younger than this are assumed to still be uploading")
+	fs.IntVar(&opts.KeepVersions, "keep", 0, "if positive, keep only this many of the newest complete versions of each file")
+	dryRun := fs.Bool("dry-run", false, "only report what would be deleted")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("Usage: %s gc [-grace DURATION] [-keep N] [-dry-run] [/path/prefix]", args[0])
+	}
+
+	prefix := "/"
+	if fs.NArg() == 1 {
+		prefix = fs.Arg(0)
+	}
+	garbage, err := blob.FindGarbage(v, prefix, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range garbage {
+		fmt.Printf("%s\t%s\t%s\t%d of %d blocks\tsha256 %x\n",
+			g.Reason, g.Path, time.Unix(g.Time, 0).UTC().Format(time.RFC3339), g.Blocks, g.NumBlocks(), g.SHA256[:])
+	}
+	if *dryRun || len(garbage) == 0 {
+		fmt.Printf("%d version(s) to remove\n", len(garbage))
+		return nil
+	}
+
+	if err := blob.CollectGarbage(v, garbage); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d version(s)\n", len(garbage))
+	return nil
+}
+
+// verifySummary totals the reports of a verify run. It is printed as the final line of output.
+type verifySummary struct {
+	Files    int                       `json:"files"`
+	Versions int                       `json:"versions"`
+	OK       int                       `json:"ok"`
+	Failed   int                       `json:"failed"`
+	Problems map[blob.BlockProblem]int `json:"problems"`
+}
+
+// verify reads back every block of a file, or of every file under a prefix, without writing it to disk,
+// and prints one JSON report per version followed by a JSON summary.
+func verify(args []string, v blob.Volume) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	prefix := fs.Bool("prefix", false, "verify every file under the path")
+	var opts blob.ListOptions
+	fs.BoolVar(&opts.IncludeUncommitted, "a", false, "include versions that have not been committed")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("Usage: %s verify [-prefix] [-a] /path/on/remote/machine", args[0])
+	}
+
+	paths := []string{fs.Arg(0)}
+	if *prefix {
+		lopts := opts
+		lopts.ListMatch = blob.ByPrefix
+		var err error
+		paths, err = v.ListFiles(fs.Arg(0), lopts)
+		if err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	sum := verifySummary{Problems: make(map[blob.BlockProblem]int)}
+	for _, p := range paths {
+		reports, err := blob.Verify(v, p, opts)
+		if err == blob.ErrNotExist {
+			if !*prefix {
+				return fmt.Errorf("No file found for path: %s", p)
+			}
+			// Removed since it was listed.
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		sum.Files++
+		for _, r := range reports {
+			sum.Versions++
+			if r.OK() {
+				sum.OK++
+			} else {
+				sum.Failed++
+			}
+			for _, is := range r.Issues {
+				sum.Problems[is.Problem]++
+			}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+	if err := enc.Encode(sum); err != nil {
+		return err
+	}
+
+	if sum.Failed > 0 {
+		return fmt.Errorf("%d of %d versions failed verification", sum.Failed, sum.Versions)
+	}
+	return nil
+}
+
+// migrate rewrites the files under a prefix that were stored with an older schema than -schema selects,
+// first committing the complete versions uploaded before commits existed.
+func migrate(args []string, v blob.Volume) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("Usage: %s migrate [/path/prefix]", args[0])
+	}
+	prefix := "/"
+	if fs.NArg() == 1 {
+		prefix = fs.Arg(0)
+	}
+
+	volumes := []blob.Volume{v}
+	if rv, ok := v.(*blob.ReplicatedVolume); ok {
+		volumes = rv.Replicas()
+	}
+
+	var n int
+	for _, rv := range volumes {
+		iv, ok := rv.(*blob.InfluxVolume)
+		if !ok {
+			return fmt.Errorf("migrate only applies to InfluxDB volumes")
+		}
+
+		// Versions uploaded before commits existed are only migrated once committed.
+		legacy, err := iv.CommitLegacy(prefix)
+		for _, fm := range legacy {
+			fmt.Printf("Committed %s (sha256 %x), uploaded before commits existed\n", fm.Path, fm.SHA256[:])
+		}
+		if err != nil {
+			return err
+		}
+
+		paths, err := iv.ListFiles(prefix, blob.ListOptions{ListMatch: blob.ByPrefix})
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			fms, err := iv.Migrate(p)
+			for _, fm := range fms {
+				fmt.Printf("Migrated %s (sha256 %x) from schema %d to %d\n", fm.Path, fm.SHA256[:], fm.Schema, iv.Schema())
+			}
+			n += len(fms)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("Migrated %d version(s)\n", n)
+	return nil
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+)
+
+func TestBlockSizeFlag(t *testing.T) {
+	for _, cmd := range []func([]string) error{
+		func(args []string) error { return up(args, nil, nil) },
+		func(args []string) error { return sync(args, nil, nil) },
+	} {
+		for _, bs := range []string{"-4", "3", "1025"} {
+			err := cmd([]string{"blob", "cmd", "-bs", bs, "/local", "/remote"})
+			if err == nil || !strings.Contains(err.Error(), "-bs") {
+				t.Fatalf("exp err for -bs %s, got %v", bs, err)
+			}
+		}
+	}
+}
+
+func TestUpEmptyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	v := blob.NewMemVolume()
+	if err := up([]string{"blob", "up", f.Name(), "/remote/empty"}, engine.NewEngine(1, 1), v); err == nil {
+		t.Fatalf("exp err uploading an empty file")
+	}
+	if _, err := v.Stat("/remote/empty", blob.ListOptions{IncludeUncommitted: true}); err != blob.ErrNotExist {
+		t.Fatalf("exp nothing stored, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cmd
+
+import "os"
+
+// fileOwner returns the empty string, as file ownership is not available on this platform.
+func fileOwner(info os.FileInfo) string {
+	return ""
+}
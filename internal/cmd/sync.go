@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+)
+
+// syncPlan is the difference between a source tree and a destination tree.
+type syncPlan struct {
+	// Files missing from the destination.
+	added []*treeFile
+	// Files whose size or checksum differ between source and destination.
+	changed []*treeFile
+	// Files in the destination that are missing from the source.
+	removed []*treeFile
+	// Empty local files, which cannot be uploaded. Their remote copies are left alone.
+	empty []*treeFile
+
+	unchanged int
+}
+
+// print writes one line per difference, followed by a summary.
+func (p *syncPlan) print(show func(t *treeFile) string) {
+	for _, t := range p.added {
+		fmt.Printf("+ %s\n", show(t))
+	}
+	for _, t := range p.changed {
+		fmt.Printf("~ %s\n", show(t))
+	}
+	for _, t := range p.removed {
+		fmt.Printf("- %s\n", show(t))
+	}
+	for _, t := range p.empty {
+		fmt.Printf("! %s is empty and will not be uploaded\n", show(t))
+	}
+	fmt.Printf("%d new, %d changed, %d unchanged, %d only in destination\n",
+		len(p.added), len(p.changed), p.unchanged, len(p.removed))
+}
+
+// transfers returns the files that need to be copied to the destination.
+func (p *syncPlan) transfers() []*treeFile {
+	return append(append([]*treeFile(nil), p.added...), p.changed...)
+}
+
+// sync makes a remote prefix match a local directory, or with -down, the reverse.
+// Only files that are new or whose size or checksum differ from the latest version are transferred.
+func sync(args []string, e *engine.Engine, v blob.Volume) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	reverse := fs.Bool("down", false, "sync from the remote prefix to the local directory instead")
+	del := fs.Bool("delete", false, "delete files in the destination that are missing from the source")
+	dryRun := fs.Bool("dry-run", false, "show what would change without transferring or deleting anything")
+	blockSize := fs.Int("bs", 0, "block size in bytes for uploads; chosen from the file size if not set")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("Usage: %s sync [-delete] [-dry-run] [-bs BYTES] /path/to/local/dir /remote/prefix\n       %s sync -down [-delete] [-dry-run] /remote/prefix /path/to/local/dir", args[0], args[0])
+	}
+
+	if err := checkBlockSize(*blockSize); err != nil {
+		return err
+	}
+
+	if *reverse {
+		return syncDown(e, v, fs.Arg(0), fs.Arg(1), *del, *dryRun)
+	}
+	return syncUp(e, v, fs.Arg(0), fs.Arg(1), *blockSize, *del, *dryRun)
+}
+
+func syncUp(e *engine.Engine, v blob.Volume, localRoot, remotePrefix string, blockSize int, del, dryRun bool) error {
+	plan, err := planUp(v, localRoot, remotePrefix)
+	if err != nil {
+		return err
+	}
+
+	plan.print(func(t *treeFile) string { return t.remote })
+	if dryRun {
+		return nil
+	}
+
+	if files := plan.transfers(); len(files) > 0 {
+		opts := uploadOptions{blockSize: blockSize}
+		bu := uploaderFor(v, &opts)
+		if err := runTree("Uploaded", files, uploadStarter(e, v, bu, opts), nil); err != nil {
+			return err
+		}
+	}
+
+	if del {
+		for _, t := range plan.removed {
+			fms, err := v.Stat(t.remote, blob.ListOptions{})
+			if err != nil {
+				return err
+			}
+			for _, fm := range fms {
+				if err := v.Delete(fm); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("Removed %s\n", t.remote)
+		}
+	}
+	return nil
+}
+
+func syncDown(e *engine.Engine, v blob.Volume, remotePrefix, localRoot string, del, dryRun bool) error {
+	plan, err := planDown(v, remotePrefix, localRoot)
+	if err != nil {
+		return err
+	}
+
+	plan.print(func(t *treeFile) string { return t.local })
+	if dryRun {
+		return nil
+	}
+
+	if files := plan.transfers(); len(files) > 0 {
+		if err := runTree("Downloaded", files, replaceStarter(e, v), replaceFinisher); err != nil {
+			return err
+		}
+	}
+
+	if del {
+		for _, t := range plan.removed {
+			if err := os.Remove(t.local); err != nil {
+				return err
+			}
+			fmt.Printf("Removed %s\n", t.local)
+		}
+	}
+	return nil
+}
+
+// planUp compares the local directory with the remote prefix, for syncing from the former to the latter.
+func planUp(v blob.Volume, localRoot, remotePrefix string) (*syncPlan, error) {
+	local, err := localTree(localRoot, remotePrefix)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := remoteTree(v, remotePrefix, localRoot, blob.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	plan := new(syncPlan)
+	seen := make(map[string]bool, len(local))
+	for _, t := range local {
+		seen[t.remote] = true
+
+		if t.empty {
+			plan.empty = append(plan.empty, t)
+			continue
+		}
+		fm, err := latestRemote(v, t.remote)
+		if err == blob.ErrNotExist {
+			plan.added = append(plan.added, t)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		same, err := sameContent(t.local, fm)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			plan.unchanged++
+		} else {
+			plan.changed = append(plan.changed, t)
+		}
+	}
+	for _, t := range remote {
+		if !seen[t.remote] {
+			plan.removed = append(plan.removed, t)
+		}
+	}
+	return plan, nil
+}
+
+// planDown compares the remote prefix with the local directory, for syncing from the former to the latter.
+// The local directory need not exist yet.
+func planDown(v blob.Volume, remotePrefix, localRoot string) (*syncPlan, error) {
+	remote, err := remoteTree(v, remotePrefix, localRoot, blob.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	local, err := localTree(localRoot, remotePrefix)
+	if os.IsNotExist(err) {
+		local = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	plan := new(syncPlan)
+	seen := make(map[string]bool, len(remote))
+	for _, t := range remote {
+		seen[t.local] = true
+
+		fm, err := latestRemote(v, t.remote)
+		if err == blob.ErrNotExist {
+			// Removed since it was listed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		same, err := sameContent(t.local, fm)
+		if os.IsNotExist(err) {
+			plan.added = append(plan.added, t)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if same {
+			plan.unchanged++
+		} else {
+			plan.changed = append(plan.changed, t)
+		}
+	}
+	for _, t := range local {
+		if !seen[t.local] {
+			plan.removed = append(plan.removed, t)
+		}
+	}
+	return plan, nil
+}
+
+// latestRemote returns the newest version of the file at path.
+func latestRemote(v blob.Volume, path string) (*blob.FileMeta, error) {
+	fms, err := v.Stat(path, blob.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return fms[len(fms)-1], nil
+}
+
+// sameContent reports whether the local file has the size and checksum of fm.
+func sameContent(local string, fm *blob.FileMeta) (bool, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != int64(fm.Size) {
+		return false, nil
+	}
+
+	lfm, err := blob.NewFileMeta(f)
+	if err != nil {
+		return false, err
+	}
+	return lfm.SHA256 == fm.SHA256, nil
+}
+
+// replaceStarter returns a treeStarter that downloads the latest version of the remote file
+// to a temporary file beside the local path. replaceFinisher moves it into place.
+func replaceStarter(e *engine.Engine, v blob.Volume) treeStarter {
+	return func(t *treeFile) error {
+		bms, err := v.ListBlocks(t.remote, blob.ListOptions{})
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(t.local), 0755); err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile(filepath.Dir(t.local), ".tmp")
+		if err != nil {
+			return err
+		}
+		t.f = f
+		t.ctx, err = e.DownloadFile(f, blob.LatestBlocks(bms), v)
+		if err != nil {
+			os.Remove(f.Name())
+		}
+		return err
+	}
+}
+
+// replaceFinisher verifies a download started by replaceStarter,
+// then replaces the local file with it, or removes it on failure.
+func replaceFinisher(t *treeFile, err error) error {
+	if err == nil {
+		err = t.ctx.FileMeta().CompareSHA256Against(t.f)
+	}
+	if err == nil {
+		err = os.Rename(t.f.Name(), t.local)
+	}
+	if err != nil {
+		os.Remove(t.f.Name())
+		return err
+	}
+	return restoreAttrs(t.local, t.ctx.FileMeta())
+}
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+)
+
+// readTree returns the contents of every file under root, keyed by slash-separated path.
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+
+	out := make(map[string]string)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		out[filepath.ToSlash(rel)] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// readRemote returns the contents of the latest version of every file under prefix, keyed by the rest of the path.
+func readRemote(t *testing.T, v blob.Volume, prefix string) map[string]string {
+	t.Helper()
+
+	paths, err := v.ListFiles(prefix+"/", blob.ListOptions{ListMatch: blob.ByPrefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]string)
+	for _, p := range paths {
+		bms, err := v.ListBlocks(p, blob.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content []byte
+		for _, bm := range blob.LatestBlocks(bms) {
+			data, err := v.DownloadBlock(bm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content = append(content, data...)
+		}
+		out[strings.TrimPrefix(p, prefix+"/")] = string(content)
+	}
+	return out
+}
+
+type syncCase struct {
+	name          string
+	local, remote map[string]string
+	del, dryRun   bool
+
+	// Number of files in each part of the plan.
+	added, changed, unchanged, removed, empty int
+	// Contents of the destination once synced.
+	exp map[string]string
+}
+
+// runSyncCases sets up the local directory and remote prefix of each case,
+// checks the plan, syncs in the given direction and checks the destination.
+func runSyncCases(t *testing.T, down bool, cases []syncCase) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "sync")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			writeTree(t, root, c.local)
+
+			v := blob.NewMemVolume()
+			for p, content := range c.remote {
+				putRemote(t, v, "/r/"+p, content)
+			}
+
+			var plan *syncPlan
+			if down {
+				plan, err = planDown(v, "/r", root)
+			} else {
+				plan, err = planUp(v, root, "/r")
+			}
+			if err != nil {
+				t.Fatalf("exp no err planning, got %s", err)
+			}
+			got := []int{len(plan.added), len(plan.changed), plan.unchanged, len(plan.removed), len(plan.empty)}
+			if exp := []int{c.added, c.changed, c.unchanged, c.removed, c.empty}; !reflect.DeepEqual(got, exp) {
+				t.Fatalf("exp added, changed, unchanged, removed and empty %v, got %v", exp, got)
+			}
+
+			e := engine.NewEngine(2, 2)
+			if down {
+				err = syncDown(e, v, "/r", root, c.del, c.dryRun)
+			} else {
+				err = syncUp(e, v, root, "/r", 4, c.del, c.dryRun)
+			}
+			if err != nil {
+				t.Fatalf("exp no err syncing, got %s", err)
+			}
+
+			var dest map[string]string
+			if down {
+				dest = readTree(t, root)
+			} else {
+				dest = readRemote(t, v, "/r")
+			}
+			if !reflect.DeepEqual(dest, c.exp) {
+				t.Fatalf("exp destination %v, got %v", c.exp, dest)
+			}
+		})
+	}
+}
+
+func TestSyncUp(t *testing.T) {
+	runSyncCases(t, false, []syncCase{
+		{
+			name:   "upload",
+			local:  map[string]string{"a": "one", "b": "two, changed", "sub/c": "three"},
+			remote: map[string]string{"b": "two", "sub/c": "three", "d": "four"},
+			added:  1, changed: 1, unchanged: 1, removed: 1,
+			exp: map[string]string{"a": "one", "b": "two, changed", "sub/c": "three", "d": "four"},
+		},
+		{
+			name:   "delete",
+			local:  map[string]string{"a": "one", "b": "two, changed"},
+			remote: map[string]string{"b": "two", "d": "four", "sub/e": "five"},
+			del:    true,
+			added:  1, changed: 1, removed: 2,
+			exp: map[string]string{"a": "one", "b": "two, changed"},
+		},
+		{
+			name:   "dry run",
+			local:  map[string]string{"a": "one", "b": "two, changed"},
+			remote: map[string]string{"b": "two", "d": "four"},
+			del:    true, dryRun: true,
+			added: 1, changed: 1, removed: 1,
+			exp: map[string]string{"b": "two", "d": "four"},
+		},
+		{
+			name:      "empty files are not deleted",
+			local:     map[string]string{"a": "one", "empty": "", "sub/new-empty": ""},
+			remote:    map[string]string{"a": "one", "empty": "was not empty"},
+			del:       true,
+			unchanged: 1, empty: 2,
+			exp: map[string]string{"a": "one", "empty": "was not empty"},
+		},
+	})
+}
+
+func TestSyncDown(t *testing.T) {
+	runSyncCases(t, true, []syncCase{
+		{
+			name:   "download",
+			local:  map[string]string{"b": "two", "sub/c": "three", "d": "four"},
+			remote: map[string]string{"a": "one", "b": "two, changed", "sub/c": "three"},
+			added:  1, changed: 1, unchanged: 1, removed: 1,
+			exp: map[string]string{"a": "one", "b": "two, changed", "sub/c": "three", "d": "four"},
+		},
+		{
+			name:   "delete",
+			local:  map[string]string{"b": "two", "d": "four", "sub/e": "five", "empty": ""},
+			remote: map[string]string{"a": "one", "b": "two, changed"},
+			del:    true,
+			added:  1, changed: 1, removed: 3,
+			exp: map[string]string{"a": "one", "b": "two, changed"},
+		},
+		{
+			name:   "dry run",
+			local:  map[string]string{"b": "two", "d": "four"},
+			remote: map[string]string{"a": "one", "b": "two, changed"},
+			del:    true, dryRun: true,
+			added: 1, changed: 1, removed: 1,
+			exp: map[string]string{"b": "two", "d": "four"},
+		},
+		{
+			name:    "empty local files are replaced",
+			local:   map[string]string{"a": ""},
+			remote:  map[string]string{"a": "one"},
+			changed: 1,
+			exp:     map[string]string{"a": "one"},
+		},
+	})
+}
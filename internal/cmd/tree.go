@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+)
+
+// maxOpenFiles bounds how many files a recursive transfer keeps in flight,
+// so that large trees don't run out of file descriptors.
+const maxOpenFiles = 64
+
+// treeFile is one file of a recursive transfer.
+type treeFile struct {
+	local, remote string
+	// empty is set for local files of zero length, which cannot be uploaded
+	// as no volume stores a version without blocks.
+	empty bool
+
+	f   *os.File
+	ctx *engine.FileTransferContext
+}
+
+// treeStarter opens t.f and starts the transfer of t, setting t.ctx.
+type treeStarter func(t *treeFile) error
+
+// treeFinisher is called with the result of t's transfer once it has completed,
+// and returns the final result for t.
+type treeFinisher func(t *treeFile, err error) error
+
+// runTree transfers files through the shared engine, at most maxOpenFiles at a time,
+// reporting each file as it completes and a summary at the end.
+func runTree(verb string, files []*treeFile, start treeStarter, finish treeFinisher) error {
+	began := time.Now()
+	var (
+		failed, done int
+		bytes        int
+	)
+
+	report := func(t *treeFile, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAILED %s <-> %s: %v\n", t.local, t.remote, err)
+			return
+		}
+		done++
+		var n int
+		var d time.Duration
+		if s := t.ctx.Stats(); s != nil {
+			n, d = s.Bytes, s.Duration
+		}
+		bytes += n
+		fmt.Printf("%s %s <-> %s: %d bytes in %.2fs\n", verb, t.local, t.remote, n, d.Seconds())
+	}
+
+	wait := func(t *treeFile) {
+		defer t.f.Close()
+		t.ctx.Wait()
+		err := t.ctx.Err()
+		if finish != nil {
+			err = finish(t, err)
+		}
+		report(t, err)
+	}
+
+	var inFlight []*treeFile
+	for _, t := range files {
+		if len(inFlight) == maxOpenFiles {
+			wait(inFlight[0])
+			inFlight = inFlight[1:]
+		}
+		if err := start(t); err != nil {
+			if t.f != nil {
+				t.f.Close()
+			}
+			report(t, err)
+			continue
+		}
+		inFlight = append(inFlight, t)
+	}
+	for _, t := range inFlight {
+		wait(t)
+	}
+
+	fmt.Printf("%s %d of %d files, %d bytes in %.2fs\n", verb, done, len(files), bytes, time.Since(began).Seconds())
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(files))
+	}
+	return nil
+}
+
+// upTree uploads every regular file under localRoot to the matching path under remotePrefix.
+func upTree(e *engine.Engine, v blob.Volume, bu engine.BlockUploader, localRoot, remotePrefix string, opts uploadOptions) error {
+	local, err := localTree(localRoot, remotePrefix)
+	if err != nil {
+		return err
+	}
+	var files []*treeFile
+	for _, t := range local {
+		if t.empty {
+			fmt.Printf("Skipping empty file %s\n", t.local)
+			continue
+		}
+		files = append(files, t)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("No files found under %s", localRoot)
+	}
+
+	return runTree("Uploaded", files, uploadStarter(e, v, bu, opts), nil)
+}
+
+// uploadStarter returns a treeStarter that uploads the local file to the remote path as a new version,
+// as startUpload.
+func uploadStarter(e *engine.Engine, v blob.Volume, bu engine.BlockUploader, opts uploadOptions) treeStarter {
+	return func(t *treeFile) error {
+		f, ctx, err := startUpload(e, v, bu, t.local, t.remote, opts, nil)
+		if err != nil {
+			return err
+		}
+		t.f, t.ctx = f, ctx
+		return nil
+	}
+}
+
+// localTree returns every regular file under localRoot,
+// paired with the matching path under remotePrefix.
+// Empty files are included, marked as such, so that sync does not take them for missing files.
+func localTree(localRoot, remotePrefix string) ([]*treeFile, error) {
+	var files []*treeFile
+	err := filepath.Walk(localRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(localRoot, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, &treeFile{
+			local:  p,
+			remote: path.Join(remotePrefix, filepath.ToSlash(rel)),
+			empty:  info.Size() == 0,
+		})
+		return nil
+	})
+	return files, err
+}
+
+// downTree downloads the latest version of every file under remotePrefix
+// to the matching path under localRoot, creating directories as needed.
+func downTree(e *engine.Engine, v blob.Volume, remotePrefix, localRoot string, opts blob.ListOptions) error {
+	files, err := remoteTree(v, remotePrefix, localRoot, opts)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("No files found under %s", remotePrefix)
+	}
+
+	return runTree("Downloaded", files, func(t *treeFile) error {
+		bms, err := v.ListBlocks(t.remote, opts)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(t.local), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(t.local, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		t.f = f
+		t.ctx, err = e.DownloadFile(f, blob.LatestBlocks(bms), v)
+		return err
+	}, func(t *treeFile, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := t.ctx.FileMeta().CompareSHA256Against(t.f); err != nil {
+			return err
+		}
+		return restoreAttrs(t.local, t.ctx.FileMeta())
+	})
+}
+
+// remoteTree returns every file under remotePrefix, paired with the matching path under localRoot.
+// It fails if a remote path, such as one containing "..", would map to a path outside localRoot.
+func remoteTree(v blob.Volume, remotePrefix, localRoot string, opts blob.ListOptions) ([]*treeFile, error) {
+	// Only match whole path elements, so /a/b does not pick up /a/bc.
+	prefix := strings.TrimSuffix(remotePrefix, "/") + "/"
+	opts.ListMatch = blob.ByPrefix
+	paths, err := v.ListFiles(prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*treeFile, len(paths))
+	for i, p := range paths {
+		local := filepath.Join(localRoot, filepath.FromSlash(strings.TrimPrefix(p, prefix)))
+		if !underRoot(localRoot, local) {
+			return nil, fmt.Errorf("remote file %s would be written outside %s", p, localRoot)
+		}
+		files[i] = &treeFile{
+			local:  local,
+			remote: p,
+		}
+	}
+	return files, nil
+}
+
+// underRoot reports whether p names a path strictly inside the directory root.
+func underRoot(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/blob"
+	"github.com/mark-rushakoff/influx-blob/engine"
+)
+
+// writeTree creates each file of contents, keyed by slash-separated path, under root.
+func writeTree(t *testing.T, root string, contents map[string]string) {
+	t.Helper()
+
+	for p, c := range contents {
+		local := filepath.Join(root, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(local, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// putRemote stores content on v as a committed version of path.
+func putRemote(t *testing.T, v blob.Volume, path, content string) {
+	t.Helper()
+
+	fm, err := blob.NewFileMeta(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.Path, fm.BlockSize, fm.Time = path, 4, 1500000000
+	for i := 0; i < fm.NumBlocks(); i++ {
+		bm := fm.NewBlockMeta(i)
+		data := []byte(content[bm.FileOffset() : int(bm.FileOffset())+bm.ExpSize()])
+		if err := bm.SetSHA256(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := v.UploadBlock(data, bm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.Commit(fm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// treePaths returns "local <- remote" for each of files, sorted.
+func treePaths(files []*treeFile) []string {
+	out := make([]string, len(files))
+	for i, f := range files {
+		out[i] = filepath.ToSlash(f.local) + " <- " + f.remote
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestLocalTree(t *testing.T) {
+	root, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeTree(t, root, map[string]string{
+		"a":       "one",
+		"sub/b":   "two",
+		"sub/c/d": "three",
+		"empty":   "",
+	})
+
+	files, err := localTree(root, "/remote/")
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	r := filepath.ToSlash(root)
+	exp := []string{
+		r + "/a <- /remote/a",
+		r + "/empty <- /remote/empty",
+		r + "/sub/b <- /remote/sub/b",
+		r + "/sub/c/d <- /remote/sub/c/d",
+	}
+	if got := treePaths(files); strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("exp %v, got %v", exp, got)
+	}
+	for _, f := range files {
+		if f.empty != strings.HasSuffix(f.remote, "/empty") {
+			t.Fatalf("exp only the empty file marked empty, got %+v", f)
+		}
+	}
+}
+
+func TestRemoteTree(t *testing.T) {
+	v := blob.NewMemVolume()
+	putRemote(t, v, "/remote/a", "one")
+	putRemote(t, v, "/remote/sub/b", "two")
+	putRemote(t, v, "/remotely/c", "not under the prefix")
+
+	files, err := remoteTree(v, "/remote", "/local", blob.ListOptions{})
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	exp := []string{
+		"/local/a <- /remote/a",
+		"/local/sub/b <- /remote/sub/b",
+	}
+	if got := treePaths(files); strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("exp %v, got %v", exp, got)
+	}
+}
+
+func TestRemoteTree_OutsideRoot(t *testing.T) {
+	for _, p := range []string{
+		"/remote/../../etc/passwd",
+		"/remote/sub/../../x",
+		"/remote/..",
+		"/remote/",
+	} {
+		v := blob.NewMemVolume()
+		putRemote(t, v, "/remote/ok", "fine")
+		putRemote(t, v, p, "escape")
+
+		if files, err := remoteTree(v, "/remote", "/local", blob.ListOptions{}); err == nil {
+			t.Fatalf("exp err for remote file %s, got %v", p, treePaths(files))
+		}
+	}
+
+	v := blob.NewMemVolume()
+	putRemote(t, v, "/remote/a..b/..c", "dots in names are fine")
+	if _, err := remoteTree(v, "/remote", "/local", blob.ListOptions{}); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+}
+
+func TestTreeRoundTrip(t *testing.T) {
+	src, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	contents := map[string]string{
+		"a":       "hello world",
+		"sub/b":   "goodbye",
+		"sub/c/d": "a file spanning several blocks",
+	}
+	writeTree(t, src, contents)
+
+	e := engine.NewEngine(2, 2)
+	v := blob.NewMemVolume()
+	if err := upTree(e, v, v, src, "/remote", uploadOptions{blockSize: 4}); err != nil {
+		t.Fatalf("exp no err uploading, got %s", err)
+	}
+	if err := downTree(e, v, "/remote", dst, blob.ListOptions{}); err != nil {
+		t.Fatalf("exp no err downloading, got %s", err)
+	}
+	for p, c := range contents {
+		got, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatalf("exp no err reading %s, got %s", p, err)
+		}
+		if string(got) != c {
+			t.Fatalf("exp %q in %s, got %q", c, p, got)
+		}
+	}
+}
@@ -2,39 +2,138 @@ package influxclient
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// DefaultGzipMinSize is the smallest write body compressed by default.
+// Smaller bodies are not worth the CPU.
+const DefaultGzipMinSize = 16 * 1024
+
 type Client struct {
 	baseURL string
 	c       *http.Client
+
+	opts ClientOptions
 }
 
+// ClientOptions controls the compression of requests and responses.
+type ClientOptions struct {
+	// DisableGzip turns off compression of write bodies and query responses.
+	DisableGzip bool
+
+	// GzipLevel is the compression level for write bodies, as defined in compress/gzip.
+	// Zero means gzip.DefaultCompression; set DisableGzip to turn compression off.
+	GzipLevel int
+
+	// GzipMinSize is the smallest write body that is compressed.
+	// Zero means DefaultGzipMinSize.
+	GzipMinSize int
+}
+
+// NewClient returns a Client with the default options, which compress large writes.
 func NewClient(httpURL string) *Client {
+	return NewClientWithOptions(httpURL, ClientOptions{})
+}
+
+func NewClientWithOptions(httpURL string, opts ClientOptions) *Client {
+	if opts.GzipLevel == 0 {
+		opts.GzipLevel = gzip.DefaultCompression
+	}
+	if opts.GzipMinSize == 0 {
+		opts.GzipMinSize = DefaultGzipMinSize
+	}
+
 	return &Client{
 		baseURL: httpURL,
 		c:       &http.Client{},
+		opts:    opts,
 	}
 }
 
+// do sends req, asking for a gzipped response if compression is enabled,
+// and transparently decompresses a gzipped response body.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if !c.opts.DisableGzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = gzipBody{Reader: gz, body: resp.Body}
+		resp.Header.Del("Content-Encoding")
+	}
+
+	return resp, nil
+}
+
+// gzipBody reads through a gzip.Reader and closes the underlying response body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// gzipTo compresses everything read from r into w at the client's gzip level.
+func (c *Client) gzipTo(w io.Writer, r io.Reader) error {
+	gz, err := gzip.NewWriterLevel(w, c.opts.GzipLevel)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(gz, r); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
 type SendOpts struct {
 	Database        string
 	RetentionPolicy string
 
 	Consistency string
+
+	// Precision is the unit of the timestamps written, such as "ns". Empty means seconds.
+	Precision string
 }
 
 func (c *Client) SendWrite(data []byte, opts SendOpts) error {
+	return c.SendWriteFrom(bytes.NewReader(data), len(data), opts)
+}
+
+// SendWriteFrom streams the line protocol read from body as the request body of a write,
+// compressing it on the fly if size, the exact length of body, is large enough.
+// It allows large writes to be sent without first assembling them in memory.
+// Uncompressed writes are sent with a Content-Length of size, so body must hold exactly that many bytes.
+func (c *Client) SendWriteFrom(body io.Reader, size int, opts SendOpts) error {
 	vals := url.Values{
 		"db":        []string{opts.Database},
 		"precision": []string{"s"},
 	}
+	if opts.Precision != "" {
+		vals.Set("precision", opts.Precision)
+	}
 	if opts.RetentionPolicy != "" {
 		vals.Set("rp", opts.RetentionPolicy)
 	}
@@ -44,12 +143,28 @@ func (c *Client) SendWrite(data []byte, opts SendOpts) error {
 
 	u := c.baseURL + "/write?" + vals.Encode()
 
-	req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	compress := !c.opts.DisableGzip && size >= c.opts.GzipMinSize
+	if compress {
+		pr, pw := io.Pipe()
+		// Unblocks the compressing goroutine if the request ends without reading the whole body.
+		defer pr.Close()
+		go func(src io.Reader) {
+			pw.CloseWithError(c.gzipTo(pw, src))
+		}(body)
+		body = pr
+	}
+
+	req, err := http.NewRequest("POST", u, body)
 	if err != nil {
 		return err
 	}
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	} else {
+		req.ContentLength = int64(size)
+	}
 
-	resp, err := c.c.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -66,148 +181,338 @@ func (c *Client) SendWrite(data []byte, opts SendOpts) error {
 type QueryOpts struct {
 	Database        string
 	RetentionPolicy string
+
+	// Epoch, if set, returns timestamps as integers in the given precision (e.g. "s")
+	// rather than as RFC3339 strings.
+	Epoch string
 }
 
-// ShowSeriesForPath returns all the series keys that exactly match path.
-func (c *Client) ShowSeriesForPath(blobPath string, opts QueryOpts) ([]string, error) {
-	q := fmt.Sprintf("SHOW SERIES FROM %q", blobPath)
+// Query runs the InfluxQL statement q, calling fn with each row of the response as it is decoded.
+// The response is requested in chunks and decoded a token at a time,
+// so memory use stays flat regardless of the number of rows.
+func (c *Client) Query(q string, opts QueryOpts, fn RowFunc) error {
+	return c.query("GET", q, opts, fn)
+}
+
+// Exec runs an InfluxQL statement that modifies the database, such as DROP SERIES.
+func (c *Client) Exec(q string, opts QueryOpts) error {
+	return c.query("POST", q, opts, func(*SeriesHeader, []json.RawMessage) error { return nil })
+}
+
+// DropSeries drops the series of the measurement path whose tags match every key-value pair in tags.
+func (c *Client) DropSeries(path string, tags map[string]string, opts QueryOpts) error {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	conds := make([]string, len(keys))
+	for i, k := range keys {
+		conds[i] = fmt.Sprintf("%q = %s", k, QuoteString(tags[k]))
+	}
+
+	q := fmt.Sprintf("DROP SERIES FROM %q", path)
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return c.Exec(q, opts)
+}
+
+func (c *Client) query(method, q string, opts QueryOpts, fn RowFunc) error {
 	vals := url.Values{
-		"q":  []string{q},
-		"db": []string{opts.Database},
+		"q":       []string{q},
+		"db":      []string{opts.Database},
+		"chunked": []string{"true"},
+	}
+	if opts.RetentionPolicy != "" {
+		vals.Set("rp", opts.RetentionPolicy)
 	}
-	req, err := http.NewRequest("GET", c.baseURL+"/query?"+vals.Encode(), nil)
+	if opts.Epoch != "" {
+		vals.Set("epoch", opts.Epoch)
+	}
+	req, err := http.NewRequest(method, c.baseURL+"/query?"+vals.Encode(), nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	resp, err := c.c.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		// nothing?
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Unexpected status %d. Body: %q", resp.StatusCode, body)
 	}
 
-	var influxResp struct {
-		Results []struct {
-			Series []struct {
-				Values [][]string `json:"values"`
-			} `json:"series"`
-		} `json:"results"`
-	}
+	return decodeRows(resp.Body, fn)
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&influxResp); err != nil {
-		return nil, err
-	}
+// ShowSeriesForPathFunc calls fn with each series key that exactly matches path,
+// without holding the full list of series in memory.
+func (c *Client) ShowSeriesForPathFunc(blobPath string, opts QueryOpts, fn func(sk string) error) error {
+	q := fmt.Sprintf("SHOW SERIES FROM %q", blobPath)
+	return c.Query(q, opts, func(_ *SeriesHeader, row []json.RawMessage) error {
+		if len(row) != 1 {
+			return fmt.Errorf("Expected one entry per Values, got %d", len(row))
+		}
+		var sk string
+		if err := json.Unmarshal(row[0], &sk); err != nil {
+			return err
+		}
+		return fn(sk)
+	})
+}
 
-	if len(influxResp.Results) == 0 {
-		return nil, fmt.Errorf("No results found in: %s", q)
-	}
-	ss := influxResp.Results[0].Series
-	if len(ss) == 0 {
-		return nil, fmt.Errorf("No series found in: %s", q)
-	}
+// BlockSource describes the point that the data of a block was read from.
+type BlockSource struct {
+	// FileSHA256 and BlockSize are the sha256 and bs tags of the point,
+	// identifying the version of the file that stored it.
+	FileSHA256, BlockSize string
 
-	sks := make([]string, len(ss[0].Values))
-	for i, s := range ss[0].Values {
-		sks[i] = s[0]
-	}
+	// Size is the sz tag of the point, or empty if it has none.
+	Size string
 
-	return sks, nil
+	// Encoding is the enc field of the point, or empty if it has none.
+	Encoding string
 }
 
-func (c *Client) GetSingleBlock(db, rp, path string, blockIndex int) ([]byte, error) {
-	q := fmt.Sprintf("SELECT z FROM %q WHERE bi = '%d'", path, blockIndex)
-	vals := url.Values{
-		"q":  []string{q},
-		"db": []string{db},
-		"rp": []string{rp},
-	}
-	req, err := http.NewRequest("GET", c.baseURL+"/query?"+vals.Encode(), nil)
-	if err != nil {
-		return nil, err
+// GetBlocks queries the encoded data of every block of the file version identified by path, fileSHA256 and blockSize
+// whose index is in blockIndexes, in a single request.
+// fn is called with each block index, the source of the block and its encoded data
+// as soon as the row is decoded from the response.
+// The z slice passed to fn is not retained and may be modified by fn.
+func (c *Client) GetBlocks(path, fileSHA256 string, blockSize int, blockIndexes []int, opts QueryOpts, fn func(blockIndex int, src BlockSource, z []byte) error) error {
+	if len(blockIndexes) == 0 {
+		return nil
 	}
 
-	resp, err := c.c.Do(req)
-	if err != nil {
-		return nil, err
+	is := make([]string, len(blockIndexes))
+	for i, bi := range blockIndexes {
+		is[i] = strconv.Itoa(bi)
 	}
-	defer resp.Body.Close()
+	q := fmt.Sprintf("SELECT * FROM %q WHERE bi =~ /^(%s)$/ AND sha256 = '%s' AND bs = '%d'", path, strings.Join(is, "|"), fileSHA256, blockSize)
+
+	return c.queryTagAndZ(q, "bi", opts, func(bi string, src BlockSource, z []byte) error {
+		idx, err := strconv.Atoi(bi)
+		if err != nil {
+			return err
+		}
+		return fn(idx, src, z)
+	})
+}
 
-	var influxResp struct {
-		Results []struct {
-			Series []struct {
-				Values [][]interface{} `json:"values"`
-			} `json:"series"`
-		} `json:"results"`
+// GetBlocksBySHA256 queries the encoded data of blocks in path by their checksum,
+// regardless of which version of the file stored them.
+// fn may be called more than once for the same checksum, if several versions stored that block.
+// As with GetBlocks, fn also receives the source of the block, which tells the versions apart.
+// The z slice passed to fn is not retained and may be modified by fn.
+func (c *Client) GetBlocksBySHA256(path string, blockSHA256s []string, opts QueryOpts, fn func(blockSHA256 string, src BlockSource, z []byte) error) error {
+	if len(blockSHA256s) == 0 {
+		return nil
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&influxResp); err != nil {
-		return nil, err
+	q := fmt.Sprintf("SELECT * FROM %q WHERE bsha256 =~ /^(%s)$/", path, strings.Join(blockSHA256s, "|"))
+	return c.queryTagAndZ(q, "bsha256", opts, fn)
+}
+
+// GetBlocksByField is like GetBlocksBySHA256, but matches the checksums against the string field named field,
+// for blocks whose checksum is stored as a field rather than a tag.
+func (c *Client) GetBlocksByField(path, field string, blockSHA256s []string, opts QueryOpts, fn func(blockSHA256 string, src BlockSource, z []byte) error) error {
+	if len(blockSHA256s) == 0 {
+		return nil
 	}
 
-	if len(influxResp.Results) == 0 {
-		return nil, fmt.Errorf("No results found in: %s", q)
+	q := fmt.Sprintf("SELECT * FROM %q WHERE %q =~ /^(%s)$/", path, field, strings.Join(blockSHA256s, "|"))
+	return c.queryTagAndZ(q, field, opts, fn)
+}
+
+// GetBlocksInRange queries the encoded data of the points of path whose tags match every key-value pair in tags
+// and whose time, in nanoseconds, is between start and end inclusive.
+// fn is called with the time of each point, its source and its encoded data.
+// As with GetBlocks, points without z are skipped and the z slice passed to fn is not retained.
+func (c *Client) GetBlocksInRange(path string, tags map[string]string, start, end int64, opts QueryOpts, fn func(t int64, src BlockSource, z []byte) error) error {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
 	}
-	ss := influxResp.Results[0].Series
-	if len(ss) == 0 {
-		return nil, fmt.Errorf("No series found in: %s", q)
+	sort.Strings(keys)
+
+	q := fmt.Sprintf("SELECT * FROM %q WHERE", path)
+	for _, k := range keys {
+		q += fmt.Sprintf(" %q = %s AND", k, QuoteString(tags[k]))
 	}
+	q += fmt.Sprintf(" time >= %d AND time <= %d", start, end)
 
-	z := ss[0].Values[0][1].(string)
-	return []byte(z), nil
+	opts.Epoch = "ns"
+	return c.queryColumnAndZ(q, "time", opts, func(col json.RawMessage, src BlockSource, z []byte) error {
+		var t int64
+		if err := json.Unmarshal(col, &t); err != nil {
+			return err
+		}
+		return fn(t, src, z)
+	})
 }
 
-func (c *Client) ShowMeasurementsByPrefix(pattern, db string) ([]string, error) {
-	// Sanitize input for an Influx regexp.
-	prefix := regexp.QuoteMeta(pattern)
-	prefix = strings.Replace(pattern, "/", "\\/", -1)
-	q := fmt.Sprintf("SHOW MEASUREMENTS WITH MEASUREMENT =~ /^%s/", prefix)
-	vals := url.Values{
-		"q":  []string{q},
-		"db": []string{db},
+// queryTagAndZ runs q, which must select the tag, the columns of BlockSource and the data of the blocks,
+// calling fn with all three for each row.
+// The data is z, or if it was split across the fields z0, z1, ..., their concatenation.
+// Queries select every column, as the number of those fields is not known in advance.
+// Rows without data, such as those of linked blocks, are skipped.
+func (c *Client) queryTagAndZ(q, tag string, opts QueryOpts, fn func(tag string, src BlockSource, z []byte) error) error {
+	return c.queryColumnAndZ(q, tag, opts, func(col json.RawMessage, src BlockSource, z []byte) error {
+		var tv string
+		if err := json.Unmarshal(col, &tv); err != nil {
+			return err
+		}
+		return fn(tv, src, z)
+	})
+}
+
+// queryColumnAndZ is like queryTagAndZ, but passes the undecoded value of any column, such as time, to fn.
+func (c *Client) queryColumnAndZ(q, column string, opts QueryOpts, fn func(col json.RawMessage, src BlockSource, z []byte) error) error {
+	colIdx, zCol, znCol := -1, -1, -1
+	var srcCols [4]int
+	var partCols []int
+	var lastHeader *SeriesHeader
+	return c.Query(q, opts, func(h *SeriesHeader, row []json.RawMessage) error {
+		if h != lastHeader {
+			colIdx, zCol, znCol = columnIndex(h.Columns, column), columnIndex(h.Columns, "z"), columnIndex(h.Columns, "zn")
+			for i, name := range []string{"sha256", "bs", "sz", "enc"} {
+				srcCols[i] = columnIndex(h.Columns, name)
+			}
+			// Series holding only linked blocks have no z or zn column at all.
+			if colIdx < 0 {
+				return fmt.Errorf("missing %s column in response to: %s", column, q)
+			}
+			partCols = partCols[:0]
+			for i := 0; columnIndex(h.Columns, fmt.Sprintf("z%d", i)) >= 0; i++ {
+				partCols = append(partCols, columnIndex(h.Columns, fmt.Sprintf("z%d", i)))
+			}
+			lastHeader = h
+		}
+		if len(row) != len(h.Columns) {
+			return fmt.Errorf("short row in response to: %s", q)
+		}
+
+		z, err := rowData(row, zCol, znCol, partCols)
+		if err != nil {
+			return fmt.Errorf("%v in response to: %s", err, q)
+		}
+		if z == nil {
+			return nil
+		}
+		var src BlockSource
+		for i, dst := range []*string{&src.FileSHA256, &src.BlockSize, &src.Size, &src.Encoding} {
+			if srcCols[i] < 0 {
+				continue
+			}
+			var v *string
+			if err := json.Unmarshal(row[srcCols[i]], &v); err != nil {
+				return err
+			}
+			if v != nil {
+				*dst = *v
+			}
+		}
+		return fn(row[colIdx], src, z)
+	})
+}
+
+// rowData returns the data of the block in row, from the z column, or joined from the columns in partCols,
+// those of z0, z1, ..., if the zn column gives their number.
+// It returns nil if the row has neither.
+func rowData(row []json.RawMessage, zCol, znCol int, partCols []int) ([]byte, error) {
+	var zn *int
+	if znCol >= 0 {
+		if err := json.Unmarshal(row[znCol], &zn); err != nil {
+			return nil, err
+		}
 	}
-	req, err := http.NewRequest("GET", c.baseURL+"/query?"+vals.Encode(), nil)
-	if err != nil {
-		return nil, err
+	if zn == nil {
+		if zCol < 0 {
+			return nil, nil
+		}
+		var z *string
+		if err := json.Unmarshal(row[zCol], &z); err != nil {
+			return nil, err
+		}
+		if z == nil {
+			return nil, nil
+		}
+		return []byte(*z), nil
 	}
 
-	resp, err := c.c.Do(req)
-	if err != nil {
-		return nil, err
+	if *zn > len(partCols) {
+		return nil, fmt.Errorf("missing field z%d of %d", len(partCols), *zn)
 	}
-	defer resp.Body.Close()
+	var data []byte
+	for i, col := range partCols[:*zn] {
+		var part *string
+		if err := json.Unmarshal(row[col], &part); err != nil {
+			return nil, err
+		}
+		if part == nil {
+			return nil, fmt.Errorf("missing field z%d of %d", i, *zn)
+		}
+		data = append(data, *part...)
+	}
+	return data, nil
+}
+
+// QuoteString returns s as an InfluxQL string literal.
+func QuoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
 
-	var influxResp struct {
-		Results []struct {
-			Series []struct {
-				Values [][]string `json:"values"`
-			} `json:"series"`
-		} `json:"results"`
+// PrefixRegex returns an InfluxQL regular expression literal matching strings that begin with prefix.
+func PrefixRegex(prefix string) string {
+	// Sanitize input for an Influx regexp.
+	re := regexp.QuoteMeta(prefix)
+	re = strings.Replace(re, "/", "\\/", -1)
+	return "/^" + re + "/"
+}
+
+// columnIndex returns the index of name in columns, or -1 if it is not present.
+func columnIndex(columns []string, name string) int {
+	for i, c := range columns {
+		if c == name {
+			return i
+		}
 	}
+	return -1
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&influxResp); err != nil {
+func (c *Client) ShowMeasurementsByPrefix(pattern, db string) ([]string, error) {
+	var names []string
+	if err := c.ShowMeasurementsByPrefixFunc(pattern, db, func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
 		return nil, err
 	}
 
-	if len(influxResp.Results) == 0 {
-		return nil, fmt.Errorf("No results found in: %s", q)
-	}
-	ss := influxResp.Results[0].Series
-	if len(ss) == 0 {
+	if len(names) == 0 {
 		return nil, fmt.Errorf("No filenames with prefix %s", pattern)
 	}
-	vs := ss[0].Values
+	return names, nil
+}
 
-	names := make([]string, len(vs))
-	for i, vs := range vs {
-		if len(vs) != 1 {
-			return nil, fmt.Errorf("Expected one entry per Values, got %d", len(vs))
-		}
-		names[i] = vs[0]
-	}
+// ShowMeasurementsByPrefixFunc calls fn with the name of each measurement beginning with pattern,
+// without holding the full list of measurements in memory.
+func (c *Client) ShowMeasurementsByPrefixFunc(pattern, db string, fn func(name string) error) error {
+	q := fmt.Sprintf("SHOW MEASUREMENTS WITH MEASUREMENT =~ %s", PrefixRegex(pattern))
 
-	return names, nil
+	return c.Query(q, QueryOpts{Database: db}, func(_ *SeriesHeader, row []json.RawMessage) error {
+		if len(row) != 1 {
+			return fmt.Errorf("Expected one entry per Values, got %d", len(row))
+		}
+		var name string
+		if err := json.Unmarshal(row[0], &name); err != nil {
+			return err
+		}
+		return fn(name)
+	})
 }
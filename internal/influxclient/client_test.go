@@ -0,0 +1,191 @@
+package influxclient_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/internal/influxclient"
+)
+
+func TestClient_SendWrite_Gzip(t *testing.T) {
+	var gotEncoding string
+	var gotLength int64
+	var gotBody []byte
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		gotLength = r.ContentLength
+		body, _ := ioutil.ReadAll(r.Body)
+		if gotEncoding == "gzip" {
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Errorf("bad gzip body: %s", err)
+			}
+			body, _ = ioutil.ReadAll(gz)
+		}
+		gotBody = body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	large := bytes.Repeat([]byte("m f=1i 1\n"), 4096)
+	small := []byte("m f=1i 1\n")
+
+	for _, tc := range []struct {
+		name    string
+		opts    influxclient.ClientOptions
+		data    []byte
+		expGzip bool
+	}{
+		{name: "large body", data: large, expGzip: true},
+		{name: "small body", data: small, expGzip: false},
+		{name: "custom min size", opts: influxclient.ClientOptions{GzipMinSize: 1, GzipLevel: gzip.BestSpeed}, data: small, expGzip: true},
+		{name: "disabled", opts: influxclient.ClientOptions{DisableGzip: true}, data: large, expGzip: false},
+	} {
+		c := influxclient.NewClientWithOptions(s.URL, tc.opts)
+		if err := c.SendWrite(tc.data, influxclient.SendOpts{Database: "db"}); err != nil {
+			t.Fatalf("%s: exp no err, got %s", tc.name, err)
+		}
+		if (gotEncoding == "gzip") != tc.expGzip {
+			t.Fatalf("%s: exp gzip %v, got Content-Encoding %q", tc.name, tc.expGzip, gotEncoding)
+		}
+		if !bytes.Equal(gotBody, tc.data) {
+			t.Fatalf("%s: server received wrong body", tc.name)
+		}
+		// Compressed bodies are streamed, so only uncompressed ones have a known length.
+		if expLength := int64(len(tc.data)); !tc.expGzip && gotLength != expLength {
+			t.Fatalf("%s: exp Content-Length %d, got %d", tc.name, expLength, gotLength)
+		}
+	}
+}
+
+func TestClient_Query_GzipResponse(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("exp Accept-Encoding gzip, got %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"results":[{"series":[{"name":"measurements","columns":["name"],"values":[["/a/b"],["/a/c"]]}]}]}`))
+		gz.Close()
+	}))
+	defer s.Close()
+
+	c := influxclient.NewClient(s.URL)
+	names, err := c.ShowMeasurementsByPrefix("/a", "db")
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(names) != 2 || names[0] != "/a/b" || names[1] != "/a/c" {
+		t.Fatalf("unexpected measurements: %v", names)
+	}
+}
+
+func TestClient_Query_Chunked(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunked") != "true" {
+			t.Errorf("exp chunked query, got %q", r.URL.RawQuery)
+		}
+		// Two chunks of the same series, then a chunk with a second series.
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"/f","tags":{"bi":"0"},"columns":["time","z"],"values":[["t0","a"],["t1","b"]],"partial":true}],"partial":true}]}`)
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"/f","tags":{"bi":"0"},"columns":["time","z"],"values":[["t2","c"]]}],"partial":true}]}`)
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"series":[{"name":"/f","tags":{"bi":"1"},"columns":["time","z"],"values":[["t3","d"]]}]}]}`)
+	}))
+	defer s.Close()
+
+	var got []string
+	c := influxclient.NewClient(s.URL)
+	if err := c.Query("SELECT z FROM \"/f\" GROUP BY bi", influxclient.QueryOpts{Database: "db"}, func(h *influxclient.SeriesHeader, row []json.RawMessage) error {
+		var z string
+		if err := json.Unmarshal(row[1], &z); err != nil {
+			return err
+		}
+		got = append(got, h.Tags["bi"]+z)
+		return nil
+	}); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	if exp := "0a,0b,0c,1d"; strings.Join(got, ",") != exp {
+		t.Fatalf("exp rows %s, got %s", exp, strings.Join(got, ","))
+	}
+}
+
+func TestClient_Query_Error(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"results":[{"statement_id":0,"error":"database not found: db"}]}`)
+	}))
+	defer s.Close()
+
+	c := influxclient.NewClient(s.URL)
+	err := c.ShowSeriesForPathFunc("/f", influxclient.QueryOpts{Database: "db"}, func(string) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "database not found") {
+		t.Fatalf("exp query error, got %v", err)
+	}
+}
+
+func TestClient_ShowSeriesForPathFunc_BoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 1M series listing in short mode")
+	}
+
+	const (
+		nSeries   = 1000000
+		chunkSize = 10000
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bw := bufio.NewWriter(w)
+		defer bw.Flush()
+		for i := 0; i < nSeries; i += chunkSize {
+			fmt.Fprint(bw, `{"results":[{"statement_id":0,"series":[{"columns":["key"],"values":[`)
+			for j := i; j < i+chunkSize; j++ {
+				if j > i {
+					bw.WriteByte(',')
+				}
+				fmt.Fprintf(bw, `["/my/file,bi=%d,bs=1024,bsha256=%064x,sha256=%064x,sz=1073741824"]`, j, j, 0)
+			}
+			fmt.Fprintln(bw, `]}],"partial":true}]}`)
+		}
+	}))
+	defer s.Close()
+
+	heapAlloc := func() uint64 {
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+	before := heapAlloc()
+	var peak uint64
+
+	n := 0
+	c := influxclient.NewClientWithOptions(s.URL, influxclient.ClientOptions{DisableGzip: true})
+	if err := c.ShowSeriesForPathFunc("/my/file", influxclient.QueryOpts{Database: "db"}, func(sk string) error {
+		n++
+		if n%100000 == 0 {
+			if h := heapAlloc(); h > peak {
+				peak = h
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+
+	if n != nSeries {
+		t.Fatalf("exp %d series, got %d", nSeries, n)
+	}
+	// The response is around 190MB; streaming should hold only a sliver of it at once.
+	const limit = 16 * 1024 * 1024
+	if peak > before && peak-before > limit {
+		t.Fatalf("exp heap growth under %d bytes, got %d", limit, peak-before)
+	}
+}
@@ -0,0 +1,149 @@
+package influxclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// SeriesHeader describes the series that a streamed row belongs to.
+type SeriesHeader struct {
+	Name    string
+	Tags    map[string]string
+	Columns []string
+}
+
+// RowFunc is called once per row of a streamed query response.
+// The header is shared by every row in the same series and must not be modified.
+type RowFunc func(h *SeriesHeader, row []json.RawMessage) error
+
+// decodeRows walks an InfluxDB query response one token at a time,
+// calling fn for each row of values as soon as it is decoded,
+// so that memory use does not grow with the size of the response.
+//
+// Multiple consecutive response objects are accepted, as sent by chunked responses.
+func decodeRows(r io.Reader, fn RowFunc) error {
+	dec := json.NewDecoder(r)
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := decodeObject(dec, func(key string) error {
+			if key != "results" {
+				return skipValue(dec)
+			}
+			return decodeArray(dec, func() error {
+				return decodeResult(dec, fn)
+			})
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+func decodeResult(dec *json.Decoder, fn RowFunc) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	return decodeObject(dec, func(key string) error {
+		switch key {
+		case "error":
+			var msg string
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			return fmt.Errorf("query error: %s", msg)
+		case "series":
+			return decodeArray(dec, func() error {
+				return decodeSeries(dec, fn)
+			})
+		default:
+			return skipValue(dec)
+		}
+	})
+}
+
+func decodeSeries(dec *json.Decoder, fn RowFunc) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	h := new(SeriesHeader)
+	return decodeObject(dec, func(key string) error {
+		switch key {
+		case "name":
+			return dec.Decode(&h.Name)
+		case "tags":
+			return dec.Decode(&h.Tags)
+		case "columns":
+			return dec.Decode(&h.Columns)
+		case "values":
+			return decodeArray(dec, func() error {
+				var row []json.RawMessage
+				if err := dec.Decode(&row); err != nil {
+					return err
+				}
+				return fn(h, row)
+			})
+		default:
+			return skipValue(dec)
+		}
+	})
+}
+
+// decodeObject calls fn for each key of the object whose opening brace has already been read.
+// fn must consume the key's value.
+func decodeObject(dec *json.Decoder, fn func(key string) error) error {
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("exp object key, got %v", t)
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeArray reads an array, calling fn for each element. fn must consume the element.
+// A null in place of the array is treated as empty.
+func decodeArray(dec *json.Decoder, fn func() error) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("exp [, got %v", t)
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, exp json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != exp {
+		return fmt.Errorf("exp %v, got %v", exp, t)
+	}
+	return nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	var discard json.RawMessage
+	return dec.Decode(&discard)
+}
@@ -0,0 +1,217 @@
+package influxtest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Point is a single point as stored by the Server.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	// Field values are int64, float64, string or bool.
+	Fields map[string]interface{}
+	// Time in nanoseconds since the Unix epoch.
+	Time int64
+}
+
+// SeriesKey returns the key of the series the point belongs to, formatted as SHOW SERIES reports it.
+func (p Point) SeriesKey() string {
+	return seriesKey(p.Measurement, p.Tags)
+}
+
+func seriesKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(escape(measurement, ", "))
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(escape(k, ",= "))
+		b.WriteByte('=')
+		b.WriteString(escape(tags[k], ",= "))
+	}
+	return b.String()
+}
+
+func escape(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// precisionMultipliers converts a write's precision parameter to nanoseconds.
+var precisionMultipliers = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1e3,
+	"us": 1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60e9,
+	"h":  3600e9,
+}
+
+// ParseLines parses a line protocol body.
+// Timestamps are multiplied by mul to convert them to nanoseconds,
+// and points without a timestamp are given the time now.
+func ParseLines(body string, mul, now int64) ([]Point, error) {
+	var points []Point
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := parseLine(line, mul, now)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse line %d: %v", i+1, err)
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+func parseLine(line string, mul, now int64) (Point, error) {
+	p := Point{Tags: make(map[string]string), Fields: make(map[string]interface{}), Time: now}
+
+	keyEnd := indexUnescaped(line, 0, ' ', false)
+	if keyEnd < 0 {
+		return p, fmt.Errorf("missing fields")
+	}
+	key := line[:keyEnd]
+	parts := splitUnescaped(key, ',')
+	p.Measurement = unescape(parts[0])
+	if p.Measurement == "" {
+		return p, fmt.Errorf("missing measurement")
+	}
+	for _, kv := range parts[1:] {
+		eq := indexUnescaped(kv, 0, '=', false)
+		if eq < 0 {
+			return p, fmt.Errorf("missing tag value in %q", kv)
+		}
+		p.Tags[unescape(kv[:eq])] = unescape(kv[eq+1:])
+	}
+
+	rest := line[keyEnd+1:]
+	fieldsEnd := indexUnescaped(rest, 0, ' ', true)
+	fields := rest
+	if fieldsEnd >= 0 {
+		fields = rest[:fieldsEnd]
+		ts := strings.TrimSpace(rest[fieldsEnd+1:])
+		if ts != "" {
+			n, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return p, fmt.Errorf("bad timestamp %q", ts)
+			}
+			p.Time = n * mul
+		}
+	}
+
+	for _, kv := range splitFields(fields) {
+		eq := indexUnescaped(kv, 0, '=', false)
+		if eq < 0 {
+			return p, fmt.Errorf("missing field value in %q", kv)
+		}
+		v, err := parseFieldValue(kv[eq+1:])
+		if err != nil {
+			return p, err
+		}
+		p.Fields[unescape(kv[:eq])] = v
+	}
+	if len(p.Fields) == 0 {
+		return p, fmt.Errorf("missing fields")
+	}
+
+	return p, nil
+}
+
+func parseFieldValue(v string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+			return nil, fmt.Errorf("unterminated string %q", v)
+		}
+		r := strings.NewReplacer(`\"`, `"`, `\\`, `\`)
+		return r.Replace(v[1 : len(v)-1]), nil
+	case strings.HasSuffix(v, "i"):
+		return strconv.ParseInt(v[:len(v)-1], 10, 64)
+	case v == "t" || v == "T" || v == "true" || v == "True" || v == "TRUE":
+		return true, nil
+	case v == "f" || v == "F" || v == "false" || v == "False" || v == "FALSE":
+		return false, nil
+	default:
+		return strconv.ParseFloat(v, 64)
+	}
+}
+
+// indexUnescaped returns the index of the first c in s at or after start
+// that is not preceded by a backslash, or -1.
+// If quotes is set, occurrences inside double-quoted strings are skipped.
+func indexUnescaped(s string, start int, c byte, quotes bool) int {
+	inQuote := false
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuote = !inQuote
+		case s[i] == c && !inQuote:
+			return i
+		}
+	}
+	return -1
+}
+
+func splitUnescaped(s string, c byte) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, 0, c, false)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// splitFields splits the field set on commas outside of quoted strings.
+func splitFields(s string) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, 0, ',', true)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package influxtest_test
+
+import (
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+func TestParseLines(t *testing.T) {
+	points, err := influxtest.ParseLines(
+		"my\\ file,a\\,b=c\\=d,e=f x=1i,y=\"say \\\"hi\\\", ok\",z=1.5,w=t 12\n"+
+			"\n"+
+			"other v=false\n",
+		1e9, 99,
+	)
+	if err != nil {
+		t.Fatalf("exp no err, got %s", err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("exp 2 points, got %d", len(points))
+	}
+
+	p := points[0]
+	if p.Measurement != "my file" || p.Tags["a,b"] != "c=d" || p.Tags["e"] != "f" {
+		t.Fatalf("wrong measurement or tags: %+v", p)
+	}
+	if p.Fields["x"] != int64(1) || p.Fields["y"] != `say "hi", ok` || p.Fields["z"] != 1.5 || p.Fields["w"] != true {
+		t.Fatalf("wrong fields: %#v", p.Fields)
+	}
+	if p.Time != 12e9 {
+		t.Fatalf("exp time 12s, got %d", p.Time)
+	}
+	if exp := `my\ file,a\,b=c\=d,e=f`; p.SeriesKey() != exp {
+		t.Fatalf("exp series key %s, got %s", exp, p.SeriesKey())
+	}
+
+	if points[1].Time != 99 || points[1].Fields["v"] != false {
+		t.Fatalf("exp default time and bool field, got %+v", points[1])
+	}
+}
@@ -0,0 +1,430 @@
+package influxtest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The statements understood by the Server. This is only the subset of InfluxQL
+// that influxclient issues, not a general implementation.
+type (
+	selectStatement struct {
+		fields      []selectField
+		measurement string
+		where       []condition
+		groupBy     []string
+		groupByAll  bool
+	}
+
+	showSeriesStatement struct {
+		measurement string
+		where       []condition
+	}
+
+	showMeasurementsStatement struct {
+		re *regexp.Regexp
+	}
+
+	dropSeriesStatement struct {
+		measurement string
+		where       []condition
+	}
+
+	dropMeasurementStatement struct {
+		measurement string
+	}
+
+	deleteStatement struct {
+		measurement string
+		where       []condition
+	}
+)
+
+// selectField is either a plain column, * or a call such as last(b).
+type selectField struct {
+	name string
+	call string
+}
+
+// condition compares a tag, a string field or the time against a literal.
+// Conditions in a WHERE clause are always joined by AND.
+type condition struct {
+	key string
+	op  string
+	str string
+	re  *regexp.Regexp
+	num int64
+}
+
+func (c condition) matchTag(v string) bool {
+	switch c.op {
+	case "=":
+		return v == c.str
+	case "!=", "<>":
+		return v != c.str
+	case "=~":
+		return c.re.MatchString(v)
+	case "!~":
+		return !c.re.MatchString(v)
+	}
+	return false
+}
+
+func (c condition) matchTime(t int64) bool {
+	switch c.op {
+	case "=":
+		return t == c.num
+	case "!=", "<>":
+		return t != c.num
+	case "<":
+		return t < c.num
+	case "<=":
+		return t <= c.num
+	case ">":
+		return t > c.num
+	case ">=":
+		return t >= c.num
+	}
+	return false
+}
+
+type token struct {
+	kind byte // 'i' identifier, 's' string, 'r' regex, 'n' number, 'p' punctuation
+	val  string
+}
+
+func tokenize(q string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			s, n, err := readQuoted(q[i:], c)
+			if err != nil {
+				return nil, err
+			}
+			kind := byte('i')
+			if c == '\'' {
+				kind = 's'
+			}
+			toks = append(toks, token{kind: kind, val: s})
+			i += n
+		case c == '/' && len(toks) > 0 && (toks[len(toks)-1].val == "=~" || toks[len(toks)-1].val == "!~"):
+			s, n, err := readQuoted(q[i:], '/')
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{kind: 'r', val: s})
+			i += n
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(q) && q[j] >= '0' && q[j] <= '9' {
+				j++
+			}
+			toks = append(toks, token{kind: 'n', val: q[i:j]})
+			i = j
+		case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+			j := i + 1
+			for j < len(q) && (q[j] == '_' || (q[j]|0x20 >= 'a' && q[j]|0x20 <= 'z') || (q[j] >= '0' && q[j] <= '9')) {
+				j++
+			}
+			toks = append(toks, token{kind: 'i', val: q[i:j]})
+			i = j
+		default:
+			for _, p := range []string{"=~", "!~", "!=", "<>", "<=", ">=", "=", "<", ">", "(", ")", ",", "*", ";"} {
+				if strings.HasPrefix(q[i:], p) {
+					toks = append(toks, token{kind: 'p', val: p})
+					i += len(p)
+					goto next
+				}
+			}
+			return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+		next:
+		}
+	}
+	return toks, nil
+}
+
+// readQuoted reads a string delimited by quote from the start of s,
+// returning the unescaped content and the number of bytes consumed.
+// Inside regexes, only the escaped delimiter is unescaped.
+func readQuoted(s string, quote byte) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == quote || quote != '/') {
+				i++
+			} else {
+				b.WriteByte('\\')
+				continue
+			}
+		case quote:
+			return b.String(), i + 1, nil
+		}
+		b.WriteByte(s[i])
+	}
+	return "", 0, fmt.Errorf("unterminated %c", quote)
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return token{}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// keyword consumes the next token if it is the case-insensitive keyword kw.
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == 'i' && strings.EqualFold(t.val, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kws ...string) error {
+	for _, kw := range kws {
+		if !p.keyword(kw) {
+			return fmt.Errorf("exp %s, got %q", kw, p.peek().val)
+		}
+	}
+	return nil
+}
+
+func (p *parser) punct(v string) bool {
+	if t := p.peek(); t.kind == 'p' && t.val == v {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if t.kind != 'i' {
+		return "", fmt.Errorf("exp identifier, got %q", t.val)
+	}
+	return t.val, nil
+}
+
+// parseQuery parses one or more statements separated by semicolons.
+func parseQuery(q string) ([]interface{}, error) {
+	toks, err := tokenize(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+
+	var stmts []interface{}
+	for p.pos < len(p.toks) {
+		if p.punct(";") {
+			continue
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+		if p.pos < len(p.toks) && !p.punct(";") {
+			return nil, fmt.Errorf("unexpected %q after statement", p.peek().val)
+		}
+	}
+	return stmts, nil
+}
+
+func (p *parser) statement() (interface{}, error) {
+	switch {
+	case p.keyword("SELECT"):
+		return p.selectStatement()
+	case p.keyword("SHOW"):
+		switch {
+		case p.keyword("SERIES"):
+			s := new(showSeriesStatement)
+			if err := p.expect("FROM"); err != nil {
+				return nil, err
+			}
+			var err error
+			if s.measurement, err = p.ident(); err != nil {
+				return nil, err
+			}
+			s.where, err = p.where()
+			return s, err
+		case p.keyword("MEASUREMENTS"):
+			s := &showMeasurementsStatement{re: regexp.MustCompile("")}
+			if p.keyword("WITH") {
+				if err := p.expect("MEASUREMENT"); err != nil {
+					return nil, err
+				}
+				if !p.punct("=~") {
+					return nil, fmt.Errorf("exp =~ in SHOW MEASUREMENTS")
+				}
+				t := p.next()
+				if t.kind != 'r' {
+					return nil, fmt.Errorf("exp regex, got %q", t.val)
+				}
+				re, err := regexp.Compile(t.val)
+				if err != nil {
+					return nil, err
+				}
+				s.re = re
+			}
+			return s, nil
+		}
+	case p.keyword("DROP"):
+		switch {
+		case p.keyword("SERIES"):
+			s := new(dropSeriesStatement)
+			if err := p.expect("FROM"); err != nil {
+				return nil, err
+			}
+			var err error
+			if s.measurement, err = p.ident(); err != nil {
+				return nil, err
+			}
+			s.where, err = p.where()
+			return s, err
+		case p.keyword("MEASUREMENT"):
+			m, err := p.ident()
+			return &dropMeasurementStatement{measurement: m}, err
+		}
+	case p.keyword("DELETE"):
+		s := new(deleteStatement)
+		if err := p.expect("FROM"); err != nil {
+			return nil, err
+		}
+		var err error
+		if s.measurement, err = p.ident(); err != nil {
+			return nil, err
+		}
+		s.where, err = p.where()
+		return s, err
+	}
+	return nil, fmt.Errorf("unsupported statement at %q", p.peek().val)
+}
+
+func (p *parser) selectStatement() (*selectStatement, error) {
+	s := new(selectStatement)
+	for {
+		var f selectField
+		if p.punct("*") {
+			f.name = "*"
+		} else {
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if p.punct("(") {
+				f.call = strings.ToLower(name)
+				if p.punct("*") {
+					name = "*"
+				} else if name, err = p.ident(); err != nil {
+					return nil, err
+				}
+				if !p.punct(")") {
+					return nil, fmt.Errorf("exp ) after %s(%s", f.call, name)
+				}
+			}
+			f.name = name
+		}
+		s.fields = append(s.fields, f)
+		if !p.punct(",") {
+			break
+		}
+	}
+
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.measurement, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if s.where, err = p.where(); err != nil {
+		return nil, err
+	}
+
+	if p.keyword("GROUP") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			if p.punct("*") {
+				s.groupByAll = true
+			} else {
+				tag, err := p.ident()
+				if err != nil {
+					return nil, err
+				}
+				s.groupBy = append(s.groupBy, tag)
+			}
+			if !p.punct(",") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		// Accepted for compatibility; results are small enough to ignore it.
+		p.next()
+	}
+
+	return s, nil
+}
+
+// where parses an optional WHERE clause of conditions joined by AND.
+func (p *parser) where() ([]condition, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil
+	}
+
+	var conds []condition
+	for {
+		var c condition
+		var err error
+		if c.key, err = p.ident(); err != nil {
+			return nil, err
+		}
+		op := p.next()
+		if op.kind != 'p' {
+			return nil, fmt.Errorf("exp operator after %s, got %q", c.key, op.val)
+		}
+		c.op = op.val
+
+		v := p.next()
+		switch v.kind {
+		case 's':
+			c.str = v.val
+		case 'r':
+			if c.re, err = regexp.Compile(v.val); err != nil {
+				return nil, err
+			}
+		case 'n':
+			if c.num, err = strconv.ParseInt(v.val, 10, 64); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("exp literal after %s %s, got %q", c.key, c.op, v.val)
+		}
+		conds = append(conds, c)
+
+		if !p.keyword("AND") {
+			return conds, nil
+		}
+	}
+}
@@ -0,0 +1,678 @@
+// Package influxtest provides a fake InfluxDB HTTP server for hermetic tests of
+// influxclient and the volumes built on it.
+//
+// The server accepts line protocol on /write and answers the subset of InfluxQL
+// that influxclient issues on /query. It is not a general InfluxDB implementation.
+package influxtest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults controls failures injected into the Server's responses.
+type Faults struct {
+	// Latency is added before handling every request.
+	Latency time.Duration
+
+	// FailWrites and FailQueries are the number of upcoming writes and queries
+	// to reject with Status. Each rejected request decrements the count.
+	FailWrites, FailQueries int
+
+	// Status is the HTTP status of rejected requests. Zero means 503.
+	Status int
+
+	// DropPoint, if set, is called for every written point.
+	// Points for which it returns true are acknowledged but never stored.
+	DropPoint func(p Point) bool
+}
+
+// Server is a fake InfluxDB. Databases are created on the first write to them.
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	dbs    map[string]*database
+	faults Faults
+
+	writes, queries int
+}
+
+// database holds every series of every measurement, keyed by measurement then series key.
+type database struct {
+	measurements map[string]map[string]*series
+}
+
+type series struct {
+	tags map[string]string
+	// Fields by time. As in InfluxDB, writing a point with an existing time merges the fields.
+	points map[int64]map[string]interface{}
+}
+
+// NewServer starts and returns a new Server. The caller must call Close when finished.
+func NewServer() *Server {
+	s := &Server{dbs: make(map[string]*database)}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// SetFaults replaces the Server's current fault injection settings.
+func (s *Server) SetFaults(f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+}
+
+// Requests returns the number of write and query requests received, including rejected ones.
+func (s *Server) Requests() (writes, queries int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes, s.queries
+}
+
+// SeriesN returns the number of series stored in db.
+func (s *Server) SeriesN(db string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	if d := s.dbs[db]; d != nil {
+		for _, m := range d.measurements {
+			n += len(m)
+		}
+	}
+	return n
+}
+
+// Points returns a copy of every point stored in measurement of db, ordered by series key and time.
+func (s *Server) Points(db, measurement string) []Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.dbs[db]
+	if d == nil {
+		return nil
+	}
+
+	var points []Point
+	for _, ser := range d.measurements[measurement] {
+		for t, fields := range ser.points {
+			p := Point{Measurement: measurement, Tags: make(map[string]string), Fields: make(map[string]interface{}), Time: t}
+			for k, v := range ser.tags {
+				p.Tags[k] = v
+			}
+			for k, v := range fields {
+				p.Fields[k] = v
+			}
+			points = append(points, p)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		ki, kj := points[i].SeriesKey(), points[j].SeriesKey()
+		if ki != kj {
+			return ki < kj
+		}
+		return points[i].Time < points[j].Time
+	})
+	return points
+}
+
+// WritePoints stores points directly in db, bypassing the HTTP API and fault injection.
+func (s *Server) WritePoints(db string, points ...Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLocked(db, points)
+}
+
+func (s *Server) writeLocked(db string, points []Point) {
+	d := s.dbs[db]
+	if d == nil {
+		d = &database{measurements: make(map[string]map[string]*series)}
+		s.dbs[db] = d
+	}
+
+	for _, p := range points {
+		m := d.measurements[p.Measurement]
+		if m == nil {
+			m = make(map[string]*series)
+			d.measurements[p.Measurement] = m
+		}
+		key := p.SeriesKey()
+		ser := m[key]
+		if ser == nil {
+			ser = &series{tags: p.Tags, points: make(map[int64]map[string]interface{})}
+			m[key] = ser
+		}
+		fields := ser.points[p.Time]
+		if fields == nil {
+			fields = make(map[string]interface{}, len(p.Fields))
+			ser.points[p.Time] = fields
+		}
+		for k, v := range p.Fields {
+			fields[k] = v
+		}
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	f := s.faults
+	var fail bool
+	switch r.URL.Path {
+	case "/write":
+		s.writes++
+		if s.faults.FailWrites > 0 {
+			s.faults.FailWrites--
+			fail = true
+		}
+	case "/query":
+		s.queries++
+		if s.faults.FailQueries > 0 {
+			s.faults.FailQueries--
+			fail = true
+		}
+	}
+	s.mu.Unlock()
+
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	if fail {
+		status := f.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "injected failure", status)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/write":
+		s.serveWrite(w, r, f.DropPoint)
+	case "/query":
+		s.serveQuery(w, r)
+	case "/ping":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveWrite(w http.ResponseWriter, r *http.Request, drop func(Point) bool) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	q := r.URL.Query()
+	mul, ok := precisionMultipliers[q.Get("precision")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid precision %q", q.Get("precision")))
+		return
+	}
+	points, err := ParseLines(string(buf), mul, time.Now().UnixNano())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	kept := points[:0]
+	for _, p := range points {
+		if drop == nil || !drop(p) {
+			kept = append(kept, p)
+		}
+	}
+
+	s.mu.Lock()
+	s.writeLocked(q.Get("db"), kept)
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// result is the JSON representation of one statement's result.
+type result struct {
+	StatementID int          `json:"statement_id"`
+	Series      []resultRows `json:"series,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Partial     bool         `json:"partial,omitempty"`
+}
+
+type resultRows struct {
+	Name    string            `json:"name,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values,omitempty"`
+	Partial bool              `json:"partial,omitempty"`
+}
+
+func (s *Server) serveQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	stmts, err := parseQuery(q.Get("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error parsing query: %v", err))
+		return
+	}
+
+	var out io.Writer = w
+	w.Header().Set("Content-Type", "application/json")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	enc := json.NewEncoder(out)
+
+	chunkSize := 0
+	if q.Get("chunked") == "true" {
+		chunkSize = 10000
+		if n, err := strconv.Atoi(q.Get("chunk_size")); err == nil && n > 0 {
+			chunkSize = n
+		}
+	}
+
+	results := make([]result, len(stmts))
+	s.mu.Lock()
+	for i, stmt := range stmts {
+		results[i] = s.execLocked(q.Get("db"), stmt, q.Get("epoch"))
+		results[i].StatementID = i
+	}
+	s.mu.Unlock()
+
+	if chunkSize == 0 {
+		enc.Encode(map[string][]result{"results": results})
+		return
+	}
+	for _, res := range results {
+		for _, chunk := range chunkResult(res, chunkSize) {
+			enc.Encode(map[string][]result{"results": {chunk}})
+		}
+	}
+}
+
+// chunkResult splits res into results of at most size rows each,
+// marking all but the last as partial, as InfluxDB does for chunked responses.
+func chunkResult(res result, size int) []result {
+	if len(res.Series) == 0 {
+		return []result{res}
+	}
+
+	var chunks []result
+	for si, ser := range res.Series {
+		for start := 0; start == 0 || start < len(ser.Values); start += size {
+			end := start + size
+			if end > len(ser.Values) {
+				end = len(ser.Values)
+			}
+			part := ser
+			part.Values = ser.Values[start:end]
+			part.Partial = end < len(ser.Values)
+			chunks = append(chunks, result{
+				StatementID: res.StatementID,
+				Series:      []resultRows{part},
+				Partial:     si < len(res.Series)-1 || part.Partial,
+			})
+		}
+	}
+	return chunks
+}
+
+func (s *Server) execLocked(db string, stmt interface{}, epoch string) result {
+	d := s.dbs[db]
+	if d == nil {
+		d = &database{measurements: make(map[string]map[string]*series)}
+	}
+
+	switch stmt := stmt.(type) {
+	case *showMeasurementsStatement:
+		var names []string
+		for name, m := range d.measurements {
+			if len(m) > 0 && stmt.re.MatchString(name) {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return result{}
+		}
+		sort.Strings(names)
+		rows := resultRows{Name: "measurements", Columns: []string{"name"}}
+		for _, n := range names {
+			rows.Values = append(rows.Values, []interface{}{n})
+		}
+		return result{Series: []resultRows{rows}}
+
+	case *showSeriesStatement:
+		var keys []string
+		for key, ser := range d.measurements[stmt.measurement] {
+			if matchTags(stmt.where, ser.tags) {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			return result{}
+		}
+		sort.Strings(keys)
+		rows := resultRows{Columns: []string{"key"}}
+		for _, k := range keys {
+			rows.Values = append(rows.Values, []interface{}{k})
+		}
+		return result{Series: []resultRows{rows}}
+
+	case *selectStatement:
+		return execSelect(d, stmt, epoch)
+
+	case *dropSeriesStatement:
+		m := d.measurements[stmt.measurement]
+		for key, ser := range m {
+			if matchTags(stmt.where, ser.tags) {
+				delete(m, key)
+			}
+		}
+		return result{}
+
+	case *dropMeasurementStatement:
+		delete(d.measurements, stmt.measurement)
+		return result{}
+
+	case *deleteStatement:
+		m := d.measurements[stmt.measurement]
+		for key, ser := range m {
+			if !matchTags(stmt.where, ser.tags) {
+				continue
+			}
+			for t := range ser.points {
+				if matchTime(stmt.where, t) {
+					delete(ser.points, t)
+				}
+			}
+			if len(ser.points) == 0 {
+				delete(m, key)
+			}
+		}
+		return result{}
+	}
+
+	return result{Error: fmt.Sprintf("unsupported statement %T", stmt)}
+}
+
+// matchTags reports whether tags satisfy every non-time condition.
+// A missing tag compares as the empty string, as in InfluxDB.
+func matchTags(conds []condition, tags map[string]string) bool {
+	for _, c := range conds {
+		if c.key != "time" && !c.matchTag(tags[c.key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitConditions separates the conditions on the fields of m's points from those on tags and time.
+// As in InfluxDB, a key names a field if any point of the measurement has a field of that name.
+func splitConditions(m map[string]*series, conds []condition) (tagConds, fieldConds []condition) {
+	for _, c := range conds {
+		if c.key != "time" && hasField(m, c.key) {
+			fieldConds = append(fieldConds, c)
+		} else {
+			tagConds = append(tagConds, c)
+		}
+	}
+	return tagConds, fieldConds
+}
+
+func hasField(m map[string]*series, key string) bool {
+	for _, ser := range m {
+		for _, fields := range ser.points {
+			if _, ok := fields[key]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchFields reports whether fields satisfy every field condition.
+// Only string fields are compared; a point without the field never matches.
+func matchFields(conds []condition, fields map[string]interface{}) bool {
+	for _, c := range conds {
+		v, ok := fields[c.key].(string)
+		if !ok || !c.matchTag(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTime reports whether t satisfies every time condition.
+func matchTime(conds []condition, t int64) bool {
+	for _, c := range conds {
+		if c.key == "time" && !c.matchTime(t) {
+			return false
+		}
+	}
+	return true
+}
+
+func formatTime(t int64, epoch string) interface{} {
+	if epoch == "" {
+		return time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+	}
+	if mul, ok := precisionMultipliers[epoch]; ok {
+		return t / mul
+	}
+	return t
+}
+
+type row struct {
+	time   int64
+	tags   map[string]string
+	fields map[string]interface{}
+}
+
+func execSelect(d *database, stmt *selectStatement, epoch string) result {
+	// Gather matching rows into groups according to GROUP BY.
+	groups := make(map[string][]row)
+	groupTags := make(map[string]map[string]string)
+	fieldKeys := make(map[string]bool)
+	tagKeys := make(map[string]bool)
+	tagConds, fieldConds := splitConditions(d.measurements[stmt.measurement], stmt.where)
+	for _, ser := range d.measurements[stmt.measurement] {
+		if !matchTags(tagConds, ser.tags) {
+			continue
+		}
+
+		gt := make(map[string]string)
+		if stmt.groupByAll {
+			for k, v := range ser.tags {
+				gt[k] = v
+			}
+		} else {
+			for _, k := range stmt.groupBy {
+				gt[k] = ser.tags[k]
+			}
+		}
+		gk := seriesKey("", gt)
+		groupTags[gk] = gt
+
+		for k := range ser.tags {
+			tagKeys[k] = true
+		}
+		for t, fields := range ser.points {
+			if !matchTime(stmt.where, t) || !matchFields(fieldConds, fields) {
+				continue
+			}
+			for k := range fields {
+				fieldKeys[k] = true
+			}
+			groups[gk] = append(groups[gk], row{time: t, tags: ser.tags, fields: fields})
+		}
+	}
+
+	// Expand * into every field and tag key, in alphabetical order.
+	var fields []selectField
+	for _, f := range stmt.fields {
+		if f.name != "*" || f.call != "" {
+			fields = append(fields, f)
+			continue
+		}
+		var keys []string
+		for k := range fieldKeys {
+			keys = append(keys, k)
+		}
+		for k := range tagKeys {
+			if !fieldKeys[k] && !groupedBy(stmt, k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fields = append(fields, selectField{name: k})
+		}
+	}
+
+	columns := []string{"time"}
+	for _, f := range fields {
+		if f.call != "" {
+			columns = append(columns, f.call)
+		} else {
+			columns = append(columns, f.name)
+		}
+	}
+
+	gks := make([]string, 0, len(groups))
+	for gk := range groups {
+		gks = append(gks, gk)
+	}
+	sort.Strings(gks)
+
+	var res result
+	for _, gk := range gks {
+		rows := groups[gk]
+		sort.Slice(rows, func(i, j int) bool { return rows[i].time < rows[j].time })
+
+		out := resultRows{Name: stmt.measurement, Columns: columns}
+		if stmt.groupByAll || len(stmt.groupBy) > 0 {
+			out.Tags = groupTags[gk]
+		}
+		if fields[0].call != "" {
+			if v := aggregate(fields, rows, epoch); v != nil {
+				out.Values = [][]interface{}{v}
+			}
+		} else {
+			for _, r := range rows {
+				v := []interface{}{formatTime(r.time, epoch)}
+				hasField := false
+				for _, f := range fields {
+					if fv, ok := r.fields[f.name]; ok {
+						v = append(v, fv)
+						hasField = true
+					} else if tv, ok := r.tags[f.name]; ok {
+						v = append(v, tv)
+					} else {
+						v = append(v, nil)
+					}
+				}
+				// As in InfluxDB, rows without any selected field are omitted.
+				if hasField {
+					out.Values = append(out.Values, v)
+				}
+			}
+		}
+		if len(out.Values) > 0 {
+			res.Series = append(res.Series, out)
+		}
+	}
+	return res
+}
+
+func groupedBy(stmt *selectStatement, tag string) bool {
+	if stmt.groupByAll {
+		return true
+	}
+	for _, k := range stmt.groupBy {
+		if k == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregate evaluates calls such as last(b) over rows, which are sorted by time.
+// A single selector reports the time of the selected point.
+// As in InfluxDB, other aggregates, and queries with more than one call, report time zero.
+func aggregate(fields []selectField, rows []row, epoch string) []interface{} {
+	var t int64
+	var vals []interface{}
+	found := false
+	for _, f := range fields {
+		var v interface{}
+		switch f.call {
+		case "count":
+			n := int64(0)
+			for _, r := range rows {
+				if _, ok := r.fields[f.name]; ok || f.name == "*" {
+					n++
+				}
+			}
+			if n > 0 {
+				v = n
+			}
+		case "first", "last":
+			for j := range rows {
+				r := rows[j]
+				if f.call == "last" {
+					r = rows[len(rows)-1-j]
+				}
+				if fv, ok := r.fields[f.name]; ok {
+					v = fv
+					if len(fields) == 1 {
+						t = r.time
+					}
+					break
+				}
+			}
+		default:
+			v = nil
+		}
+		if v != nil {
+			found = true
+		}
+		vals = append(vals, v)
+	}
+	if !found {
+		return nil
+	}
+	return append([]interface{}{formatTime(t, epoch)}, vals...)
+}
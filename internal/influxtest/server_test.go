@@ -0,0 +1,49 @@
+package influxtest_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mark-rushakoff/influx-blob/internal/influxtest"
+)
+
+func TestServer_SelectorTime(t *testing.T) {
+	s := influxtest.NewServer()
+	defer s.Close()
+
+	resp, err := http.Post(s.URL+"/write?db=db&precision=s", "text/plain", strings.NewReader("m a=1i,b=2i 10\nm a=3i 20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for q, exp := range map[string]float64{
+		"SELECT last(a) FROM m":          20,
+		"SELECT last(b) FROM m":          10,
+		"SELECT last(a), last(b) FROM m": 0,
+		"SELECT count(a) FROM m":         0,
+	} {
+		resp, err := http.Get(s.URL + "/query?" + url.Values{"db": {"db"}, "epoch": {"s"}, "q": {q}}.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Results []struct {
+				Series []struct {
+					Values [][]interface{}
+				}
+			}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := body.Results[0].Series[0].Values[0][0]; got != exp {
+			t.Fatalf("%s: exp time %v, got %v", q, exp, got)
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 
 func main() {
 	if err := cmd.Main(os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 }